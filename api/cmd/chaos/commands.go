@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/johnnynu/agreatchaos/api/pkg/client"
+)
+
+func downloadCommand(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("download", flag.ContinueOnError)
+	out := flags.String("o", "", "output file, or directory when downloading several files (default: the file name in the current directory)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errors.New("download needs at least one file ID")
+	}
+
+	for _, fileID := range flags.Args() {
+		file, err := c.PreviewFile(ctx, fileID)
+		if err != nil {
+			return fmt.Errorf("%s: %v", fileID, err)
+		}
+
+		// remote names may contain directories, only the last element is used locally
+		target := path.Base(file.FileName)
+		switch {
+		case *out != "" && flags.NArg() == 1:
+			target = *out
+		case *out != "":
+			target = filepath.Join(*out, target)
+		}
+
+		err = downloadFile(ctx, c, file, target)
+		if err != nil {
+			return fmt.Errorf("%s: %v", fileID, err)
+		}
+
+		fmt.Printf("%s\t%s\n", fileID, target)
+	}
+
+	return nil
+}
+
+// downloadFile downloads into a temporary file first, so that a failed or
+// corrupted download never replaces an existing file
+func downloadFile(ctx context.Context, c *client.Client, file *client.File, target string) error {
+	err := os.MkdirAll(filepath.Dir(target), 0o755)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".chaos-download-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	bar := newProgressBar(file.FileName, file.FileSize)
+	w := &progressWriter{w: tmp, onWrite: func(written int64) { bar.Set(written, file.FileSize) }}
+
+	_, err = c.Download(ctx, file.FileID, w)
+	bar.Done()
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), target)
+}
+
+type progressWriter struct {
+	w       *os.File
+	written int64
+	onWrite func(written int64)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.written += int64(n)
+	p.onWrite(p.written)
+	return n, err
+}
+
+func listCommand(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("ls", flag.ContinueOnError)
+	name := flags.String("name", "", "only files whose name matches this glob, e.g. 'reports/*.csv'")
+	fileType := flags.String("type", "", "only files whose content type starts with this, e.g. image/")
+	minSize := flags.Int64("min-size", 0, "only files of at least this many bytes")
+	maxSize := flags.Int64("max-size", 0, "only files of at most this many bytes")
+	asJSON := flags.Bool("json", false, "print JSON instead of a table")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	files, err := c.ListFiles(ctx)
+	if err != nil {
+		return err
+	}
+
+	matched := []client.File{}
+	for _, file := range files {
+		if *name != "" {
+			ok, err := path.Match(*name, file.FileName)
+			if err != nil {
+				return fmt.Errorf("invalid -name pattern: %v", err)
+			}
+			if !ok {
+				continue
+			}
+		}
+		if !strings.HasPrefix(file.FileType, *fileType) {
+			continue
+		}
+		if file.FileSize < *minSize || (*maxSize > 0 && file.FileSize > *maxSize) {
+			continue
+		}
+
+		matched = append(matched, file)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(matched)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILEID\tSIZE\tUPDATED\tNAME")
+	for _, file := range matched {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", file.FileID, formatBytes(file.FileSize), file.UpdatedAt, file.FileName)
+	}
+
+	return tw.Flush()
+}
+
+func removeCommand(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) == 0 {
+		return errors.New("rm needs at least one file ID")
+	}
+
+	for _, fileID := range args {
+		err := c.DeleteFile(ctx, fileID)
+		if err != nil {
+			return fmt.Errorf("%s: %v", fileID, err)
+		}
+
+		fmt.Printf("deleted %s\n", fileID)
+	}
+
+	return nil
+}
+
+// shareCommand prints a presigned link that anyone can download the file with
+// until it expires
+func shareCommand(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("share", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print JSON instead of the bare link")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("share needs exactly one file ID")
+	}
+
+	link, err := c.GenerateDownloadURL(ctx, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return json.NewEncoder(os.Stdout).Encode(link)
+	}
+
+	fmt.Println(link.DownloadURL)
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/johnnynu/agreatchaos/api/pkg/client"
+)
+
+// profile is a section of the config file:
+//
+//	[default]
+//	endpoint = https://4j1h7lzpf5.execute-api.us-east-2.amazonaws.com/dev
+//	token = eyJ...
+//
+//	[ci]
+//	endpoint = https://...
+//	token_command = ./fetch-token.sh
+//
+// token_command is run the first time a token is needed and its trimmed output
+// is used, so CI can fetch a fresh short lived Cognito token. The CHAOS_ENDPOINT
+// and CHAOS_TOKEN environment variables override the profile.
+type profile struct {
+	Endpoint     string
+	Token        string
+	TokenCommand string
+}
+
+// chaosDir is where the config file and upload state live
+func chaosDir() (string, error) {
+	if dir := os.Getenv("CHAOS_HOME"); dir != "" {
+		return dir, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".chaos"), nil
+}
+
+func loadProfile(name string) (*profile, error) {
+	if name == "" {
+		name = "default"
+	}
+
+	dir, err := chaosDir()
+	if err != nil {
+		return nil, err
+	}
+
+	profiles, err := readConfig(filepath.Join(dir, "config"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	p := profiles[name]
+	if p == nil {
+		p = &profile{}
+	}
+
+	if endpoint := os.Getenv("CHAOS_ENDPOINT"); endpoint != "" {
+		p.Endpoint = endpoint
+	}
+	if token := os.Getenv("CHAOS_TOKEN"); token != "" {
+		p.Token = token
+		p.TokenCommand = ""
+	}
+
+	if p.Endpoint == "" {
+		return nil, fmt.Errorf("no endpoint configured for profile %q", name)
+	}
+	if p.Token == "" && p.TokenCommand == "" {
+		return nil, fmt.Errorf("no token or token_command configured for profile %q", name)
+	}
+
+	return p, nil
+}
+
+func readConfig(path string) (map[string]*profile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	profiles := make(map[string]*profile)
+	var current *profile
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") || strings.HasPrefix(text, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]") {
+			current = &profile{}
+			profiles[strings.TrimSpace(text[1:len(text)-1])] = current
+			continue
+		}
+
+		key, value, ok := strings.Cut(text, "=")
+		if !ok || current == nil {
+			return nil, fmt.Errorf("%s:%d: expected a [profile] header or key = value", path, line)
+		}
+
+		switch strings.TrimSpace(key) {
+		case "endpoint":
+			current.Endpoint = strings.TrimSpace(value)
+		case "token":
+			current.Token = strings.TrimSpace(value)
+		case "token_command":
+			current.TokenCommand = strings.TrimSpace(value)
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown key %q", path, line, strings.TrimSpace(key))
+		}
+	}
+
+	return profiles, scanner.Err()
+}
+
+func (p *profile) client() *client.Client {
+	var tokens client.TokenSource = client.StaticToken(p.Token)
+	if p.TokenCommand != "" {
+		var once sync.Once
+		var token string
+		var err error
+		tokens = client.TokenFunc(func(ctx context.Context) (string, error) {
+			once.Do(func() {
+				var out []byte
+				out, err = exec.CommandContext(ctx, "sh", "-c", p.TokenCommand).Output()
+				if err != nil {
+					err = fmt.Errorf("token_command failed: %v", err)
+				}
+				token = strings.TrimSpace(string(out))
+			})
+			return token, err
+		})
+	}
+
+	return client.New(p.Endpoint, tokens)
+}
@@ -0,0 +1,76 @@
+// Command chaos uploads, downloads and manages files in ChaosFiles from a terminal or CI.
+//
+// Usage:
+//
+//	chaos [-profile name] <command> [flags] [args]
+//
+// Commands:
+//
+//	upload [-parallel N] [-dedup] [-prefix p] <path>...   upload files and directories
+//	download [-o path] <fileID>...                        download files
+//	ls [-name glob] [-type prefix] [-min-size n] [-max-size n] [-json]
+//	rm <fileID>...                                        delete files
+//	share [-json] <fileID>                                print a temporary download link
+//	sync [-remote dir] [-delete] [-dry-run] <dir>         mirror a local directory
+//
+// Credentials are read from the profile's section of ~/.chaos/config, see profile.
+// Interrupted multipart uploads are resumed from state kept in ~/.chaos/uploads.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/johnnynu/agreatchaos/api/pkg/client"
+)
+
+type command func(ctx context.Context, c *client.Client, args []string) error
+
+var commands = map[string]command{
+	"upload":   uploadCommand,
+	"download": downloadCommand,
+	"ls":       listCommand,
+	"rm":       removeCommand,
+	"share":    shareCommand,
+	"sync":     syncCommand,
+}
+
+func main() {
+	profileName := flag.String("profile", os.Getenv("CHAOS_PROFILE"), "config profile to use (default \"default\")")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: chaos [-profile name] <upload|download|ls|rm|share|sync> [flags] [args]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "chaos: unknown command %q\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	profile, err := loadProfile(*profileName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "chaos: %v\n", err)
+		os.Exit(1)
+	}
+
+	// stop cleanly on ^C, interrupted uploads are resumed on the next run
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	err = cmd(ctx, profile.client(), flag.Args()[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "chaos: %v\n", err)
+		os.Exit(1)
+	}
+}
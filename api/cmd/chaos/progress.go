@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressBar renders the progress of one transfer on a single stderr line
+type progressBar struct {
+	label string
+	total int64
+
+	mu       sync.Mutex
+	current  int64
+	lastDraw time.Time
+	started  time.Time
+}
+
+func newProgressBar(label string, total int64) *progressBar {
+	return &progressBar{label: label, total: total, started: time.Now()}
+}
+
+// Set records the transferred byte count, redrawing at most ten times a second
+func (p *progressBar) Set(current, total int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.current = current
+	p.total = total
+	if time.Since(p.lastDraw) < 100*time.Millisecond && current < total {
+		return
+	}
+	p.lastDraw = time.Now()
+	p.draw()
+}
+
+// Done finishes the line
+func (p *progressBar) Done() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.draw()
+	fmt.Fprintln(os.Stderr)
+}
+
+func (p *progressBar) draw() {
+	const width = 30
+
+	fraction := 1.0
+	if p.total > 0 {
+		fraction = float64(p.current) / float64(p.total)
+	}
+	// the total is what the API reported, the transfer can end up larger
+	fraction = max(0, min(fraction, 1))
+	filled := int(fraction * width)
+
+	rate := float64(p.current) / time.Since(p.started).Seconds()
+
+	label := p.label
+	if len(label) > 40 {
+		label = "..." + label[len(label)-37:]
+	}
+
+	fmt.Fprintf(os.Stderr, "\r%-40s [%s%s] %5.1f%% %10s %10s/s",
+		label, strings.Repeat("=", filled), strings.Repeat(" ", width-filled),
+		fraction*100, formatBytes(p.current), formatBytes(int64(rate)))
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
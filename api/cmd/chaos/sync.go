@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/johnnynu/agreatchaos/api/pkg/client"
+)
+
+const (
+	syncUpload = "upload"
+	syncUpdate = "update"
+	syncDelete = "delete"
+)
+
+// syncAction is one step of a sync plan
+type syncAction struct {
+	Op     string
+	Name   string
+	Local  string
+	Size   int64
+	Remote []client.File // files replaced or deleted by the action
+	Reason string
+}
+
+// syncCommand mirrors a local directory to the remote files named
+// <remote>/<relative path>. Files are compared by size, then by checksum.
+func syncCommand(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("sync", flag.ContinueOnError)
+	remote := flags.String("remote", "", "remote directory to mirror to (default: the local directory's name)")
+	deleteExtra := flags.Bool("delete", false, "delete remote files that don't exist locally")
+	dryRun := flags.Bool("dry-run", false, "print the plan without changing anything")
+	parallel := flags.Int("parallel", 4, "number of parts uploaded at once")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("sync needs exactly one local directory")
+	}
+
+	root := flags.Arg(0)
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", root)
+	}
+
+	remoteRoot := strings.Trim(*remote, "/")
+	if remoteRoot == "" {
+		remoteRoot = filepath.Base(filepath.Clean(root))
+	}
+
+	plan, unchanged, err := planSync(ctx, c, root, remoteRoot, *deleteExtra)
+	if err != nil {
+		return err
+	}
+
+	for _, action := range plan {
+		fmt.Printf("%-7s %s (%s)\n", action.Op, action.Name, action.Reason)
+	}
+	fmt.Printf("%d to upload, %d to update, %d to delete, %d unchanged\n",
+		countOps(plan, syncUpload), countOps(plan, syncUpdate), countOps(plan, syncDelete), unchanged)
+
+	if *dryRun {
+		return nil
+	}
+
+	settings := uploadSettings{parallel: *parallel, resume: true}
+	for _, action := range plan {
+		if action.Op != syncDelete {
+			err = uploadAndReport(ctx, c, action.Local, action.Name, settings)
+			if err != nil {
+				return err
+			}
+		}
+
+		// replaced files are only deleted once their new version is uploaded
+		for _, file := range action.Remote {
+			err = c.DeleteFile(ctx, file.FileID)
+			if err != nil {
+				return fmt.Errorf("%s: failed to delete %s: %v", action.Name, file.FileID, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// planSync compares the local tree with the remote files under remoteRoot and
+// returns the actions to take, along with the number of files already in sync
+func planSync(ctx context.Context, c *client.Client, root, remoteRoot string, deleteExtra bool) ([]syncAction, int, error) {
+	files, err := c.ListFiles(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	remoteByName := make(map[string][]client.File)
+	for _, file := range files {
+		if strings.HasPrefix(file.FileName, remoteRoot+"/") {
+			remoteByName[file.FileName] = append(remoteByName[file.FileName], file)
+		}
+	}
+
+	var plan []syncAction
+	unchanged := 0
+	seen := make(map[string]bool)
+
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !d.Type().IsRegular() {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+
+		name := path.Join(remoteRoot, filepath.ToSlash(rel))
+		seen[name] = true
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		remote := remoteByName[name]
+		if len(remote) == 0 {
+			plan = append(plan, syncAction{Op: syncUpload, Name: name, Local: p, Size: info.Size(), Reason: "new"})
+			return nil
+		}
+
+		same, reason, err := sameContent(p, info.Size(), remote)
+		if err != nil {
+			return err
+		}
+
+		if same {
+			unchanged++
+			return nil
+		}
+
+		plan = append(plan, syncAction{Op: syncUpdate, Name: name, Local: p, Size: info.Size(), Remote: remote, Reason: reason})
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if deleteExtra {
+		for name, remote := range remoteByName {
+			if !seen[name] {
+				plan = append(plan, syncAction{Op: syncDelete, Name: name, Remote: remote, Reason: "missing locally"})
+			}
+		}
+	}
+
+	sort.SliceStable(plan, func(i, j int) bool {
+		return plan[i].Name < plan[j].Name
+	})
+
+	return plan, unchanged, nil
+}
+
+// sameContent reports whether a local file matches its remote copy. Duplicate
+// remote files with the same name are collapsed into the local file's update.
+func sameContent(localPath string, size int64, remote []client.File) (bool, string, error) {
+	if len(remote) > 1 {
+		return false, fmt.Sprintf("%d remote copies", len(remote)), nil
+	}
+
+	file := remote[0]
+	if file.Status != "" && file.Status != "uploaded" {
+		return false, "remote " + file.Status, nil
+	}
+
+	if file.FileSize != size {
+		return false, fmt.Sprintf("size %d -> %d", file.FileSize, size), nil
+	}
+
+	// files uploaded before checksums existed can only be compared by size
+	if file.ChecksumSHA256 == "" {
+		return true, "", nil
+	}
+
+	local, err := localChecksum(localPath, size, file.ChecksumSHA256)
+	if err != nil {
+		return false, "", err
+	}
+
+	if local != file.ChecksumSHA256 {
+		return false, "checksum differs", nil
+	}
+
+	return true, "", nil
+}
+
+// localChecksum computes the checksum of a local file in the same form as the
+// remote one: whole-object, or composite over the parts Upload would use
+func localChecksum(localPath string, size int64, remote string) (string, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	multipart := strings.Contains(remote, "-")
+	return client.ContentChecksum(f, size, client.DefaultPartSize(size), multipart)
+}
+
+func countOps(plan []syncAction, op string) int {
+	n := 0
+	for _, action := range plan {
+		if action.Op == op {
+			n++
+		}
+	}
+
+	return n
+}
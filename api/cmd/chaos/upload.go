@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/johnnynu/agreatchaos/api/pkg/client"
+)
+
+type uploadSettings struct {
+	parallel int
+	dedup    bool
+	resume   bool
+}
+
+func uploadCommand(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("upload", flag.ContinueOnError)
+	parallel := flags.Int("parallel", 4, "number of parts uploaded at once")
+	dedup := flags.Bool("dedup", false, "store content in shared blobs, skipping files whose content is already stored")
+	prefix := flags.String("prefix", "", "prefix for the remote file names, e.g. builds/1234/")
+	resume := flags.Bool("resume", true, "resume interrupted multipart uploads")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errors.New("upload needs at least one path")
+	}
+
+	settings := uploadSettings{parallel: *parallel, dedup: *dedup, resume: *resume}
+
+	for _, root := range flags.Args() {
+		info, err := os.Stat(root)
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			err = uploadAndReport(ctx, c, root, *prefix+filepath.Base(root), settings)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		// directories keep their own name and relative layout in the remote names
+		base := filepath.Base(filepath.Clean(root))
+		err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || !d.Type().IsRegular() {
+				return err
+			}
+
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return err
+			}
+
+			return uploadAndReport(ctx, c, p, *prefix+path.Join(base, filepath.ToSlash(rel)), settings)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func uploadAndReport(ctx context.Context, c *client.Client, localPath, name string, settings uploadSettings) error {
+	fileID, err := uploadFile(ctx, c, localPath, name, settings)
+	if err != nil {
+		return fmt.Errorf("%s: %v", localPath, err)
+	}
+
+	fmt.Printf("%s\t%s\n", fileID, name)
+	return nil
+}
+
+// uploadFile uploads a local file under the given remote name and returns its
+// file ID. Multipart uploads save their state after every part, so that an
+// interrupted upload of the same unchanged file picks up where it stopped.
+func uploadFile(ctx context.Context, c *client.Client, localPath, name string, settings uploadSettings) (string, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	bar := newProgressBar(name, info.Size())
+	defer bar.Done()
+
+	opts := &client.UploadOptions{
+		ContentType: contentType(localPath),
+		Concurrency: settings.parallel,
+		Dedup:       settings.dedup,
+		Progress:    bar.Set,
+	}
+
+	threshold := int64(client.DefaultMultipartThreshold)
+	if settings.dedup || info.Size() < threshold {
+		return c.Upload(ctx, name, f, info.Size(), opts)
+	}
+
+	statePath, err := uploadStatePath(localPath)
+	if err != nil {
+		return "", err
+	}
+
+	var upload *client.MultipartUpload
+	if settings.resume {
+		upload = loadUploadState(statePath, name, info)
+	}
+	if upload == nil {
+		upload, err = c.StartMultipartUpload(ctx, name, f, info.Size(), opts)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	state := uploadState{Path: localPath, Name: name, Size: info.Size(), ModTime: info.ModTime(), Upload: upload}
+	err = state.save(statePath)
+	if err != nil {
+		return "", err
+	}
+
+	opts.OnPartDone = func(*client.MultipartUpload) {
+		if err := state.save(statePath); err != nil {
+			fmt.Fprintf(os.Stderr, "\nchaos: failed to save upload state: %v\n", err)
+		}
+	}
+
+	err = c.UploadParts(ctx, upload, f, opts)
+	if err != nil {
+		return "", err
+	}
+
+	err = c.FinishMultipartUpload(ctx, upload)
+	if err != nil {
+		return "", err
+	}
+
+	os.Remove(statePath)
+	return upload.FileID, nil
+}
+
+func contentType(localPath string) string {
+	if t := mime.TypeByExtension(filepath.Ext(localPath)); t != "" {
+		return t
+	}
+
+	return "application/octet-stream"
+}
+
+// uploadState is what's kept on disk for an in-flight multipart upload
+type uploadState struct {
+	Path    string                  `json:"path"`
+	Name    string                  `json:"name"`
+	Size    int64                   `json:"size"`
+	ModTime time.Time               `json:"modTime"`
+	Upload  *client.MultipartUpload `json:"upload"`
+
+	// parts finish concurrently, saves are serialized
+	mu sync.Mutex
+}
+
+// uploadStatePath names the state file after the absolute path being uploaded
+func uploadStatePath(localPath string) (string, error) {
+	abs, err := filepath.Abs(localPath)
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := chaosDir()
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256([]byte(abs))
+	return filepath.Join(dir, "uploads", hex.EncodeToString(sum[:16])+".json"), nil
+}
+
+// loadUploadState returns the saved upload for a file, unless the file or its
+// remote name changed since or the upload's part URLs expired
+func loadUploadState(statePath, name string, info os.FileInfo) *client.MultipartUpload {
+	data, err := os.ReadFile(statePath)
+	if err != nil {
+		return nil
+	}
+
+	var state uploadState
+	if json.Unmarshal(data, &state) != nil || state.Upload == nil {
+		return nil
+	}
+
+	if state.Name != name || state.Size != info.Size() || !state.ModTime.Equal(info.ModTime()) {
+		return nil
+	}
+
+	if time.Now().After(state.Upload.ExpiresAt.Add(-time.Hour)) {
+		return nil
+	}
+
+	fmt.Fprintf(os.Stderr, "resuming upload of %s\n", name)
+	return state.Upload
+}
+
+// save writes the state atomically, so a crash never leaves a torn file behind
+func (s *uploadState) save(statePath string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Upload.Lock()
+	data, err := json.Marshal(s)
+	s.Upload.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(statePath), 0o700)
+	if err != nil {
+		return err
+	}
+
+	tmp := statePath + ".tmp"
+	err = os.WriteFile(tmp, data, 0o600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, statePath)
+}
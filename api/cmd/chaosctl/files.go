@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/johnnynu/agreatchaos/api/internal/db"
+)
+
+const bucket = "chaosfiles-filestorage"
+
+func filesList(ctx context.Context, out *output, args []string) error {
+	fs := flag.NewFlagSet("files list", flag.ContinueOnError)
+	uid := fs.String("uid", "", "user ID")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := requireFlag(fs, "uid", *uid); err != nil {
+		return err
+	}
+
+	files, err := db.ListUserFiles(ctx, *uid)
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	rows := make([][]string, 0, len(files)+1)
+	for _, file := range files {
+		total += file.FileSize
+		rows = append(rows, []string{file.FileID, file.FileName, formatBytes(file.FileSize), file.Status, file.UpdatedAt})
+	}
+	rows = append(rows, []string{"", fmt.Sprintf("%d files", len(files)), formatBytes(total), "", ""})
+
+	return out.print(files, []string{"FILEID", "NAME", "SIZE", "STATUS", "UPDATED"}, rows)
+}
+
+func filesURL(ctx context.Context, out *output, args []string) error {
+	fs := flag.NewFlagSet("files url", flag.ContinueOnError)
+	fileID := fs.String("file", "", "file ID")
+	expires := fs.Duration("expires", time.Hour, "how long the URL stays valid")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := requireFlag(fs, "file", *fileID); err != nil {
+		return err
+	}
+
+	file, err := getFile(ctx, *fileID)
+	if err != nil {
+		return err
+	}
+
+	s3Client, err := newS3Client(ctx)
+	if err != nil {
+		return err
+	}
+
+	presignedUrl, err := s3.NewPresignClient(s3Client).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket:                     aws.String(bucket),
+		Key:                        aws.String(file.ObjectKey()),
+		ResponseContentType:        aws.String(file.FileType),
+		ResponseContentDisposition: aws.String(fmt.Sprintf("attachment; filename=%q", file.FileName)),
+		ChecksumMode:               types.ChecksumModeEnabled,
+	}, s3.WithPresignExpires(*expires))
+	if err != nil {
+		return err
+	}
+
+	result := struct {
+		FileID      string `json:"fileId"`
+		DownloadURL string `json:"downloadUrl"`
+		ExpiresAt   string `json:"expiresAt"`
+	}{file.FileID, presignedUrl.URL, time.Now().Add(*expires).Format(time.RFC3339)}
+
+	return out.print(result, []string{"FILEID", "EXPIRES", "URL"}, [][]string{{result.FileID, result.ExpiresAt, result.DownloadURL}})
+}
+
+func filesRemove(ctx context.Context, out *output, args []string) error {
+	fs := flag.NewFlagSet("files rm", flag.ContinueOnError)
+	fileID := fs.String("file", "", "file ID")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := requireFlag(fs, "file", *fileID); err != nil {
+		return err
+	}
+
+	file, err := getFile(ctx, *fileID)
+	if err != nil {
+		return err
+	}
+
+	// delete on behalf of the owner, which also records the pending storage delete
+	_, op, err := db.DeleteFile(ctx, file.FileID, file.UserID)
+	if err != nil {
+		return err
+	}
+
+	storage := "deleted"
+	if op.Kind == db.PendingDeleteObject {
+		s3Client, err := newS3Client(ctx)
+		if err != nil {
+			return err
+		}
+
+		_, err = s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(op.Key),
+		})
+		if err != nil {
+			return fmt.Errorf("file metadata deleted, object left to the pending delete worker: %v", err)
+		}
+
+		err = db.CompletePendingDelete(ctx, op.OpID)
+		if err != nil {
+			return err
+		}
+	} else {
+		// the blob may still be referenced by other files, the worker checks
+		storage = "left to the pending delete worker"
+	}
+
+	result := struct {
+		FileID  string `json:"fileId"`
+		UserID  string `json:"userId"`
+		Storage string `json:"storage"`
+	}{file.FileID, file.UserID, storage}
+
+	return out.print(result, []string{"FILEID", "OWNER", "STORAGE"}, [][]string{{result.FileID, result.UserID, result.Storage}})
+}
+
+func getFile(ctx context.Context, fileID string) (*db.File, error) {
+	file, err := db.GetFile(ctx, fileID)
+	if err != nil {
+		return nil, err
+	}
+	if file == nil {
+		return nil, fmt.Errorf("file %s not found", fileID)
+	}
+
+	return file, nil
+}
+
+func newS3Client(ctx context.Context) (*s3.Client, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load SDK config, %v", err)
+	}
+
+	return s3.NewFromConfig(cfg), nil
+}
@@ -0,0 +1,111 @@
+// Command chaosctl is the operator tool for ChaosFiles users, files and quotas.
+//
+// Usage:
+//
+//	chaosctl [-o table|json] <command> [flags]
+//
+// Commands:
+//
+//	user get -uid UID | -email EMAIL   look up users
+//	files list -uid UID                list a user's files with their sizes
+//	files url -file FILEID             generate a download URL for a file
+//	files rm -file FILEID              delete a file regardless of its owner
+//	usage recompute -uid UID           recompute and store a user's storage usage
+//	quota set -uid UID -bytes N        set a user's storage quota, 0 removes it
+//	export -uid UID                    export a user's metadata as JSON
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// command runs a subcommand with its remaining arguments
+type command func(ctx context.Context, out *output, args []string) error
+
+var commands = map[string]map[string]command{
+	"user": {
+		"get": userGet,
+	},
+	"files": {
+		"list": filesList,
+		"url":  filesURL,
+		"rm":   filesRemove,
+	},
+	"usage": {
+		"recompute": usageRecompute,
+	},
+	"quota": {
+		"set": quotaSet,
+	},
+	"export": {
+		"": export,
+	},
+}
+
+func main() {
+	format := flag.String("o", "table", "output format, table or json")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: chaosctl [-o table|json] <command> [flags]")
+		fmt.Fprintln(os.Stderr, "commands: user get, files list, files url, files rm, usage recompute, quota set, export")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	out, err := newOutput(*format, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	cmd, args, err := lookupCommand(flag.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	err = cmd(context.Background(), out, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "chaosctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func lookupCommand(args []string) (command, []string, error) {
+	if len(args) == 0 {
+		return nil, nil, fmt.Errorf("missing command")
+	}
+
+	group, ok := commands[args[0]]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown command %q", args[0])
+	}
+
+	if cmd, ok := group[""]; ok {
+		return cmd, args[1:], nil
+	}
+
+	if len(args) < 2 {
+		return nil, nil, fmt.Errorf("missing %s subcommand", args[0])
+	}
+
+	cmd, ok := group[args[1]]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown command %q", args[0]+" "+args[1])
+	}
+
+	return cmd, args[2:], nil
+}
+
+// requireFlag fails with a usage error if a required flag wasn't given
+func requireFlag(fs *flag.FlagSet, name, value string) error {
+	if value == "" {
+		fs.Usage()
+		return fmt.Errorf("-%s is required", name)
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// output prints results either as an aligned table or as indented JSON
+type output struct {
+	json bool
+	w    io.Writer
+}
+
+func newOutput(format string, w io.Writer) (*output, error) {
+	switch format {
+	case "table":
+		return &output{w: w}, nil
+	case "json":
+		return &output{json: true, w: w}, nil
+	}
+
+	return nil, fmt.Errorf("unknown output format %q", format)
+}
+
+// print writes v as JSON, or as a table with the given header and rows
+func (o *output) print(v interface{}, header []string, rows [][]string) error {
+	if o.json {
+		enc := json.NewEncoder(o.w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	tw := tabwriter.NewWriter(o.w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+
+	return tw.Flush()
+}
+
+// formatBytes renders a size in bytes with a binary unit
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+
+	"github.com/johnnynu/agreatchaos/api/internal/db"
+)
+
+func userGet(ctx context.Context, out *output, args []string) error {
+	fs := flag.NewFlagSet("user get", flag.ContinueOnError)
+	uid := fs.String("uid", "", "user ID")
+	email := fs.String("email", "", "email address")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var users []db.User
+	switch {
+	case *uid != "":
+		user, err := db.GetUser(ctx, *uid)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return fmt.Errorf("user %s not found", *uid)
+		}
+		users = append(users, *user)
+	case *email != "":
+		var err error
+		users, err = db.FindUsersByEmail(ctx, *email)
+		if err != nil {
+			return err
+		}
+		if len(users) == 0 {
+			return fmt.Errorf("no user with email %s", *email)
+		}
+	default:
+		fs.Usage()
+		return errors.New("-uid or -email is required")
+	}
+
+	rows := make([][]string, len(users))
+	for i, user := range users {
+		quota := "none"
+		if user.StorageQuota > 0 {
+			quota = formatBytes(user.StorageQuota)
+		}
+		rows[i] = []string{user.UID, user.Email, user.CreatedAt, formatBytes(user.StorageUsed), quota}
+	}
+
+	return out.print(users, []string{"UID", "EMAIL", "CREATED", "USED", "QUOTA"}, rows)
+}
+
+func usageRecompute(ctx context.Context, out *output, args []string) error {
+	fs := flag.NewFlagSet("usage recompute", flag.ContinueOnError)
+	uid := fs.String("uid", "", "user ID")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := requireFlag(fs, "uid", *uid); err != nil {
+		return err
+	}
+
+	files, err := db.ListUserFiles(ctx, *uid)
+	if err != nil {
+		return err
+	}
+
+	var used int64
+	for _, file := range files {
+		used += file.FileSize
+	}
+
+	err = db.SetUserStorageUsed(ctx, *uid, used)
+	if err != nil {
+		return err
+	}
+
+	result := struct {
+		UID         string `json:"uid"`
+		Files       int    `json:"files"`
+		StorageUsed int64  `json:"storageUsed"`
+	}{*uid, len(files), used}
+
+	return out.print(result, []string{"UID", "FILES", "USED"}, [][]string{
+		{result.UID, strconv.Itoa(result.Files), formatBytes(result.StorageUsed)},
+	})
+}
+
+func quotaSet(ctx context.Context, out *output, args []string) error {
+	fs := flag.NewFlagSet("quota set", flag.ContinueOnError)
+	uid := fs.String("uid", "", "user ID")
+	quota := fs.Int64("bytes", -1, "quota in bytes, 0 removes the quota")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := requireFlag(fs, "uid", *uid); err != nil {
+		return err
+	}
+	if *quota < 0 {
+		fs.Usage()
+		return errors.New("-bytes is required")
+	}
+
+	err := db.SetUserStorageQuota(ctx, *uid, *quota)
+	if err != nil {
+		return err
+	}
+
+	result := struct {
+		UID          string `json:"uid"`
+		StorageQuota int64  `json:"storageQuota"`
+	}{*uid, *quota}
+
+	return out.print(result, []string{"UID", "QUOTA"}, [][]string{{result.UID, formatBytes(result.StorageQuota)}})
+}
+
+func export(ctx context.Context, out *output, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	uid := fs.String("uid", "", "user ID")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := requireFlag(fs, "uid", *uid); err != nil {
+		return err
+	}
+
+	user, err := db.GetUser(ctx, *uid)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("user %s not found", *uid)
+	}
+
+	files, err := db.ListUserFiles(ctx, *uid)
+	if err != nil {
+		return err
+	}
+
+	// an export is always JSON, whatever the output format
+	exported := struct {
+		User  db.User   `json:"user"`
+		Files []db.File `json:"files"`
+	}{*user, files}
+
+	return (&output{json: true, w: out.w}).print(exported, nil, nil)
+}
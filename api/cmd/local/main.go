@@ -0,0 +1,91 @@
+// Command local is the local server mode of the notifications: it tails the
+// FileMetadata table's stream and serves the events the WebSocket API pushes
+// (file.created, file.uploaded, file.renamed and file.deleted) as Server-Sent
+// Events, for development stacks without a WebSocket API.
+//
+// Usage:
+//
+//	local [-addr 127.0.0.1:8080] [-table FileMetadata] [-poll 1s]
+//
+// Clients open GET /events?user=UID[&events=file.created,file.deleted]. The
+// user isn't authenticated, which is why the server listens on loopback unless
+// told otherwise.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodbstreams"
+	"github.com/johnnynu/agreatchaos/api/internal/domain"
+	"github.com/johnnynu/agreatchaos/api/internal/handlers"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:8080", "address to serve the event stream on")
+	table := flag.String("table", "FileMetadata", "table whose stream is tailed")
+	poll := flag.Duration("poll", time.Second, "how often each stream shard is polled")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		log.Fatalf("Unable to load SDK config, %v", err)
+	}
+
+	streamArn, err := latestStreamArn(ctx, dynamodb.NewFromConfig(cfg), *table)
+	if err != nil {
+		log.Fatalf("Unable to find the stream of %s: %v", *table, err)
+	}
+
+	hub := handlers.NewEventHub()
+	dispatcher := domain.NewDispatcher()
+	dispatcher.Subscribe(hub.Notify)
+
+	tailer := &streamTailer{
+		client:     dynamodbstreams.NewFromConfig(cfg),
+		streamArn:  streamArn,
+		dispatcher: dispatcher,
+		poll:       *poll,
+	}
+	go tailer.run(ctx)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID := r.URL.Query().Get("user")
+		if userID == "" {
+			http.Error(w, "user is required", http.StatusBadRequest)
+			return
+		}
+
+		hub.ServeEvents(w, r, userID)
+	})
+
+	server := &http.Server{Addr: *addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("Serving events of %s on http://%s/events", *table, *addr)
+	err = server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatalf("Server failed: %v", err)
+	}
+}
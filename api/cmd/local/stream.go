@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodbstreams"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodbstreams/types"
+	"github.com/johnnynu/agreatchaos/api/internal/domain"
+	"github.com/johnnynu/agreatchaos/api/internal/handlers"
+)
+
+// shardRefresh is how often the stream is described again to find the shards
+// that replaced closed ones
+const shardRefresh = 30 * time.Second
+
+func latestStreamArn(ctx context.Context, client *dynamodb.Client, table string) (string, error) {
+	res, err := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(table)})
+	if err != nil {
+		return "", err
+	}
+	if res.Table.LatestStreamArn == nil {
+		return "", fmt.Errorf("streams are not enabled")
+	}
+
+	return *res.Table.LatestStreamArn, nil
+}
+
+// streamTailer reads every shard of a table stream and dispatches its records
+// the way the stream Lambda does. It starts at the end of the shards open when
+// it starts, and at the beginning of shards created later.
+type streamTailer struct {
+	client     *dynamodbstreams.Client
+	streamArn  string
+	dispatcher *domain.Dispatcher
+	poll       time.Duration
+
+	mu     sync.Mutex
+	shards map[string]bool
+}
+
+func (t *streamTailer) run(ctx context.Context) {
+	t.shards = make(map[string]bool)
+	iteratorType := types.ShardIteratorTypeLatest
+
+	for {
+		err := t.startShards(ctx, iteratorType)
+		if err != nil {
+			log.Printf("Error describing stream: %v", err)
+		}
+		iteratorType = types.ShardIteratorTypeTrimHorizon
+
+		select {
+		case <-time.After(shardRefresh):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// startShards starts tailing the open shards that aren't tailed yet
+func (t *streamTailer) startShards(ctx context.Context, iteratorType types.ShardIteratorType) error {
+	var startID *string
+	for {
+		res, err := t.client.DescribeStream(ctx, &dynamodbstreams.DescribeStreamInput{
+			StreamArn:             aws.String(t.streamArn),
+			ExclusiveStartShardId: startID,
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, shard := range res.StreamDescription.Shards {
+			closed := shard.SequenceNumberRange != nil && shard.SequenceNumberRange.EndingSequenceNumber != nil
+			shardID := aws.ToString(shard.ShardId)
+
+			t.mu.Lock()
+			known := t.shards[shardID]
+			t.shards[shardID] = true
+			t.mu.Unlock()
+
+			if !known && !closed {
+				go t.tail(ctx, shardID, iteratorType)
+			}
+		}
+
+		startID = res.StreamDescription.LastEvaluatedShardId
+		if startID == nil {
+			return nil
+		}
+	}
+}
+
+// tail dispatches the records of a shard until it is closed. Failed records are
+// logged and skipped: clients resync with ListFiles when they reconnect.
+func (t *streamTailer) tail(ctx context.Context, shardID string, iteratorType types.ShardIteratorType) {
+	it, err := t.client.GetShardIterator(ctx, &dynamodbstreams.GetShardIteratorInput{
+		StreamArn:         aws.String(t.streamArn),
+		ShardId:           aws.String(shardID),
+		ShardIteratorType: iteratorType,
+	})
+	if err != nil {
+		log.Printf("Error getting an iterator for shard %s: %v", shardID, err)
+		t.forget(shardID)
+		return
+	}
+
+	iterator := it.ShardIterator
+	for iterator != nil {
+		res, err := t.client.GetRecords(ctx, &dynamodbstreams.GetRecordsInput{ShardIterator: iterator})
+		if err != nil {
+			log.Printf("Error reading shard %s: %v", shardID, err)
+			t.forget(shardID)
+			return
+		}
+
+		if len(res.Records) > 0 {
+			e := events.DynamoDBEvent{Records: make([]events.DynamoDBEventRecord, len(res.Records))}
+			for i, record := range res.Records {
+				e.Records[i] = lambdaRecord(t.streamArn, record)
+			}
+			handlers.DispatchStream(ctx, t.dispatcher, e)
+		}
+
+		iterator = res.NextShardIterator
+
+		select {
+		case <-time.After(t.poll):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// forget lets the next refresh start tailing a shard again
+func (t *streamTailer) forget(shardID string) {
+	t.mu.Lock()
+	delete(t.shards, shardID)
+	t.mu.Unlock()
+}
+
+// lambdaRecord converts a record read from the streams API to the form the
+// stream Lambda receives it in
+func lambdaRecord(streamArn string, record types.Record) events.DynamoDBEventRecord {
+	converted := events.DynamoDBEventRecord{
+		AWSRegion:      aws.ToString(record.AwsRegion),
+		EventID:        aws.ToString(record.EventID),
+		EventName:      string(record.EventName),
+		EventSource:    aws.ToString(record.EventSource),
+		EventVersion:   aws.ToString(record.EventVersion),
+		EventSourceArn: streamArn,
+	}
+
+	if change := record.Dynamodb; change != nil {
+		converted.Change = events.DynamoDBStreamRecord{
+			Keys:           lambdaImage(change.Keys),
+			NewImage:       lambdaImage(change.NewImage),
+			OldImage:       lambdaImage(change.OldImage),
+			SequenceNumber: aws.ToString(change.SequenceNumber),
+			SizeBytes:      aws.ToInt64(change.SizeBytes),
+			StreamViewType: string(change.StreamViewType),
+		}
+		if change.ApproximateCreationDateTime != nil {
+			converted.Change.ApproximateCreationDateTime = events.SecondsEpochTime{Time: *change.ApproximateCreationDateTime}
+		}
+	}
+
+	return converted
+}
+
+func lambdaImage(image map[string]types.AttributeValue) map[string]events.DynamoDBAttributeValue {
+	if image == nil {
+		return nil
+	}
+
+	converted := make(map[string]events.DynamoDBAttributeValue, len(image))
+	for name, value := range image {
+		converted[name] = lambdaAttribute(value)
+	}
+
+	return converted
+}
+
+func lambdaAttribute(value types.AttributeValue) events.DynamoDBAttributeValue {
+	switch v := value.(type) {
+	case *types.AttributeValueMemberS:
+		return events.NewStringAttribute(v.Value)
+	case *types.AttributeValueMemberN:
+		return events.NewNumberAttribute(v.Value)
+	case *types.AttributeValueMemberB:
+		return events.NewBinaryAttribute(v.Value)
+	case *types.AttributeValueMemberBOOL:
+		return events.NewBooleanAttribute(v.Value)
+	case *types.AttributeValueMemberSS:
+		return events.NewStringSetAttribute(v.Value)
+	case *types.AttributeValueMemberNS:
+		return events.NewNumberSetAttribute(v.Value)
+	case *types.AttributeValueMemberBS:
+		return events.NewBinarySetAttribute(v.Value)
+	case *types.AttributeValueMemberL:
+		list := make([]events.DynamoDBAttributeValue, len(v.Value))
+		for i, item := range v.Value {
+			list[i] = lambdaAttribute(item)
+		}
+		return events.NewListAttribute(list)
+	case *types.AttributeValueMemberM:
+		return events.NewMapAttribute(lambdaImage(v.Value))
+	default:
+		return events.NewNullAttribute()
+	}
+}
@@ -0,0 +1,175 @@
+// Command reconcile compares the file storage bucket with the FileMetadata table
+// and reports, and optionally repairs, where they disagree:
+//
+//   - orphans: objects that no file row points at
+//   - ghosts: file rows whose object is missing
+//   - size mismatches: objects whose size differs from the row's FileSize
+//
+// Usage:
+//
+//	reconcile [-format json|csv] [-repair orphans,ghosts,sizes|all] [-dry-run] [-rate 20]
+//	          [-inventory manifest.csv.gz -inventory-date 2024-01-31] [-bucket name] [-grace 24h]
+//
+// An inventory has no modification times, so objects can't be told apart from
+// uploads in flight: orphans and ghosts are only reported, never repaired, when
+// reading one.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func main() {
+	bucket := flag.String("bucket", "chaosfiles-filestorage", "bucket holding the file contents")
+	format := flag.String("format", "json", "report format, json (one object per line) or csv")
+	repair := flag.String("repair", "", "comma separated discrepancies to repair: orphans, ghosts, sizes or all")
+	dryRun := flag.Bool("dry-run", false, "report the repairs that would be made without making them")
+	rate := flag.Float64("rate", 20, "maximum AWS requests per second")
+	inventory := flag.String("inventory", "", "read the bucket listing from an S3 inventory CSV (optionally gzipped) with Bucket, Key and Size columns instead of listing the bucket")
+	inventoryDate := flag.String("inventory-date", "", "when the inventory was taken, as 2006-01-02 or RFC 3339, required with -inventory")
+	grace := flag.Duration("grace", 24*time.Hour, "ignore objects and rows changed this long before the listing, they may belong to uploads in flight")
+	flag.Parse()
+
+	repairs, err := parseRepairs(*repair)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	report, err := newReportWriter(*format, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	listedAt := time.Now()
+	if *inventory != "" {
+		listedAt, err = parseInventoryDate(*inventoryDate)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+
+		if repairs[kindOrphan] || repairs[kindGhost] {
+			fmt.Fprintln(os.Stderr, "orphans and ghosts can't be repaired from an inventory, it doesn't show uploads made since it was taken")
+			os.Exit(2)
+		}
+	}
+
+	if *rate <= 0 {
+		fmt.Fprintln(os.Stderr, "rate must be positive")
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		log.Fatalf("Unable to load SDK config, %v", err)
+	}
+
+	r := &reconciler{
+		s3Client: s3.NewFromConfig(cfg),
+		bucket:   *bucket,
+		repairs:  repairs,
+		dryRun:   *dryRun,
+		grace:    *grace,
+		listedAt: listedAt,
+		throttle: newThrottle(*rate),
+		report:   report,
+	}
+	defer r.throttle.Stop()
+
+	var listing objectLister = r.listBucket
+	if *inventory != "" {
+		listing = inventoryLister(*inventory)
+	}
+
+	summary, err := r.run(ctx, listing)
+	if flushErr := report.Flush(); flushErr != nil && err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		log.Fatalf("Reconciliation failed: %v", err)
+	}
+
+	log.Printf("Scanned %d files and %d objects: %d orphans, %d ghosts, %d size mismatches, %d repair errors",
+		summary.files, summary.objects, summary.counts[kindOrphan], summary.counts[kindGhost], summary.counts[kindSizeMismatch], summary.repairErrors)
+}
+
+func parseRepairs(value string) (map[string]bool, error) {
+	repairs := make(map[string]bool)
+	if value == "" {
+		return repairs, nil
+	}
+
+	for _, name := range strings.Split(value, ",") {
+		switch name = strings.TrimSpace(name); name {
+		case "all":
+			repairs[kindOrphan] = true
+			repairs[kindGhost] = true
+			repairs[kindSizeMismatch] = true
+		case "orphans":
+			repairs[kindOrphan] = true
+		case "ghosts":
+			repairs[kindGhost] = true
+		case "sizes":
+			repairs[kindSizeMismatch] = true
+		default:
+			return nil, fmt.Errorf("unknown repair %q", name)
+		}
+	}
+
+	return repairs, nil
+}
+
+func parseInventoryDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, fmt.Errorf("-inventory-date is required with -inventory")
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid -inventory-date %q", value)
+	}
+
+	return t, nil
+}
+
+// throttle spaces out AWS requests so a reconciliation doesn't eat the table's
+// or the bucket's capacity
+type throttle struct {
+	ticker *time.Ticker
+}
+
+func newThrottle(perSecond float64) *throttle {
+	return &throttle{ticker: time.NewTicker(time.Duration(float64(time.Second) / perSecond))}
+}
+
+func (t *throttle) Wait(ctx context.Context) error {
+	select {
+	case <-t.ticker.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *throttle) Stop() {
+	t.ticker.Stop()
+}
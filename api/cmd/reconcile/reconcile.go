@@ -0,0 +1,340 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/johnnynu/agreatchaos/api/internal/db"
+)
+
+const (
+	kindOrphan       = "orphan"
+	kindGhost        = "ghost"
+	kindSizeMismatch = "size_mismatch"
+)
+
+// ignoredPrefixes hold objects the backend writes itself, which never have file rows
+var ignoredPrefixes = []string{"quarantine/", "derived/", "tmp/"}
+
+// object is an entry of the bucket listing
+type object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time // zero when read from an inventory
+}
+
+// objectLister streams the bucket's objects to fn
+type objectLister func(ctx context.Context, fn func(object) error) error
+
+// expected is what the table says should be stored under a key. Deduplicated
+// files share their blob's key, so one key can be expected by several files.
+type expected struct {
+	files []db.File
+	seen  bool
+}
+
+type discrepancy struct {
+	Kind         string `json:"kind"`
+	Key          string `json:"key"`
+	FileID       string `json:"fileId,omitempty"`
+	UserID       string `json:"userId,omitempty"`
+	ObjectSize   *int64 `json:"objectSize,omitempty"`
+	RecordedSize *int64 `json:"recordedSize,omitempty"`
+	Action       string `json:"action,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+type summary struct {
+	files        int
+	objects      int
+	counts       map[string]int
+	repairErrors int
+}
+
+type reconciler struct {
+	s3Client *s3.Client
+	bucket   string
+	repairs  map[string]bool
+	dryRun   bool
+	grace    time.Duration
+	// listedAt is when the bucket listing was taken, the start of the run or
+	// the date of the inventory
+	listedAt time.Time
+	throttle *throttle
+	report   reportWriter
+}
+
+func (r *reconciler) run(ctx context.Context, listObjects objectLister) (*summary, error) {
+	sum := &summary{counts: make(map[string]int)}
+	cutoff := r.listedAt.Add(-r.grace)
+
+	// index the table by object key, the listing is then streamed against it
+	byKey := make(map[string]*expected)
+	err := db.ScanFiles(ctx, func(files []db.File) error {
+		sum.files += len(files)
+		for _, file := range files {
+			exp := byKey[file.ObjectKey()]
+			if exp == nil {
+				exp = &expected{}
+				byKey[file.ObjectKey()] = exp
+			}
+			exp.files = append(exp.files, file)
+		}
+
+		return r.throttle.Wait(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = listObjects(ctx, func(obj object) error {
+		sum.objects++
+
+		for _, prefix := range ignoredPrefixes {
+			if strings.HasPrefix(obj.Key, prefix) {
+				return nil
+			}
+		}
+
+		exp := byKey[obj.Key]
+		if exp == nil {
+			if !obj.LastModified.IsZero() && obj.LastModified.After(cutoff) {
+				return nil
+			}
+
+			return r.emit(ctx, sum, discrepancy{Kind: kindOrphan, Key: obj.Key, ObjectSize: aws.Int64(obj.Size)})
+		}
+
+		exp.seen = true
+		for _, file := range exp.files {
+			if file.FileSize == obj.Size || file.Status == db.FileStatusFailed {
+				continue
+			}
+
+			err := r.emit(ctx, sum, discrepancy{
+				Kind:         kindSizeMismatch,
+				Key:          obj.Key,
+				FileID:       file.FileID,
+				UserID:       file.UserID,
+				ObjectSize:   aws.Int64(obj.Size),
+				RecordedSize: aws.Int64(file.FileSize),
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for key, exp := range byKey {
+		if exp.seen {
+			continue
+		}
+
+		for _, file := range exp.files {
+			if file.Status == db.FileStatusFailed || changedSince(file, cutoff) {
+				continue
+			}
+
+			err := r.emit(ctx, sum, discrepancy{
+				Kind:         kindGhost,
+				Key:          key,
+				FileID:       file.FileID,
+				UserID:       file.UserID,
+				RecordedSize: aws.Int64(file.FileSize),
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return sum, nil
+}
+
+// changedSince reports whether a file was created or updated after cutoff. Its
+// upload may still be in flight, or have landed after the listing was taken.
+func changedSince(file db.File, cutoff time.Time) bool {
+	for _, at := range []string{file.CreatedAt, file.UpdatedAt} {
+		t, err := time.Parse(time.RFC3339, at)
+		if err == nil && t.After(cutoff) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// emit repairs a discrepancy if asked to and reports it
+func (r *reconciler) emit(ctx context.Context, sum *summary, d discrepancy) error {
+	sum.counts[d.Kind]++
+
+	if r.repairs[d.Kind] {
+		action, err := r.repair(ctx, d)
+		d.Action = action
+		if err != nil {
+			d.Error = err.Error()
+			sum.repairErrors++
+		}
+	}
+
+	return r.report.Write(d)
+}
+
+func (r *reconciler) repair(ctx context.Context, d discrepancy) (string, error) {
+	var action string
+	switch d.Kind {
+	case kindOrphan:
+		action = "delete_object"
+	case kindGhost:
+		action = "mark_failed"
+	case kindSizeMismatch:
+		action = "fix_size"
+	}
+
+	if r.dryRun {
+		return "would_" + action, nil
+	}
+
+	err := r.throttle.Wait(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	switch d.Kind {
+	case kindOrphan:
+		_, err = r.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(r.bucket),
+			Key:    aws.String(d.Key),
+		})
+	case kindGhost:
+		err = r.updateFile(ctx, d.FileID, func(file *db.File) {
+			file.Status = db.FileStatusFailed
+			file.StatusReason = "object missing from storage"
+		})
+	case kindSizeMismatch:
+		err = r.updateFile(ctx, d.FileID, func(file *db.File) {
+			file.FileSize = *d.ObjectSize
+		})
+	}
+
+	return action, err
+}
+
+// updateFile re-reads a file before changing it, so that rows changed since the
+// scan are not overwritten with stale values
+func (r *reconciler) updateFile(ctx context.Context, fileID string, change func(file *db.File)) error {
+	file, err := db.GetFile(ctx, fileID)
+	if err != nil {
+		return err
+	}
+	if file == nil {
+		return fmt.Errorf("file %s no longer exists", fileID)
+	}
+
+	change(file)
+	file.UpdatedAt = time.Now().Format(time.RFC3339)
+
+	return db.UpdateFile(ctx, *file)
+}
+
+func (r *reconciler) listBucket(ctx context.Context, fn func(object) error) error {
+	paginator := s3.NewListObjectsV2Paginator(r.s3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(r.bucket),
+	})
+
+	for paginator.HasMorePages() {
+		err := r.throttle.Wait(ctx)
+		if err != nil {
+			return err
+		}
+
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list bucket: %v", err)
+		}
+
+		for _, obj := range page.Contents {
+			err = fn(object{
+				Key:          aws.ToString(obj.Key),
+				Size:         aws.ToInt64(obj.Size),
+				LastModified: aws.ToTime(obj.LastModified),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// inventoryLister reads the listing from an S3 inventory CSV file. The
+// inventory must be configured with Size as its first optional field, so that
+// the columns start with Bucket, Key, Size.
+func inventoryLister(path string) objectLister {
+	return func(ctx context.Context, fn func(object) error) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		var r io.Reader = f
+		if strings.HasSuffix(path, ".gz") {
+			gz, err := gzip.NewReader(f)
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %v", path, err)
+			}
+			defer gz.Close()
+			r = gz
+		}
+
+		records := csv.NewReader(r)
+		records.FieldsPerRecord = -1
+
+		for line := 1; ; line++ {
+			record, err := records.Read()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %v", path, err)
+			}
+
+			if len(record) < 3 {
+				return fmt.Errorf("%s:%d: expected Bucket, Key and Size columns", path, line)
+			}
+
+			// inventory keys are URL encoded
+			key, err := url.QueryUnescape(record[1])
+			if err != nil {
+				return fmt.Errorf("%s:%d: invalid key %q: %v", path, line, record[1], err)
+			}
+
+			size, err := strconv.ParseInt(record[2], 10, 64)
+			if err != nil {
+				return fmt.Errorf("%s:%d: invalid size %q: %v", path, line, record[2], err)
+			}
+
+			err = fn(object{Key: key, Size: size})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
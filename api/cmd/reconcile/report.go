@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// reportWriter writes discrepancies as they are found
+type reportWriter interface {
+	Write(d discrepancy) error
+	Flush() error
+}
+
+func newReportWriter(format string, w io.Writer) (reportWriter, error) {
+	switch format {
+	case "json":
+		return &jsonReport{enc: json.NewEncoder(w)}, nil
+	case "csv":
+		return &csvReport{w: csv.NewWriter(w)}, nil
+	}
+
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+type jsonReport struct {
+	enc *json.Encoder
+}
+
+func (r *jsonReport) Write(d discrepancy) error {
+	return r.enc.Encode(d)
+}
+
+func (r *jsonReport) Flush() error {
+	return nil
+}
+
+type csvReport struct {
+	w             *csv.Writer
+	headerWritten bool
+}
+
+func (r *csvReport) Write(d discrepancy) error {
+	if !r.headerWritten {
+		err := r.w.Write([]string{"kind", "key", "fileId", "userId", "objectSize", "recordedSize", "action", "error"})
+		if err != nil {
+			return err
+		}
+		r.headerWritten = true
+	}
+
+	return r.w.Write([]string{d.Kind, d.Key, d.FileID, d.UserID, formatSize(d.ObjectSize), formatSize(d.RecordedSize), d.Action, d.Error})
+}
+
+func (r *csvReport) Flush() error {
+	r.w.Flush()
+	return r.w.Error()
+}
+
+func formatSize(size *int64) string {
+	if size == nil {
+		return ""
+	}
+
+	return strconv.FormatInt(*size, 10)
+}
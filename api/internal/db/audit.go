@@ -0,0 +1,185 @@
+package db
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	AuditSignin          = "user.signin"
+	AuditUploadInitiated = "upload.initiated"
+	AuditUploadCompleted = "upload.completed"
+	AuditDownloadURL     = "download.url_issued"
+	AuditPreview         = "file.preview"
+	AuditRename          = "file.rename"
+	AuditDelete          = "file.delete"
+	AuditBulkDownload    = "download.bulk"
+	AuditCopy            = "file.copy"
+	AuditExtract         = "file.extract"
+	AuditImport          = "file.import"
+)
+
+// AuditEntry records an action on a file or account. Entries are only ever
+// added: the AuditLog table has no update or delete path.
+type AuditEntry struct {
+	EntryID string `dynamodbav:"EntryID"`
+	Action  string `dynamodbav:"Action"`
+	// ActorID is the user who performed the action
+	ActorID string `dynamodbav:"ActorID"`
+	// OwnerID is the owner of the file, who can read its history
+	OwnerID   string `dynamodbav:"OwnerID,omitempty"`
+	FileID    string `dynamodbav:"FileID,omitempty"`
+	FileName  string `dynamodbav:"FileName,omitempty"`
+	Details   string `dynamodbav:"Details,omitempty"`
+	IP        string `dynamodbav:"IP,omitempty"`
+	UserAgent string `dynamodbav:"UserAgent,omitempty"`
+	RequestID string `dynamodbav:"RequestID,omitempty"`
+	CreatedAt string `dynamodbav:"CreatedAt"`
+}
+
+// CreateAuditEntry appends an entry. An entry with the same EntryID is only
+// written once, so entries derived from redelivered events are deduplicated.
+func CreateAuditEntry(ctx context.Context, entry AuditEntry) error {
+	item, err := attributevalue.MarshalMap(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit entry: %v", err)
+	}
+
+	_, err = dbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String("AuditLog"),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(EntryID)"),
+	})
+
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to put audit entry: %v", err)
+	}
+
+	return nil
+}
+
+// ListFileAudit returns a page of a file's history, newest first. Only the
+// entries of files owned by ownerID are returned, including deleted files.
+func ListFileAudit(ctx context.Context, fileID, ownerID, cursor string, limit int32) ([]AuditEntry, string, error) {
+	key := expression.Key("FileID").Equal(expression.Value(fileID))
+	filter := expression.Equal(expression.Name("OwnerID"), expression.Value(ownerID))
+
+	expr, err := expression.NewBuilder().WithKeyCondition(key).WithFilter(filter).Build()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to build audit query: %v", err)
+	}
+
+	return queryAudit(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String("AuditLog"),
+		IndexName:                 aws.String("FileID-index"),
+		KeyConditionExpression:    expr.KeyCondition(),
+		FilterExpression:          expr.Filter(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}, cursor, limit)
+}
+
+// ListUserAudit returns a page of the actions a user performed, newest first
+func ListUserAudit(ctx context.Context, actorID, cursor string, limit int32) ([]AuditEntry, string, error) {
+	key := expression.Key("ActorID").Equal(expression.Value(actorID))
+
+	expr, err := expression.NewBuilder().WithKeyCondition(key).Build()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to build audit query: %v", err)
+	}
+
+	return queryAudit(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String("AuditLog"),
+		IndexName:                 aws.String("ActorID-index"),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}, cursor, limit)
+}
+
+// queryAudit runs one page of an audit index query. Both indexes are sorted on
+// CreatedAt. The returned cursor is empty on the last page.
+func queryAudit(ctx context.Context, input *dynamodb.QueryInput, cursor string, limit int32) ([]AuditEntry, string, error) {
+	startKey, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	input.ExclusiveStartKey = startKey
+	input.Limit = aws.Int32(limit)
+	input.ScanIndexForward = aws.Bool(false)
+
+	res, err := dbClient.Query(ctx, input)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to query audit log: %v", err)
+	}
+
+	entries := []AuditEntry{}
+	err = attributevalue.UnmarshalListOfMaps(res.Items, &entries)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to unmarshal audit entries: %v", err)
+	}
+
+	next, err := encodeCursor(res.LastEvaluatedKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return entries, next, nil
+}
+
+// encodeCursor turns a LastEvaluatedKey made of string attributes into an
+// opaque pagination cursor
+func encodeCursor(key map[string]types.AttributeValue) (string, error) {
+	if len(key) == 0 {
+		return "", nil
+	}
+
+	var values map[string]string
+	err := attributevalue.UnmarshalMap(key, &values)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode cursor: %v", err)
+	}
+
+	b, err := json.Marshal(values)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode cursor: %v", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func decodeCursor(cursor string) (map[string]types.AttributeValue, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var values map[string]string
+	err = json.Unmarshal(b, &values)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	return attributevalue.MarshalMap(values)
+}
+
+// ErrInvalidCursor is returned for pagination cursors that weren't returned by a previous page
+var ErrInvalidCursor = errors.New("invalid cursor")
@@ -0,0 +1,188 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	// batchGetSize and batchWriteSize are the most items DynamoDB takes in one
+	// BatchGetItem and BatchWriteItem, transactWriteSize the most in one transaction
+	batchGetSize      = 100
+	batchWriteSize    = 25
+	transactWriteSize = 100
+
+	// unprocessed items are retried batchAttempts times, doubling batchDelay
+	batchAttempts = 6
+	batchDelay    = 50 * time.Millisecond
+)
+
+var (
+	// ErrConditionFailed is matched by a TransactionError when a condition of
+	// the transaction didn't hold
+	ErrConditionFailed = errors.New("condition check failed")
+	// ErrTransactionConflict is matched by a TransactionError when another
+	// request was writing the same items
+	ErrTransactionConflict = errors.New("transaction conflict")
+)
+
+// TransactionError is a canceled transaction. Reasons holds one entry per item
+// of the transaction, in order, with an empty Code for the items that were fine.
+type TransactionError struct {
+	Reasons []TransactionReason
+}
+
+type TransactionReason struct {
+	Code    string
+	Message string
+}
+
+func (e *TransactionError) Error() string {
+	var reasons []string
+	for i, reason := range e.Reasons {
+		if reason.Code != "" && reason.Code != "None" {
+			reasons = append(reasons, fmt.Sprintf("item %d: %s", i, reason.Code))
+		}
+	}
+
+	return "transaction canceled: " + strings.Join(reasons, ", ")
+}
+
+func (e *TransactionError) Is(target error) bool {
+	code := ""
+	switch target {
+	case ErrConditionFailed:
+		code = "ConditionalCheckFailed"
+	case ErrTransactionConflict:
+		code = "TransactionConflict"
+	default:
+		return false
+	}
+
+	for _, reason := range e.Reasons {
+		if reason.Code == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Failed reports whether item i of the transaction was why it was canceled
+func (e *TransactionError) Failed(i int) bool {
+	return i < len(e.Reasons) && e.Reasons[i].Code != "" && e.Reasons[i].Code != "None"
+}
+
+// BatchGet reads items of a table by key, batchGetSize at a time, retrying the
+// keys DynamoDB leaves unprocessed. Missing items are left out, and the items
+// found come back in no particular order.
+func BatchGet(ctx context.Context, table string, keys []map[string]types.AttributeValue) ([]map[string]types.AttributeValue, error) {
+	var items []map[string]types.AttributeValue
+	for start := 0; start < len(keys); start += batchGetSize {
+		pending := keys[start:min(start+batchGetSize, len(keys))]
+
+		for attempt := 0; len(pending) > 0; attempt++ {
+			if attempt == batchAttempts {
+				return nil, fmt.Errorf("failed to read %d items of %s after %d attempts", len(pending), table, attempt)
+			}
+			err := batchBackoff(ctx, attempt)
+			if err != nil {
+				return nil, err
+			}
+
+			res, err := dbClient.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{
+				RequestItems: map[string]types.KeysAndAttributes{table: {Keys: pending}},
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to batch get %s: %v", table, err)
+			}
+
+			items = append(items, res.Responses[table]...)
+			pending = res.UnprocessedKeys[table].Keys
+		}
+	}
+
+	return items, nil
+}
+
+// BatchWrite puts and deletes items of a table, batchWriteSize at a time,
+// retrying the requests DynamoDB leaves unprocessed. Batches aren't atomic,
+// when it fails some of the requests may have been written.
+func BatchWrite(ctx context.Context, table string, requests []types.WriteRequest) error {
+	for start := 0; start < len(requests); start += batchWriteSize {
+		pending := requests[start:min(start+batchWriteSize, len(requests))]
+
+		for attempt := 0; len(pending) > 0; attempt++ {
+			if attempt == batchAttempts {
+				return fmt.Errorf("failed to write %d items to %s after %d attempts", len(pending), table, attempt)
+			}
+			err := batchBackoff(ctx, attempt)
+			if err != nil {
+				return err
+			}
+
+			res, err := dbClient.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+				RequestItems: map[string][]types.WriteRequest{table: pending},
+			})
+			if err != nil {
+				return fmt.Errorf("failed to batch write %s: %v", table, err)
+			}
+
+			pending = res.UnprocessedItems[table]
+		}
+	}
+
+	return nil
+}
+
+// TransactWrite writes items atomically. A canceled transaction is returned as
+// a *TransactionError, which matches ErrConditionFailed or
+// ErrTransactionConflict with errors.Is.
+func TransactWrite(ctx context.Context, items []types.TransactWriteItem) error {
+	if len(items) > transactWriteSize {
+		return fmt.Errorf("transaction of %d items exceeds the limit of %d", len(items), transactWriteSize)
+	}
+
+	_, err := dbClient.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	})
+
+	var canceled *types.TransactionCanceledException
+	if errors.As(err, &canceled) {
+		txErr := &TransactionError{}
+		for _, reason := range canceled.CancellationReasons {
+			txErr.Reasons = append(txErr.Reasons, TransactionReason{
+				Code:    aws.ToString(reason.Code),
+				Message: aws.ToString(reason.Message),
+			})
+		}
+		return txErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write transaction: %v", err)
+	}
+
+	return nil
+}
+
+// batchBackoff waits before a retry of unprocessed items, doubling the delay
+// with every attempt
+func batchBackoff(ctx context.Context, attempt int) error {
+	if attempt == 0 {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(batchDelay << (attempt - 1)):
+		return nil
+	}
+}
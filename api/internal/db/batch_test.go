@@ -0,0 +1,201 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// fakeDynamoDB points dbClient at a server that hands each request's operation
+// and JSON body to respond, and writes back the status and body it returns
+func fakeDynamoDB(t *testing.T, respond func(op string, body map[string]interface{}) (int, string)) {
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		status, res := respond(strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "DynamoDB_20120810."), body)
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		w.WriteHeader(status)
+		fmt.Fprint(w, res)
+	}))
+	t.Cleanup(server.Close)
+
+	saved := dbClient
+	t.Cleanup(func() { dbClient = saved })
+	dbClient = dynamodb.New(dynamodb.Options{
+		Region:           "us-east-1",
+		BaseEndpoint:     aws.String(server.URL),
+		Credentials:      aws.AnonymousCredentials{},
+		RetryMaxAttempts: 1,
+	})
+}
+
+// canceled is the body of a TransactionCanceledException with one reason per code
+func canceled(codes ...string) string {
+	var reasons []string
+	for _, code := range codes {
+		reasons = append(reasons, fmt.Sprintf(`{"Code":%q}`, code))
+	}
+
+	return `{"__type":"com.amazonaws.dynamodb.v20120810#TransactionCanceledException",` +
+		`"message":"Transaction cancelled","CancellationReasons":[` + strings.Join(reasons, ",") + `]}`
+}
+
+func TestTransactionErrorFailed(t *testing.T) {
+	txErr := &TransactionError{Reasons: []TransactionReason{
+		{Code: "None"},
+		{Code: "ConditionalCheckFailed"},
+		{},
+		{Code: "TransactionConflict"},
+	}}
+
+	tests := []struct {
+		item int
+		want bool
+	}{
+		{item: 0, want: false},
+		{item: 1, want: true},
+		{item: 2, want: false},
+		{item: 3, want: true},
+		// DynamoDB leaves the reasons of trailing items out
+		{item: 4, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("item %d", tt.item), func(t *testing.T) {
+			if got := txErr.Failed(tt.item); got != tt.want {
+				t.Errorf("Failed(%d) = %v, want %v", tt.item, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransactionErrorIs(t *testing.T) {
+	tests := []struct {
+		name         string
+		codes        []string
+		wantCond     bool
+		wantConflict bool
+	}{
+		{name: "condition failed", codes: []string{"None", "ConditionalCheckFailed"}, wantCond: true},
+		{name: "conflict", codes: []string{"TransactionConflict", "None"}, wantConflict: true},
+		{name: "both", codes: []string{"ConditionalCheckFailed", "TransactionConflict"}, wantCond: true, wantConflict: true},
+		{name: "other reason", codes: []string{"None", "ProvisionedThroughputExceeded"}},
+		{name: "no reasons"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			txErr := &TransactionError{}
+			for _, code := range tt.codes {
+				txErr.Reasons = append(txErr.Reasons, TransactionReason{Code: code})
+			}
+
+			// wrapped the way callers usually return it
+			err := fmt.Errorf("failed to delete files: %w", txErr)
+			if got := errors.Is(err, ErrConditionFailed); got != tt.wantCond {
+				t.Errorf("errors.Is(ErrConditionFailed) = %v, want %v", got, tt.wantCond)
+			}
+			if got := errors.Is(err, ErrTransactionConflict); got != tt.wantConflict {
+				t.Errorf("errors.Is(ErrTransactionConflict) = %v, want %v", got, tt.wantConflict)
+			}
+		})
+	}
+}
+
+func TestTransactionErrorError(t *testing.T) {
+	txErr := &TransactionError{Reasons: []TransactionReason{
+		{Code: "None"},
+		{Code: "ConditionalCheckFailed"},
+		{},
+		{Code: "TransactionConflict"},
+	}}
+
+	want := "transaction canceled: item 1: ConditionalCheckFailed, item 3: TransactionConflict"
+	if got := txErr.Error(); got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}
+
+func TestBatchWrite(t *testing.T) {
+	var batches []int
+	fakeDynamoDB(t, func(op string, body map[string]interface{}) (int, string) {
+		if op != "BatchWriteItem" {
+			return http.StatusBadRequest, `{"__type":"ValidationException"}`
+		}
+		requests := body["RequestItems"].(map[string]interface{})["Files"].([]interface{})
+		batches = append(batches, len(requests))
+
+		// the first batch leaves its last request unprocessed once
+		if len(batches) == 1 {
+			unprocessed, _ := json.Marshal(map[string]interface{}{
+				"UnprocessedItems": map[string]interface{}{"Files": requests[len(requests)-1:]},
+			})
+			return http.StatusOK, string(unprocessed)
+		}
+		return http.StatusOK, `{}`
+	})
+
+	var requests []types.WriteRequest
+	for i := 0; i < 2*batchWriteSize+3; i++ {
+		requests = append(requests, types.WriteRequest{DeleteRequest: &types.DeleteRequest{
+			Key: map[string]types.AttributeValue{"FileID": &types.AttributeValueMemberS{Value: fmt.Sprint(i)}},
+		}})
+	}
+
+	err := BatchWrite(context.Background(), "Files", requests)
+	if err != nil {
+		t.Fatalf("BatchWrite() error = %v", err)
+	}
+
+	want := []int{batchWriteSize, 1, batchWriteSize, 3}
+	if fmt.Sprint(batches) != fmt.Sprint(want) {
+		t.Errorf("BatchWrite() sent batches of %v, want %v", batches, want)
+	}
+}
+
+func TestTransactWrite(t *testing.T) {
+	fakeDynamoDB(t, func(op string, body map[string]interface{}) (int, string) {
+		return http.StatusBadRequest, canceled("None", "ConditionalCheckFailed")
+	})
+
+	items := make([]types.TransactWriteItem, 2)
+	for i := range items {
+		items[i] = types.TransactWriteItem{Delete: &types.Delete{
+			TableName: aws.String("Files"),
+			Key:       map[string]types.AttributeValue{"FileID": &types.AttributeValueMemberS{Value: fmt.Sprint(i)}},
+		}}
+	}
+
+	err := TransactWrite(context.Background(), items)
+	var txErr *TransactionError
+	if !errors.As(err, &txErr) {
+		t.Fatalf("TransactWrite() error = %v, want a *TransactionError", err)
+	}
+	if !errors.Is(err, ErrConditionFailed) || txErr.Failed(0) || !txErr.Failed(1) {
+		t.Errorf("TransactWrite() error = %v, want item 1 to have failed its condition", err)
+	}
+
+	err = TransactWrite(context.Background(), make([]types.TransactWriteItem, transactWriteSize+1))
+	if err == nil || errors.As(err, &txErr) {
+		t.Errorf("TransactWrite() of %d items error = %v, want the limit refused", transactWriteSize+1, err)
+	}
+}
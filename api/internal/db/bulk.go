@@ -0,0 +1,197 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ErrFileNotFound is returned when a file doesn't exist or belongs to someone else
+var ErrFileNotFound = errors.New("file not found")
+
+// DeleteFilesLimit is the most files DeleteFiles takes, each file taking a
+// delete and a put in its transaction
+const DeleteFilesLimit = transactWriteSize / 2
+
+// DeleteFiles deletes files that don't share a blob and records the pending
+// deletes of their objects, in one transaction so that a file is never gone
+// without its pending delete. Files deleted or given to someone else since
+// they were read are skipped. It returns the pending delete of every file it
+// deleted, keyed by file ID; on error none of the files were deleted.
+func DeleteFiles(ctx context.Context, files []File) (map[string]PendingDelete, error) {
+	if len(files) > DeleteFilesLimit {
+		return nil, fmt.Errorf("can't delete %d files at once, the limit is %d", len(files), DeleteFilesLimit)
+	}
+
+	ops := make(map[string]PendingDelete, len(files))
+	// items holds a delete and a put for each of fileIDs
+	var fileIDs []string
+	var items []types.TransactWriteItem
+	for _, file := range files {
+		if file.BlobID != "" {
+			return nil, fmt.Errorf("file %s shares blob %s, delete it with DeleteFile", file.FileID, file.BlobID)
+		}
+
+		op := newPendingDelete(file)
+		opItem, err := attributevalue.MarshalMap(op)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal pending delete: %v", err)
+		}
+
+		ops[file.FileID] = op
+		fileIDs = append(fileIDs, file.FileID)
+		items = append(items,
+			types.TransactWriteItem{
+				Delete: &types.Delete{
+					TableName: aws.String("FileMetadata"),
+					Key: map[string]types.AttributeValue{
+						"FileID": &types.AttributeValueMemberS{Value: file.FileID},
+					},
+					// a file deduplicated since it was read needs DeleteFile
+					ConditionExpression: aws.String("UserID = :uid AND attribute_not_exists(BlobID)"),
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":uid": &types.AttributeValueMemberS{Value: file.UserID},
+					},
+				},
+			},
+			types.TransactWriteItem{
+				Put: &types.Put{
+					TableName: aws.String("PendingDeletes"),
+					Item:      opItem,
+				},
+			},
+		)
+	}
+
+	for attempt := 0; len(items) > 0; attempt++ {
+		if attempt == batchAttempts {
+			return nil, fmt.Errorf("failed to delete %d files after %d attempts", len(fileIDs), attempt)
+		}
+		err := batchBackoff(ctx, attempt)
+		if err != nil {
+			return nil, err
+		}
+
+		err = TransactWrite(ctx, items)
+		if err == nil {
+			break
+		}
+
+		var txErr *TransactionError
+		switch {
+		case errors.Is(err, ErrConditionFailed) && errors.As(err, &txErr):
+			// drop the files that changed and delete the rest
+			var remainingIDs []string
+			var remaining []types.TransactWriteItem
+			for i, fileID := range fileIDs {
+				if txErr.Failed(2 * i) {
+					delete(ops, fileID)
+					continue
+				}
+				remainingIDs = append(remainingIDs, fileID)
+				remaining = append(remaining, items[2*i], items[2*i+1])
+			}
+			fileIDs, items = remainingIDs, remaining
+		case errors.Is(err, ErrTransactionConflict):
+		default:
+			return nil, err
+		}
+	}
+
+	return ops, nil
+}
+
+// MoveFile moves one of userID's files to a folder, or to the root when
+// folderID is empty
+func MoveFile(ctx context.Context, fileID, userID, folderID string) error {
+	update := expression.Set(expression.Name("UpdatedAt"), expression.Value(time.Now().Format(time.RFC3339)))
+	if folderID == "" {
+		update = update.Remove(expression.Name("FolderID"))
+	} else {
+		update = update.Set(expression.Name("FolderID"), expression.Value(folderID))
+	}
+
+	return updateOwnedFile(ctx, fileID, userID, update)
+}
+
+// UpdateFileDetails sets the name, type and size of one of file.UserID's
+// files, for files whose details are only known once their content arrives
+func UpdateFileDetails(ctx context.Context, file File) error {
+	update := expression.Set(expression.Name("FileName"), expression.Value(file.FileName)).
+		Set(expression.Name("FileType"), expression.Value(file.FileType)).
+		Set(expression.Name("FileSize"), expression.Value(file.FileSize)).
+		Set(expression.Name("UpdatedAt"), expression.Value(time.Now().Format(time.RFC3339)))
+
+	return updateOwnedFile(ctx, file.FileID, file.UserID, update)
+}
+
+// AddFileTags adds tags to one of userID's files, keeping the ones it has
+func AddFileTags(ctx context.Context, fileID, userID string, tags []string) error {
+	update := expression.Add(expression.Name("Tags"), expression.Value(stringSet(tags))).
+		Set(expression.Name("UpdatedAt"), expression.Value(time.Now().Format(time.RFC3339)))
+
+	return updateOwnedFile(ctx, fileID, userID, update)
+}
+
+// stringSet marshals as a DynamoDB string set, which ADD merges into
+type stringSet []string
+
+func (s stringSet) MarshalDynamoDBAttributeValue() (types.AttributeValue, error) {
+	return &types.AttributeValueMemberSS{Value: s}, nil
+}
+
+// TrashFile moves one of userID's files to the trash
+func TrashFile(ctx context.Context, fileID, userID string) error {
+	now := time.Now().Format(time.RFC3339)
+	update := expression.Set(expression.Name("TrashedAt"), expression.Value(now)).
+		Set(expression.Name("UpdatedAt"), expression.Value(now))
+
+	return updateOwnedFile(ctx, fileID, userID, update)
+}
+
+// RestoreFile takes one of userID's files out of the trash
+func RestoreFile(ctx context.Context, fileID, userID string) error {
+	update := expression.Remove(expression.Name("TrashedAt")).
+		Set(expression.Name("UpdatedAt"), expression.Value(time.Now().Format(time.RFC3339)))
+
+	return updateOwnedFile(ctx, fileID, userID, update)
+}
+
+// updateOwnedFile applies update to a file if it belongs to userID, and returns
+// ErrFileNotFound otherwise
+func updateOwnedFile(ctx context.Context, fileID, userID string, update expression.UpdateBuilder) error {
+	cond := expression.Name("UserID").Equal(expression.Value(userID))
+
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return fmt.Errorf("failed to build file update: %v", err)
+	}
+
+	_, err = dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String("FileMetadata"),
+		Key: map[string]types.AttributeValue{
+			"FileID": &types.AttributeValueMemberS{Value: fileID},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+	})
+
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return ErrFileNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update file %s: %v", fileID, err)
+	}
+
+	return nil
+}
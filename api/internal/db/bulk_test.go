@@ -0,0 +1,138 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"testing"
+)
+
+func TestDeleteFiles(t *testing.T) {
+	tests := []struct {
+		name string
+		// responses answers the transactions in turn, "" for success
+		responses []string
+		wantCalls []string
+		wantOps   []string
+		wantErr   bool
+	}{
+		{
+			name:      "all deleted",
+			responses: []string{""},
+			wantCalls: []string{"a b c"},
+			wantOps:   []string{"a", "b", "c"},
+		},
+		{
+			name:      "changed file dropped",
+			responses: []string{canceled("None", "None", "ConditionalCheckFailed", "None", "None", "None"), ""},
+			wantCalls: []string{"a b c", "a c"},
+			wantOps:   []string{"a", "c"},
+		},
+		{
+			name:      "last file dropped",
+			responses: []string{canceled("None", "None", "None", "None", "ConditionalCheckFailed", "None"), ""},
+			wantCalls: []string{"a b c", "a b"},
+			wantOps:   []string{"a", "b"},
+		},
+		{
+			name: "conflict retried",
+			responses: []string{
+				canceled("None", "None", "ConditionalCheckFailed", "None", "None", "None"),
+				canceled("TransactionConflict", "None", "None", "None"),
+				"",
+			},
+			wantCalls: []string{"a b c", "a c", "a c"},
+			wantOps:   []string{"a", "c"},
+		},
+		{
+			name:      "every file changed",
+			responses: []string{canceled("ConditionalCheckFailed", "None", "ConditionalCheckFailed", "None", "ConditionalCheckFailed", "None")},
+			wantCalls: []string{"a b c"},
+			wantOps:   []string{},
+		},
+		{
+			name:      "other failure",
+			responses: []string{canceled("None", "None", "ValidationError", "None", "None", "None")},
+			wantCalls: []string{"a b c"},
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls []string
+			fakeDynamoDB(t, func(op string, body map[string]interface{}) (int, string) {
+				if op != "TransactWriteItems" {
+					return http.StatusBadRequest, `{"__type":"ValidationException"}`
+				}
+
+				// each file is a delete then a put, name the files of the deletes
+				var fileIDs string
+				for i, item := range body["TransactItems"].([]interface{}) {
+					del, ok := item.(map[string]interface{})["Delete"].(map[string]interface{})
+					if ok != (i%2 == 0) {
+						t.Errorf("item %d is out of place: %v", i, item)
+						continue
+					}
+					if ok {
+						key := del["Key"].(map[string]interface{})["FileID"].(map[string]interface{})["S"].(string)
+						fileIDs += " " + key
+					}
+				}
+				calls = append(calls, fileIDs[1:])
+
+				res := tt.responses[len(calls)-1]
+				if res == "" {
+					return http.StatusOK, `{}`
+				}
+				return http.StatusBadRequest, res
+			})
+
+			var files []File
+			for _, fileID := range []string{"a", "b", "c"} {
+				files = append(files, File{FileID: fileID, UserID: "user"})
+			}
+
+			ops, err := DeleteFiles(context.Background(), files)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DeleteFiles() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if fmt.Sprint(calls) != fmt.Sprint(tt.wantCalls) {
+				t.Errorf("DeleteFiles() transactions = %q, want %q", calls, tt.wantCalls)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			var got []string
+			for fileID, op := range ops {
+				if op.FileID != fileID {
+					t.Errorf("ops[%s] is the pending delete of %s", fileID, op.FileID)
+				}
+				got = append(got, fileID)
+			}
+			sort.Strings(got)
+			if fmt.Sprint(got) != fmt.Sprint(tt.wantOps) {
+				t.Errorf("DeleteFiles() deleted %v, want %v", got, tt.wantOps)
+			}
+		})
+	}
+}
+
+func TestDeleteFilesRefused(t *testing.T) {
+	fakeDynamoDB(t, func(op string, body map[string]interface{}) (int, string) {
+		t.Errorf("unexpected %s", op)
+		return http.StatusBadRequest, `{"__type":"ValidationException"}`
+	})
+
+	_, err := DeleteFiles(context.Background(), []File{{FileID: "a", UserID: "user", BlobID: "blob"}})
+	if err == nil {
+		t.Error("DeleteFiles() of a deduplicated file succeeded")
+	}
+
+	_, err = DeleteFiles(context.Background(), make([]File, DeleteFilesLimit+1))
+	if err == nil {
+		t.Errorf("DeleteFiles() of %d files succeeded", DeleteFilesLimit+1)
+	}
+}
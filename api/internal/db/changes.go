@@ -0,0 +1,218 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	ChangeCreate = "create"
+	ChangeUpdate = "update"
+	ChangeDelete = "delete"
+)
+
+// ChangeRetention is how long change log entries are kept before their TTL expires
+const ChangeRetention = 30 * 24 * time.Hour
+
+// Change is an entry of a user's change log, ordered by Seq. It carries the
+// file as it was after the change, or before it for deletes.
+type Change struct {
+	UserID     string `dynamodbav:"UserID" json:"-"`
+	Seq        int64  `dynamodbav:"Seq" json:"seq"`
+	EventID    string `dynamodbav:"EventID" json:"eventId"`
+	Op         string `dynamodbav:"Op" json:"op"`
+	FileID     string `dynamodbav:"FileID" json:"fileId"`
+	File       File   `dynamodbav:"File" json:"file"`
+	OccurredAt string `dynamodbav:"OccurredAt" json:"occurredAt"`
+	ExpiresAt  int64  `dynamodbav:"ExpiresAt" json:"-"`
+}
+
+// ErrUserNotFound is returned by AppendChange for changes of users that don't exist
+var ErrUserNotFound = errors.New("user not found")
+
+const (
+	// appendChangeAttempts bounds how often AppendChange starts over when a
+	// concurrent change of the same user took the sequence number it read
+	appendChangeAttempts = 5
+	// changeMarkerPrefix keys the ChangeLog items recording which events were
+	// appended, in partitions no user ID can collide with
+	changeMarkerPrefix = "event#"
+)
+
+// AppendChange stores change under the next sequence number of the user's
+// change log and returns that number. The entry, the user's change_seq and a
+// marker of the event ID are written in one transaction: change_seq is
+// therefore a high-water mark below which every entry is committed, and a
+// redelivered event isn't appended again, in which case 0 is returned.
+func AppendChange(ctx context.Context, change Change) (int64, error) {
+	for attempt := 0; attempt < appendChangeAttempts; attempt++ {
+		err := batchBackoff(ctx, attempt)
+		if err != nil {
+			return 0, err
+		}
+
+		current, found, err := changeSeq(ctx, change.UserID)
+		if err != nil {
+			return 0, err
+		}
+		if !found {
+			return 0, ErrUserNotFound
+		}
+
+		change.Seq = current + 1
+		items, err := appendChangeItems(change, current)
+		if err != nil {
+			return 0, err
+		}
+
+		err = TransactWrite(ctx, items)
+
+		var txErr *TransactionError
+		if errors.As(err, &txErr) {
+			if txErr.Failed(2) && txErr.Reasons[2].Code == "ConditionalCheckFailed" {
+				return 0, nil
+			}
+			// another change of the user took the number, read it again
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to append change for %s: %v", change.UserID, err)
+		}
+
+		return change.Seq, nil
+	}
+
+	return 0, fmt.Errorf("failed to append change for %s: %w", change.UserID, ErrTransactionConflict)
+}
+
+// appendChangeItems moves the user's change_seq from current to change.Seq,
+// stores the entry and marks its event as appended
+func appendChangeItems(change Change, current int64) ([]types.TransactWriteItem, error) {
+	seqCond := expression.Equal(expression.Name("change_seq"), expression.Value(current))
+	if current == 0 {
+		seqCond = expression.Or(expression.AttributeNotExists(expression.Name("change_seq")), seqCond)
+	}
+
+	update := expression.Set(expression.Name("change_seq"), expression.Value(change.Seq))
+	expr, err := expression.NewBuilder().
+		WithUpdate(update).
+		WithCondition(expression.AttributeExists(expression.Name("uid")).And(seqCond)).
+		Build()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build change sequence update: %v", err)
+	}
+
+	item, err := attributevalue.MarshalMap(change)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal change: %v", err)
+	}
+
+	marker := map[string]types.AttributeValue{
+		"UserID":    &types.AttributeValueMemberS{Value: changeMarkerPrefix + change.EventID},
+		"Seq":       &types.AttributeValueMemberN{Value: "0"},
+		"ExpiresAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(change.ExpiresAt, 10)},
+	}
+
+	return []types.TransactWriteItem{
+		{
+			Update: &types.Update{
+				TableName: aws.String("users"),
+				Key: map[string]types.AttributeValue{
+					"uid": &types.AttributeValueMemberS{Value: change.UserID},
+				},
+				ExpressionAttributeNames:  expr.Names(),
+				ExpressionAttributeValues: expr.Values(),
+				UpdateExpression:          expr.Update(),
+				ConditionExpression:       expr.Condition(),
+			},
+		},
+		{
+			Put: &types.Put{
+				TableName:           aws.String("ChangeLog"),
+				Item:                item,
+				ConditionExpression: aws.String("attribute_not_exists(Seq)"),
+			},
+		},
+		{
+			Put: &types.Put{
+				TableName:           aws.String("ChangeLog"),
+				Item:                marker,
+				ConditionExpression: aws.String("attribute_not_exists(UserID)"),
+			},
+		},
+	}, nil
+}
+
+// changeSeq reads a user's committed change_seq
+func changeSeq(ctx context.Context, userID string) (int64, bool, error) {
+	res, err := dbClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String("users"),
+		Key: map[string]types.AttributeValue{
+			"uid": &types.AttributeValueMemberS{Value: userID},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to get change sequence of %s: %v", userID, err)
+	}
+	if res.Item == nil {
+		return 0, false, nil
+	}
+
+	var user User
+	err = attributevalue.UnmarshalMap(res.Item, &user)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to unmarshal user: %v", err)
+	}
+
+	return user.ChangeSeq, true, nil
+}
+
+// ListChanges returns up to limit of a user's changes with a sequence number
+// above after, in order. Only entries up to the user's change_seq are read, the
+// high-water mark of committed entries.
+func ListChanges(ctx context.Context, userID string, after int64, limit int32) ([]Change, error) {
+	committed, found, err := changeSeq(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !found || committed <= after {
+		return []Change{}, nil
+	}
+
+	key := expression.Key("UserID").Equal(expression.Value(userID)).
+		And(expression.Key("Seq").Between(expression.Value(after+1), expression.Value(committed)))
+
+	expr, err := expression.NewBuilder().WithKeyCondition(key).Build()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build change query: %v", err)
+	}
+
+	res, err := dbClient.Query(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String("ChangeLog"),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		Limit:                     aws.Int32(limit),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query changes: %v", err)
+	}
+
+	changes := []Change{}
+	err = attributevalue.UnmarshalListOfMaps(res.Items, &changes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal changes: %v", err)
+	}
+
+	return changes, nil
+}
@@ -0,0 +1,133 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Connection is an open WebSocket connection of a user. Endpoint is the
+// connection management URL events are posted to, and Events the event types
+// the client subscribed to; no events means all of them.
+type Connection struct {
+	ConnectionID string   `dynamodbav:"ConnectionID"`
+	UserID       string   `dynamodbav:"UserID"`
+	Endpoint     string   `dynamodbav:"Endpoint"`
+	Events       []string `dynamodbav:"Events,omitempty,stringset"`
+	ConnectedAt  string   `dynamodbav:"ConnectedAt"`
+	ExpiresAt    int64    `dynamodbav:"ExpiresAt"`
+}
+
+func CreateConnection(ctx context.Context, conn Connection) error {
+	item, err := attributevalue.MarshalMap(conn)
+	if err != nil {
+		return fmt.Errorf("failed to marshal connection: %v", err)
+	}
+
+	_, err = dbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String("Connections"),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put connection: %v", err)
+	}
+
+	return nil
+}
+
+func DeleteConnection(ctx context.Context, connectionID string) error {
+	_, err := dbClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String("Connections"),
+		Key: map[string]types.AttributeValue{
+			"ConnectionID": &types.AttributeValueMemberS{Value: connectionID},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete connection %s: %v", connectionID, err)
+	}
+
+	return nil
+}
+
+// SetConnectionEvents replaces the event types a connection subscribed to. It
+// only updates connections that exist and belong to userID.
+func SetConnectionEvents(ctx context.Context, connectionID, userID string, eventTypes []string) error {
+	var update expression.UpdateBuilder
+	if len(eventTypes) == 0 {
+		update = expression.Remove(expression.Name("Events"))
+	} else {
+		update = expression.Set(expression.Name("Events"), expression.Value(&types.AttributeValueMemberSS{Value: eventTypes}))
+	}
+	cond := expression.Equal(expression.Name("UserID"), expression.Value(userID))
+
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return fmt.Errorf("failed to build connection update: %v", err)
+	}
+
+	_, err = dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String("Connections"),
+		Key: map[string]types.AttributeValue{
+			"ConnectionID": &types.AttributeValueMemberS{Value: connectionID},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update connection %s: %v", connectionID, err)
+	}
+
+	return nil
+}
+
+func ListUserConnections(ctx context.Context, userID string) ([]Connection, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String("Connections"),
+		IndexName:              aws.String("UserID-index"),
+		KeyConditionExpression: aws.String("UserID = :uid"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":uid": &types.AttributeValueMemberS{Value: userID},
+		},
+	}
+
+	var conns []Connection
+	paginator := dynamodb.NewQueryPaginator(dbClient, input)
+	for paginator.HasMorePages() {
+		res, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query user connections: %v", err)
+		}
+
+		var pageConns []Connection
+		err = attributevalue.UnmarshalListOfMaps(res.Items, &pageConns)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal connections: %v", err)
+		}
+
+		conns = append(conns, pageConns...)
+	}
+
+	return conns, nil
+}
+
+// Subscribed reports whether the connection wants events of the given type
+func (c Connection) Subscribed(eventType string) bool {
+	if len(c.Events) == 0 {
+		return true
+	}
+
+	for _, t := range c.Events {
+		if t == eventType {
+			return true
+		}
+	}
+
+	return false
+}
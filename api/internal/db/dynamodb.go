@@ -2,8 +2,10 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -29,6 +31,12 @@ type User struct {
 	Username  string `dynamodbav:"username"`
 	Email     string `dynamodbav:"email"`
 	CreatedAt string `dynamodbav:"created_at"`
+	// StorageUsed is the total FileSize of the user's files as last recomputed
+	StorageUsed int64 `dynamodbav:"storage_used,omitempty"`
+	// StorageQuota caps StorageUsed, 0 means no quota
+	StorageQuota int64 `dynamodbav:"storage_quota,omitempty"`
+	// ChangeSeq is the sequence number of the user's latest change log entry
+	ChangeSeq int64 `dynamodbav:"change_seq,omitempty"`
 }
 
 type File struct {
@@ -39,6 +47,103 @@ type File struct {
 	FileType  string `dynamodbav:"FileType"`
 	CreatedAt string `dynamodbav:"CreatedAt"`
 	UpdatedAt string `dynamodbav:"UpdatedAt"`
+	// FolderID is the folder holding the file, empty for the root
+	FolderID string `dynamodbav:"FolderID,omitempty"`
+	// Tags are labels the owner put on the file
+	Tags []string `dynamodbav:"Tags,stringset,omitempty"`
+	// TrashedAt is set while the file is in the trash
+	TrashedAt string `dynamodbav:"TrashedAt,omitempty"`
+	// ChecksumSHA256 is the base64 checksum S3 verified for the object. For
+	// multipart uploads it is the composite checksum, suffixed with "-<parts>".
+	ChecksumSHA256 string `dynamodbav:"ChecksumSHA256,omitempty"`
+	// BlobID is set for deduplicated files, whose content lives in a shared blob
+	BlobID string `dynamodbav:"BlobID,omitempty"`
+	// Status tracks the upload lifecycle, rows created before it existed have none
+	Status       string `dynamodbav:"Status,omitempty"`
+	StatusReason string `dynamodbav:"StatusReason,omitempty"`
+	// UploadSequencer orders the S3 events applied to the file, see RecordUpload
+	UploadSequencer string `dynamodbav:"UploadSequencer,omitempty"`
+	// DeclaredType is the type the uploader claimed, and DetectedType the one
+	// sniffed from the content. FileType is the type downloads are served with.
+	DeclaredType string `dynamodbav:"DeclaredType,omitempty"`
+	DetectedType string `dynamodbav:"DetectedType,omitempty"`
+	// ScanStatus is the outcome of the latest malware scan, empty when the file
+	// was never scanned
+	ScanStatus    string `dynamodbav:"ScanStatus,omitempty"`
+	ScanSignature string `dynamodbav:"ScanSignature,omitempty"`
+	ScanEngine    string `dynamodbav:"ScanEngine,omitempty"`
+	ScannedAt     string `dynamodbav:"ScannedAt,omitempty"`
+	// Thumbnails are the scaled down copies generated for image uploads
+	Thumbnails []Thumbnail `dynamodbav:"Thumbnails,omitempty"`
+}
+
+// Thumbnail is a scaled down JPEG copy of an image, stored under the derived prefix
+type Thumbnail struct {
+	Size   string `dynamodbav:"Size"`
+	Key    string `dynamodbav:"Key"`
+	Width  int    `dynamodbav:"Width"`
+	Height int    `dynamodbav:"Height"`
+}
+
+const (
+	FileStatusPending  = "pending"
+	FileStatusUploaded = "uploaded"
+	// FileStatusFlagged marks an uploaded object that didn't match what was declared
+	FileStatusFlagged = "flagged"
+	FileStatusFailed  = "failed"
+	// FileStatusQuarantined marks a file whose content is infected, it can't be downloaded
+	FileStatusQuarantined = "quarantined"
+)
+
+const (
+	ScanClean    = "clean"
+	ScanInfected = "infected"
+	// ScanError is recorded when the scanner couldn't scan the content
+	ScanError = "error"
+)
+
+// ObjectKey returns the S3 key holding the file's content
+func (f File) ObjectKey() string {
+	if f.BlobID != "" {
+		return BlobKey(f.BlobID)
+	}
+
+	return f.FileID
+}
+
+const (
+	BlobStatusPending   = "pending"
+	BlobStatusAvailable = "available"
+	// BlobStatusDeleting is set once a blob lost its last reference and its
+	// object is being deleted. Such a blob can't be acquired again.
+	BlobStatusDeleting = "deleting"
+)
+
+// ErrBlobDeleting is returned when acquiring a blob whose object is being deleted
+var ErrBlobDeleting = errors.New("blob is being deleted")
+
+// Blob is content-addressed storage shared by every file with the same SHA-256.
+// RefCount is the number of File rows pointing at the blob.
+type Blob struct {
+	BlobID    string `dynamodbav:"BlobID"` // owner's user ID and hex SHA-256 of the content, "<uid>/<sha256>"
+	Size      int64  `dynamodbav:"Size"`
+	RefCount  int64  `dynamodbav:"RefCount"`
+	Status    string `dynamodbav:"Status"`
+	CreatedAt string `dynamodbav:"CreatedAt"`
+	// ScanStatus and ScanSignature are the latest scan of the blob's content,
+	// copied to files that reuse it without uploading
+	ScanStatus    string `dynamodbav:"ScanStatus,omitempty"`
+	ScanSignature string `dynamodbav:"ScanSignature,omitempty"`
+	// DetectedType is the type sniffed from the content, checked against the
+	// declared type of files that reuse the blob without uploading
+	DetectedType string `dynamodbav:"DetectedType,omitempty"`
+	// Thumbnails are generated once for the blob's content and shared by its files
+	Thumbnails []Thumbnail `dynamodbav:"Thumbnails,omitempty"`
+}
+
+// BlobKey returns the S3 key of a blob
+func BlobKey(blobID string) string {
+	return "blobs/" + blobID
 }
 
 func CreateUser(ctx context.Context, user User) error {
@@ -84,6 +189,77 @@ func GetUser(ctx context.Context, uid string) (*User, error) {
 	return &user, nil
 }
 
+// FindUsersByEmail scans the users table for accounts with the given email
+func FindUsersByEmail(ctx context.Context, email string) ([]User, error) {
+	filter := expression.Equal(expression.Name("email"), expression.Value(email))
+
+	expr, err := expression.NewBuilder().WithFilter(filter).Build()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build user filter: %v", err)
+	}
+
+	var users []User
+	paginator := dynamodb.NewScanPaginator(dbClient, &dynamodb.ScanInput{
+		TableName:                 aws.String("users"),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		FilterExpression:          expr.Filter(),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan users: %v", err)
+		}
+
+		var pageUsers []User
+		err = attributevalue.UnmarshalListOfMaps(page.Items, &pageUsers)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal users: %v", err)
+		}
+
+		users = append(users, pageUsers...)
+	}
+
+	return users, nil
+}
+
+// SetUserStorageUsed stores a user's recomputed usage
+func SetUserStorageUsed(ctx context.Context, uid string, used int64) error {
+	return updateUser(ctx, uid, expression.Set(expression.Name("storage_used"), expression.Value(used)))
+}
+
+// SetUserStorageQuota sets a user's quota, 0 removes it
+func SetUserStorageQuota(ctx context.Context, uid string, quota int64) error {
+	return updateUser(ctx, uid, expression.Set(expression.Name("storage_quota"), expression.Value(quota)))
+}
+
+func updateUser(ctx context.Context, uid string, update expression.UpdateBuilder) error {
+	cond := expression.AttributeExists(expression.Name("uid"))
+
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return fmt.Errorf("failed to build user update: %v", err)
+	}
+
+	_, err = dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String("users"),
+		Key: map[string]types.AttributeValue{
+			"uid": &types.AttributeValueMemberS{Value: uid},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to update user %s: %v", uid, err)
+	}
+
+	return nil
+}
+
 func CreateFile(ctx context.Context, file File) error {
 	item, err := attributevalue.MarshalMap(file)
 	if err != nil {
@@ -105,6 +281,42 @@ func CreateFile(ctx context.Context, file File) error {
 	return nil
 }
 
+// CreateBlobFile creates a file whose content is an existing blob and adds
+// its reference to the blob in the same transaction. It fails with
+// ErrConditionFailed if the blob is gone or being deleted.
+func CreateBlobFile(ctx context.Context, file File) error {
+	item, err := attributevalue.MarshalMap(file)
+	if err != nil {
+		return fmt.Errorf("failed to marshal file: %v", err)
+	}
+
+	return TransactWrite(ctx, []types.TransactWriteItem{
+		{
+			Put: &types.Put{
+				TableName: aws.String("FileMetadata"),
+				Item:      item,
+			},
+		},
+		{
+			Update: &types.Update{
+				TableName: aws.String("Blobs"),
+				Key: map[string]types.AttributeValue{
+					"BlobID": &types.AttributeValueMemberS{Value: file.BlobID},
+				},
+				UpdateExpression:    aws.String("ADD RefCount :inc"),
+				ConditionExpression: aws.String("attribute_exists(BlobID) AND #status <> :deleting"),
+				ExpressionAttributeNames: map[string]string{
+					"#status": "Status",
+				},
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":inc":      &types.AttributeValueMemberN{Value: "1"},
+					":deleting": &types.AttributeValueMemberS{Value: BlobStatusDeleting},
+				},
+			},
+		},
+	})
+}
+
 func GetFile(ctx context.Context, fileID string) (*File, error) {
 	res, err := dbClient.GetItem(ctx, &dynamodb.GetItemInput{
 		TableName: aws.String("FileMetadata"),
@@ -140,26 +352,91 @@ func ListUserFiles(ctx context.Context, userID string) ([]File, error) {
 		},
 	}
 
-	res, err := dbClient.Query(ctx, input)
+	// a single query returns at most 1MB, keep going until every file is read
+	files := []File{}
+	paginator := dynamodb.NewQueryPaginator(dbClient, input)
+	for paginator.HasMorePages() {
+		res, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query user files: %v", err)
+		}
+
+		var pageFiles []File
+		err = attributevalue.UnmarshalListOfMaps(res.Items, &pageFiles)
+		if err != nil {
+			return nil, fmt.Errorf("failed the unmarshal files: %v", err)
+		}
+
+		files = append(files, pageFiles...)
+	}
+
+	return files, nil
+}
+
+// ListBlobFiles returns the files pointing at a blob. Blobs are scoped to their
+// owner, so only the owner's files are searched.
+func ListBlobFiles(ctx context.Context, userID, blobID string) ([]File, error) {
+	key := expression.Key("UserID").Equal(expression.Value(userID))
+	filter := expression.Equal(expression.Name("BlobID"), expression.Value(blobID))
+
+	expr, err := expression.NewBuilder().WithKeyCondition(key).WithFilter(filter).Build()
 	if err != nil {
-		return nil, fmt.Errorf("failed to query user files: %v", err)
+		return nil, fmt.Errorf("failed to build blob files query: %v", err)
 	}
 
 	var files []File
-	err = attributevalue.UnmarshalListOfMaps(res.Items, &files)
+	paginator := dynamodb.NewQueryPaginator(dbClient, &dynamodb.QueryInput{
+		TableName:                 aws.String("FileMetadata"),
+		IndexName:                 aws.String("UserID-index"),
+		KeyConditionExpression:    expr.KeyCondition(),
+		FilterExpression:          expr.Filter(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	for paginator.HasMorePages() {
+		res, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query blob files: %v", err)
+		}
+
+		var pageFiles []File
+		err = attributevalue.UnmarshalListOfMaps(res.Items, &pageFiles)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal files: %v", err)
+		}
+
+		files = append(files, pageFiles...)
+	}
+
+	return files, nil
+}
+
+// GetFiles reads files by ID. Files that don't exist are left out, and the
+// others come back in no particular order.
+func GetFiles(ctx context.Context, fileIDs []string) ([]File, error) {
+	keys := make([]map[string]types.AttributeValue, len(fileIDs))
+	for i, fileID := range fileIDs {
+		keys[i] = map[string]types.AttributeValue{
+			"FileID": &types.AttributeValueMemberS{Value: fileID},
+		}
+	}
+
+	items, err := BatchGet(ctx, "FileMetadata", keys)
 	if err != nil {
-		return nil, fmt.Errorf("failed the unmarshal files: %v", err)
+		return nil, err
+	}
+
+	var files []File
+	err = attributevalue.UnmarshalListOfMaps(items, &files)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal files: %v", err)
 	}
 
 	return files, nil
 }
 
 func UpdateFile(ctx context.Context, file File) error {
-	update := expression.Set(expression.Name("FileSize"), expression.Value(file.FileSize)).
-		Set(expression.Name("FileType"), expression.Value(file.FileType)).
-		Set(expression.Name("UpdatedAt"), expression.Value(file.UpdatedAt))
-
-	expr, err := expression.NewBuilder().WithUpdate(update).Build()
+	expr, err := expression.NewBuilder().WithUpdate(fileUpdate(file)).Build()
 	if err != nil {
 		log.Printf("couldnt build expression for update: %v\n", err)
 		return err
@@ -185,29 +462,547 @@ func UpdateFile(ctx context.Context, file File) error {
 	return nil
 }
 
-func DeleteFile(ctx context.Context, fileID string, userID string) error {
+// RecordUpload applies an upload event to a file unless a later event for the
+// same object was already recorded, and reports whether it did.
+// file.UploadSequencer must be set to the event's normalized sequencer.
+func RecordUpload(ctx context.Context, file File) (bool, error) {
+	update := fileUpdate(file).Set(expression.Name("UploadSequencer"), expression.Value(file.UploadSequencer))
+	cond := expression.AttributeExists(expression.Name("FileID")).
+		And(expression.Or(
+			expression.AttributeNotExists(expression.Name("UploadSequencer")),
+			expression.LessThan(expression.Name("UploadSequencer"), expression.Value(file.UploadSequencer)),
+		))
+
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return false, fmt.Errorf("failed to build upload update: %v", err)
+	}
+
+	_, err = dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String("FileMetadata"),
+		Key: map[string]types.AttributeValue{
+			"FileID": &types.AttributeValueMemberS{Value: file.FileID},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+	})
+
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to record upload for file %s: %v", file.FileID, err)
+	}
+
+	return true, nil
+}
+
+// RecordMultipartChecksum stores the checksum of a completed multipart upload
+// on a file that is still pending. Its status and content details are left to
+// ProcessUpload, which reads the same checksum from the object if it got there
+// first.
+func RecordMultipartChecksum(ctx context.Context, fileID, checksum string) error {
+	update := expression.Set(expression.Name("ChecksumSHA256"), expression.Value(checksum)).
+		Set(expression.Name("UpdatedAt"), expression.Value(time.Now().Format(time.RFC3339)))
+	cond := expression.Equal(expression.Name("Status"), expression.Value(FileStatusPending))
+
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return fmt.Errorf("failed to build checksum update: %v", err)
+	}
+
+	_, err = dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String("FileMetadata"),
+		Key: map[string]types.AttributeValue{
+			"FileID": &types.AttributeValueMemberS{Value: fileID},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+	})
+
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to record checksum for file %s: %v", fileID, err)
+	}
+
+	return nil
+}
+
+// SetFileThumbnails records the thumbnails generated for a file
+func SetFileThumbnails(ctx context.Context, fileID string, thumbnails []Thumbnail) error {
+	update := expression.Set(expression.Name("Thumbnails"), expression.Value(thumbnails))
+	cond := expression.AttributeExists(expression.Name("FileID"))
+
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return fmt.Errorf("failed to build thumbnail update: %v", err)
+	}
+
+	_, err = dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String("FileMetadata"),
+		Key: map[string]types.AttributeValue{
+			"FileID": &types.AttributeValueMemberS{Value: fileID},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update thumbnails of %s: %v", fileID, err)
+	}
+
+	return nil
+}
+
+// fileUpdate sets the mutable attributes of a file, skipping optional ones that are empty
+func fileUpdate(file File) expression.UpdateBuilder {
+	update := expression.Set(expression.Name("FileSize"), expression.Value(file.FileSize)).
+		Set(expression.Name("FileType"), expression.Value(file.FileType)).
+		Set(expression.Name("UpdatedAt"), expression.Value(file.UpdatedAt))
+	if file.ChecksumSHA256 != "" {
+		update = update.Set(expression.Name("ChecksumSHA256"), expression.Value(file.ChecksumSHA256))
+	}
+	if file.Status != "" {
+		update = update.Set(expression.Name("Status"), expression.Value(file.Status))
+	}
+	if file.StatusReason != "" {
+		update = update.Set(expression.Name("StatusReason"), expression.Value(file.StatusReason))
+	}
+	if file.ScanStatus != "" {
+		update = update.Set(expression.Name("ScanStatus"), expression.Value(file.ScanStatus)).
+			Set(expression.Name("ScanEngine"), expression.Value(file.ScanEngine)).
+			Set(expression.Name("ScannedAt"), expression.Value(file.ScannedAt))
+		if file.ScanSignature != "" {
+			update = update.Set(expression.Name("ScanSignature"), expression.Value(file.ScanSignature))
+		} else {
+			update = update.Remove(expression.Name("ScanSignature"))
+		}
+	}
+	if file.DeclaredType != "" {
+		update = update.Set(expression.Name("DeclaredType"), expression.Value(file.DeclaredType))
+	}
+	if file.DetectedType != "" {
+		update = update.Set(expression.Name("DetectedType"), expression.Value(file.DetectedType))
+	}
+
+	return update
+}
+
+// DeleteFile deletes a file owned by userID and returns the deleted metadata
+// along with the pending delete of its content. Both are written in one
+// transaction, so the content is cleaned up even if the caller never gets to it.
+func DeleteFile(ctx context.Context, fileID string, userID string) (*File, *PendingDelete, error) {
 	file, err := GetFile(ctx, fileID)
 	if err != nil {
-		return fmt.Errorf("failed to get file: %v", err)
+		return nil, nil, fmt.Errorf("failed to get file: %v", err)
 	}
 	if file == nil {
-		return fmt.Errorf("file not found")
+		return nil, nil, ErrFileNotFound
 	}
 
 	if file.UserID != userID {
-		return fmt.Errorf("unauthorized: file does not belong to the user")
+		return nil, nil, fmt.Errorf("unauthorized: file does not belong to the user")
 	}
 
-	_, err = dbClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+	op := newPendingDelete(*file)
+	opItem, err := attributevalue.MarshalMap(op)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal pending delete: %v", err)
+	}
+
+	transactItems := []types.TransactWriteItem{
+		{
+			Delete: &types.Delete{
+				TableName: aws.String("FileMetadata"),
+				Key: map[string]types.AttributeValue{
+					"FileID": &types.AttributeValueMemberS{Value: fileID},
+				},
+				ConditionExpression: aws.String("UserID = :uid"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":uid": &types.AttributeValueMemberS{Value: userID},
+				},
+			},
+		},
+		{
+			Put: &types.Put{
+				TableName: aws.String("PendingDeletes"),
+				Item:      opItem,
+			},
+		},
+	}
+
+	if file.BlobID != "" {
+		transactItems = append(transactItems, types.TransactWriteItem{
+			Update: &types.Update{
+				TableName: aws.String("Blobs"),
+				Key: map[string]types.AttributeValue{
+					"BlobID": &types.AttributeValueMemberS{Value: file.BlobID},
+				},
+				UpdateExpression: aws.String("ADD RefCount :dec"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":dec": &types.AttributeValueMemberN{Value: "-1"},
+				},
+			},
+		})
+	}
+
+	err = TransactWrite(ctx, transactItems)
+	if errors.Is(err, ErrConditionFailed) {
+		// the file was deleted, or changed hands, since it was read
+		return nil, nil, ErrFileNotFound
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to delete file: %v", err)
+	}
+
+	return file, &op, nil
+}
+
+func GetBlob(ctx context.Context, blobID string) (*Blob, error) {
+	res, err := dbClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String("Blobs"),
+		Key: map[string]types.AttributeValue{
+			"BlobID": &types.AttributeValueMemberS{Value: blobID},
+		},
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get blob: %v", err)
+	}
+
+	if res.Item == nil {
+		return nil, nil
+	}
+
+	var blob Blob
+	err = attributevalue.UnmarshalMap(res.Item, &blob)
+	if err != nil {
+		return nil, err
+	}
+
+	return &blob, nil
+}
+
+// AcquireBlob adds a reference to a blob, creating it in the pending state if it
+// doesn't exist yet, and returns the blob as it is after the update. It fails
+// with ErrBlobDeleting if the blob's object is being deleted.
+func AcquireBlob(ctx context.Context, blobID string, size int64) (*Blob, error) {
+	update := expression.Add(expression.Name("RefCount"), expression.Value(1)).
+		Set(expression.Name("Size"), expression.IfNotExists(expression.Name("Size"), expression.Value(size))).
+		Set(expression.Name("Status"), expression.IfNotExists(expression.Name("Status"), expression.Value(BlobStatusPending))).
+		Set(expression.Name("CreatedAt"), expression.IfNotExists(expression.Name("CreatedAt"), expression.Value(time.Now().Format(time.RFC3339))))
+	cond := expression.AttributeNotExists(expression.Name("BlobID")).
+		Or(expression.NotEqual(expression.Name("Status"), expression.Value(BlobStatusDeleting)))
+
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build blob update: %v", err)
+	}
+
+	res, err := dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String("Blobs"),
+		Key: map[string]types.AttributeValue{
+			"BlobID": &types.AttributeValueMemberS{Value: blobID},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ReturnValues:              types.ReturnValueAllNew,
+	})
+
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return nil, ErrBlobDeleting
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire blob %s: %v", blobID, err)
+	}
+
+	var blob Blob
+	err = attributevalue.UnmarshalMap(res.Attributes, &blob)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal blob: %v", err)
+	}
+
+	return &blob, nil
+}
+
+// ReleaseBlob drops a reference to a blob and returns the remaining reference count
+func ReleaseBlob(ctx context.Context, blobID string) (int64, error) {
+	update := expression.Add(expression.Name("RefCount"), expression.Value(-1))
+	cond := expression.AttributeExists(expression.Name("BlobID"))
+
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return 0, fmt.Errorf("failed to build blob update: %v", err)
+	}
+
+	res, err := dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String("Blobs"),
+		Key: map[string]types.AttributeValue{
+			"BlobID": &types.AttributeValueMemberS{Value: blobID},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ReturnValues:              types.ReturnValueUpdatedNew,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to release blob %s: %v", blobID, err)
+	}
+
+	var blob Blob
+	err = attributevalue.UnmarshalMap(res.Attributes, &blob)
+	if err != nil {
+		return 0, fmt.Errorf("failed to unmarshal blob: %v", err)
+	}
+
+	return blob.RefCount, nil
+}
+
+// MarkBlobAvailable records that the blob's content has landed in S3, along
+// with the type detected from it. A blob that is gone or being deleted is left
+// as it is.
+func MarkBlobAvailable(ctx context.Context, blobID string, size int64, detectedType string) error {
+	update := expression.Set(expression.Name("Status"), expression.Value(BlobStatusAvailable)).
+		Set(expression.Name("Size"), expression.Value(size))
+	if detectedType != "" {
+		update = update.Set(expression.Name("DetectedType"), expression.Value(detectedType))
+	}
+	cond := expression.AttributeExists(expression.Name("BlobID")).
+		And(expression.NotEqual(expression.Name("Status"), expression.Value(BlobStatusDeleting)))
+
+	err := updateBlob(ctx, blobID, update, cond)
+
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to mark blob %s available: %v", blobID, err)
+	}
+
+	return nil
+}
+
+// SetBlobThumbnails records the thumbnails generated for a blob's content
+func SetBlobThumbnails(ctx context.Context, blobID string, thumbnails []Thumbnail) error {
+	update := expression.Set(expression.Name("Thumbnails"), expression.Value(thumbnails))
+	cond := expression.AttributeExists(expression.Name("BlobID"))
+
+	err := updateBlob(ctx, blobID, update, cond)
+	if err != nil {
+		return fmt.Errorf("failed to record thumbnails of blob %s: %v", blobID, err)
+	}
+
+	return nil
+}
+
+// SetBlobScan records the scan of a blob's content
+func SetBlobScan(ctx context.Context, blobID, status, signature string) error {
+	update := expression.Set(expression.Name("ScanStatus"), expression.Value(status))
+	if signature != "" {
+		update = update.Set(expression.Name("ScanSignature"), expression.Value(signature))
+	} else {
+		update = update.Remove(expression.Name("ScanSignature"))
+	}
+	cond := expression.AttributeExists(expression.Name("BlobID"))
+
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return fmt.Errorf("failed to build blob update: %v", err)
+	}
+
+	_, err = dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String("Blobs"),
+		Key: map[string]types.AttributeValue{
+			"BlobID": &types.AttributeValueMemberS{Value: blobID},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record scan of blob %s: %v", blobID, err)
+	}
+
+	return nil
+}
+
+// RecordScan stores the scan fields and resulting status of a file
+func RecordScan(ctx context.Context, file File) error {
+	update := expression.Set(expression.Name("ScanStatus"), expression.Value(file.ScanStatus)).
+		Set(expression.Name("ScanEngine"), expression.Value(file.ScanEngine)).
+		Set(expression.Name("ScannedAt"), expression.Value(file.ScannedAt)).
+		Set(expression.Name("Status"), expression.Value(file.Status)).
+		Set(expression.Name("UpdatedAt"), expression.Value(file.UpdatedAt))
+	if file.ScanSignature != "" {
+		update = update.Set(expression.Name("ScanSignature"), expression.Value(file.ScanSignature))
+	} else {
+		update = update.Remove(expression.Name("ScanSignature"))
+	}
+	if file.StatusReason != "" {
+		update = update.Set(expression.Name("StatusReason"), expression.Value(file.StatusReason))
+	} else {
+		update = update.Remove(expression.Name("StatusReason"))
+	}
+	cond := expression.AttributeExists(expression.Name("FileID"))
+
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return fmt.Errorf("failed to build scan update: %v", err)
+	}
+
+	_, err = dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
 		TableName: aws.String("FileMetadata"),
 		Key: map[string]types.AttributeValue{
-			"FileID": &types.AttributeValueMemberS{Value: fileID},
+			"FileID": &types.AttributeValueMemberS{Value: file.FileID},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record scan of %s: %v", file.FileID, err)
+	}
+
+	return nil
+}
+
+// MarkBlobDeleting moves a blob nothing references anymore to the deleting
+// state, so that it can't be acquired while its object is deleted, and reports
+// whether it did
+func MarkBlobDeleting(ctx context.Context, blobID string) (bool, error) {
+	update := expression.Set(expression.Name("Status"), expression.Value(BlobStatusDeleting))
+	cond := expression.LessThanEqual(expression.Name("RefCount"), expression.Value(0))
+
+	err := updateBlob(ctx, blobID, update, cond)
+
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to mark blob %s deleting: %v", blobID, err)
+	}
+
+	return true, nil
+}
+
+func updateBlob(ctx context.Context, blobID string, update expression.UpdateBuilder, cond expression.ConditionBuilder) error {
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return fmt.Errorf("failed to build blob update: %v", err)
+	}
+
+	_, err = dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String("Blobs"),
+		Key: map[string]types.AttributeValue{
+			"BlobID": &types.AttributeValueMemberS{Value: blobID},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+	})
+
+	return err
+}
+
+// DeleteBlob removes a blob row once it was marked deleting, and reports
+// whether it did
+func DeleteBlob(ctx context.Context, blobID string) (bool, error) {
+	cond := expression.Equal(expression.Name("Status"), expression.Value(BlobStatusDeleting))
+
+	expr, err := expression.NewBuilder().WithCondition(cond).Build()
+	if err != nil {
+		return false, fmt.Errorf("failed to build blob condition: %v", err)
+	}
+
+	_, err = dbClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String("Blobs"),
+		Key: map[string]types.AttributeValue{
+			"BlobID": &types.AttributeValueMemberS{Value: blobID},
 		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ConditionExpression:       expr.Condition(),
+	})
+
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to delete blob %s: %v", blobID, err)
+	}
+
+	return true, nil
+}
+
+// DeadLetter is an event a handler gave up on, kept for inspection and replay
+type DeadLetter struct {
+	DeadLetterID string `dynamodbav:"DeadLetterID"`
+	Source       string `dynamodbav:"Source"`
+	Payload      string `dynamodbav:"Payload"`
+	Error        string `dynamodbav:"Error"`
+	CreatedAt    string `dynamodbav:"CreatedAt"`
+}
+
+func CreateDeadLetter(ctx context.Context, deadLetter DeadLetter) error {
+	item, err := attributevalue.MarshalMap(deadLetter)
+	if err != nil {
+		return fmt.Errorf("failed to marshal dead letter: %v", err)
+	}
+
+	_, err = dbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String("DeadLetters"),
+		Item:      item,
 	})
 
 	if err != nil {
-		return fmt.Errorf("failed to delete file: %v", err)
+		return fmt.Errorf("failed to create dead letter in DynamoDB: %v", err)
+	}
+
+	return nil
+}
+
+// ScanFiles walks the whole FileMetadata table, calling fn with each page of files
+func ScanFiles(ctx context.Context, fn func(files []File) error) error {
+	paginator := dynamodb.NewScanPaginator(dbClient, &dynamodb.ScanInput{
+		TableName: aws.String("FileMetadata"),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to scan files: %v", err)
+		}
+
+		var files []File
+		err = attributevalue.UnmarshalListOfMaps(page.Items, &files)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal files: %v", err)
+		}
+
+		err = fn(files)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,175 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// conditionFailed is the body of a ConditionalCheckFailedException
+const conditionFailed = `{"__type":"com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException","message":"The conditional request failed"}`
+
+// validationFailed is the body of any other failed request
+const validationFailed = `{"__type":"com.amazonaws.dynamodb.v20120810#ValidationException","message":"invalid request"}`
+
+// conditionValues returns the string values a request's condition can refer to
+func conditionValues(body map[string]interface{}) []string {
+	var values []string
+	attrs, _ := body["ExpressionAttributeValues"].(map[string]interface{})
+	for _, attr := range attrs {
+		if s, ok := attr.(map[string]interface{})["S"].(string); ok {
+			values = append(values, s)
+		}
+	}
+
+	return values
+}
+
+func hasValue(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestRecordUpload(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		body        string
+		wantApplied bool
+		wantErr     bool
+	}{
+		{name: "applied", status: http.StatusOK, body: `{}`, wantApplied: true},
+		// replays and events older than the recorded one are skipped, not failed
+		{name: "stale event", status: http.StatusBadRequest, body: conditionFailed},
+		{name: "other failure", status: http.StatusBadRequest, body: `{"__type":"com.amazonaws.dynamodb.v20120810#ValidationException"}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeDynamoDB(t, func(op string, body map[string]interface{}) (int, string) {
+				cond, _ := body["ConditionExpression"].(string)
+				if op != "UpdateItem" || !strings.Contains(cond, "attribute_not_exists") || !strings.Contains(cond, "<") {
+					t.Errorf("%s with condition %q doesn't guard the sequencer", op, cond)
+				}
+				return tt.status, tt.body
+			})
+
+			applied, err := RecordUpload(context.Background(), File{FileID: "file", UploadSequencer: "0055AED6DCD90281E5"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RecordUpload() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if applied != tt.wantApplied {
+				t.Errorf("RecordUpload() applied = %v, want %v", applied, tt.wantApplied)
+			}
+		})
+	}
+}
+
+func TestAcquireBlob(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		wantRefs int64
+		wantErr  error
+	}{
+		{name: "acquired", status: http.StatusOK, body: `{"Attributes":{"BlobID":{"S":"u/abc"},"RefCount":{"N":"2"},"Status":{"S":"available"}}}`, wantRefs: 2},
+		{name: "being deleted", status: http.StatusBadRequest, body: conditionFailed, wantErr: ErrBlobDeleting},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeDynamoDB(t, func(op string, body map[string]interface{}) (int, string) {
+				if op != "UpdateItem" || !hasValue(conditionValues(body), BlobStatusDeleting) {
+					t.Errorf("%s doesn't refuse deleting blobs: %v", op, body["ConditionExpression"])
+				}
+				return tt.status, tt.body
+			})
+
+			blob, err := AcquireBlob(context.Background(), "u/abc", 10)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("AcquireBlob() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && blob.RefCount != tt.wantRefs {
+				t.Errorf("AcquireBlob() RefCount = %d, want %d", blob.RefCount, tt.wantRefs)
+			}
+		})
+	}
+}
+
+func TestReleaseBlob(t *testing.T) {
+	fakeDynamoDB(t, func(op string, body map[string]interface{}) (int, string) {
+		if !strings.Contains(body["UpdateExpression"].(string), "ADD") {
+			t.Errorf("%s doesn't decrement the reference count: %v", op, body["UpdateExpression"])
+		}
+		return http.StatusOK, `{"Attributes":{"RefCount":{"N":"0"}}}`
+	})
+
+	refs, err := ReleaseBlob(context.Background(), "u/abc")
+	if err != nil || refs != 0 {
+		t.Errorf("ReleaseBlob() = %d, %v, want 0 references", refs, err)
+	}
+}
+
+// TestBlobDeletion covers the two steps that remove an unreferenced blob. Both
+// only go through while nothing acquired the blob again.
+func TestBlobDeletion(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		want    bool
+		wantErr bool
+	}{
+		{name: "done", status: http.StatusOK, body: `{}`, want: true},
+		{name: "acquired again", status: http.StatusBadRequest, body: conditionFailed},
+		{name: "failed", status: http.StatusBadRequest, body: validationFailed, wantErr: true},
+	}
+
+	steps := []struct {
+		name string
+		op   string
+		// cond is part of the condition the step has to be guarded by
+		cond string
+		run  func() (bool, error)
+	}{
+		{name: "MarkBlobDeleting", op: "UpdateItem", cond: "<=", run: func() (bool, error) {
+			return MarkBlobDeleting(context.Background(), "u/abc")
+		}},
+		{name: "DeleteBlob", op: "DeleteItem", cond: "=", run: func() (bool, error) {
+			return DeleteBlob(context.Background(), "u/abc")
+		}},
+	}
+
+	for _, step := range steps {
+		for _, tt := range tests {
+			t.Run(step.name+" "+tt.name, func(t *testing.T) {
+				fakeDynamoDB(t, func(op string, body map[string]interface{}) (int, string) {
+					cond, _ := body["ConditionExpression"].(string)
+					if op != step.op || !strings.Contains(cond, step.cond) {
+						t.Errorf("%s with condition %q, want a %s guarded by %q", op, cond, step.op, step.cond)
+					}
+					if step.op == "DeleteItem" && !hasValue(conditionValues(body), BlobStatusDeleting) {
+						t.Errorf("DeleteItem would delete a blob that isn't deleting: %q", cond)
+					}
+					return tt.status, tt.body
+				})
+
+				got, err := step.run()
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("%s() error = %v, wantErr %v", step.name, err, tt.wantErr)
+				}
+				if got != tt.want {
+					t.Errorf("%s() = %v, want %v", step.name, got, tt.want)
+				}
+			})
+		}
+	}
+}
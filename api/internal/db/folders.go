@@ -0,0 +1,91 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Folder groups files. Files and folders without a parent are at the root.
+type Folder struct {
+	FolderID  string `dynamodbav:"FolderID" json:"folderId"`
+	UserID    string `dynamodbav:"UserID" json:"userId"`
+	Name      string `dynamodbav:"Name" json:"name"`
+	ParentID  string `dynamodbav:"ParentID,omitempty" json:"parentId,omitempty"`
+	CreatedAt string `dynamodbav:"CreatedAt" json:"createdAt"`
+}
+
+func CreateFolder(ctx context.Context, folder Folder) error {
+	item, err := attributevalue.MarshalMap(folder)
+	if err != nil {
+		return fmt.Errorf("failed to marshal folder: %v", err)
+	}
+
+	_, err = dbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String("Folders"),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put folder: %v", err)
+	}
+
+	return nil
+}
+
+func GetFolder(ctx context.Context, folderID string) (*Folder, error) {
+	res, err := dbClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String("Folders"),
+		Key: map[string]types.AttributeValue{
+			"FolderID": &types.AttributeValueMemberS{Value: folderID},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get folder: %v", err)
+	}
+
+	if res.Item == nil {
+		return nil, nil
+	}
+
+	var folder Folder
+	err = attributevalue.UnmarshalMap(res.Item, &folder)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal folder: %v", err)
+	}
+
+	return &folder, nil
+}
+
+func ListUserFolders(ctx context.Context, userID string) ([]Folder, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String("Folders"),
+		IndexName:              aws.String("UserID-index"),
+		KeyConditionExpression: aws.String("UserID = :uid"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":uid": &types.AttributeValueMemberS{Value: userID},
+		},
+	}
+
+	folders := []Folder{}
+	paginator := dynamodb.NewQueryPaginator(dbClient, input)
+	for paginator.HasMorePages() {
+		res, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query user folders: %v", err)
+		}
+
+		var pageFolders []Folder
+		err = attributevalue.UnmarshalListOfMaps(res.Items, &pageFolders)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal folders: %v", err)
+		}
+
+		folders = append(folders, pageFolders...)
+	}
+
+	return folders, nil
+}
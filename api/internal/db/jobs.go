@@ -0,0 +1,242 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// JobRetention is how long finished jobs and their results are kept
+const JobRetention = 24 * time.Hour
+
+// Job is a long running task started by a user. Jobs are run by the Jobs
+// table stream as soon as they are created.
+type Job struct {
+	JobID   string   `dynamodbav:"JobID" json:"jobId"`
+	UserID  string   `dynamodbav:"UserID" json:"-"`
+	Kind    string   `dynamodbav:"Kind" json:"kind"`
+	Status  string   `dynamodbav:"Status" json:"status"`
+	FileIDs []string `dynamodbav:"FileIDs,omitempty" json:"fileIds,omitempty"`
+	// SourceURL is the remote file an import job fetches
+	SourceURL string `dynamodbav:"SourceURL,omitempty" json:"sourceUrl,omitempty"`
+	// FolderID is where a job puts the files it creates, empty for the root
+	FolderID string `dynamodbav:"FolderID,omitempty" json:"folderId,omitempty"`
+	// Progress, in files and bytes processed so far
+	FilesDone  int   `dynamodbav:"FilesDone" json:"filesDone"`
+	FilesTotal int   `dynamodbav:"FilesTotal" json:"filesTotal"`
+	BytesDone  int64 `dynamodbav:"BytesDone" json:"bytesDone"`
+	BytesTotal int64 `dynamodbav:"BytesTotal" json:"bytesTotal"`
+	// ResultKey is the object a job produced, if any
+	ResultKey string `dynamodbav:"ResultKey,omitempty" json:"-"`
+	// Items reports on the individual items of a job, such as archive entries
+	Items     []JobItem `dynamodbav:"Items,omitempty" json:"items,omitempty"`
+	Error     string    `dynamodbav:"Error,omitempty" json:"error,omitempty"`
+	CreatedAt string    `dynamodbav:"CreatedAt" json:"createdAt"`
+	// UpdatedAt is refreshed when a job is claimed and as it reports progress
+	UpdatedAt string `dynamodbav:"UpdatedAt" json:"updatedAt"`
+	ExpiresAt int64  `dynamodbav:"ExpiresAt" json:"-"`
+}
+
+// JobItem is the outcome of one item of a job
+type JobItem struct {
+	Name   string `dynamodbav:"Name" json:"name"`
+	FileID string `dynamodbav:"FileID,omitempty" json:"fileId,omitempty"`
+	Error  string `dynamodbav:"Error,omitempty" json:"error,omitempty"`
+}
+
+func CreateJob(ctx context.Context, job Job) error {
+	item, err := attributevalue.MarshalMap(job)
+	if err != nil {
+		return fmt.Errorf("failed to marshal job: %v", err)
+	}
+
+	_, err = dbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String("Jobs"),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put job: %v", err)
+	}
+
+	return nil
+}
+
+func GetJob(ctx context.Context, jobID string) (*Job, error) {
+	res, err := dbClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String("Jobs"),
+		Key: map[string]types.AttributeValue{
+			"JobID": &types.AttributeValueMemberS{Value: jobID},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get job: %v", err)
+	}
+
+	if res.Item == nil {
+		return nil, nil
+	}
+
+	var job Job
+	err = attributevalue.UnmarshalMap(res.Item, &job)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal job: %v", err)
+	}
+
+	return &job, nil
+}
+
+// ClaimJob moves a queued job to running, and reports whether this caller got
+// it. A job delivered twice is only run once.
+func ClaimJob(ctx context.Context, jobID string) (bool, error) {
+	update := expression.Set(expression.Name("Status"), expression.Value(JobRunning)).
+		Set(expression.Name("UpdatedAt"), expression.Value(time.Now().UTC().Format(time.RFC3339)))
+	cond := expression.Equal(expression.Name("Status"), expression.Value(JobQueued))
+
+	err := updateJob(ctx, jobID, update, cond)
+
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// UpdateJobProgress stores the progress of a running job
+func UpdateJobProgress(ctx context.Context, job Job) error {
+	update := expression.Set(expression.Name("FilesDone"), expression.Value(job.FilesDone)).
+		Set(expression.Name("FilesTotal"), expression.Value(job.FilesTotal)).
+		Set(expression.Name("BytesDone"), expression.Value(job.BytesDone)).
+		Set(expression.Name("BytesTotal"), expression.Value(job.BytesTotal)).
+		Set(expression.Name("UpdatedAt"), expression.Value(time.Now().UTC().Format(time.RFC3339)))
+	cond := expression.Equal(expression.Name("Status"), expression.Value(JobRunning))
+
+	return updateJob(ctx, job.JobID, update, cond)
+}
+
+// FinishJob stores the final status of a running job, along with its result
+// or error
+func FinishJob(ctx context.Context, job Job) error {
+	update := expression.Set(expression.Name("Status"), expression.Value(job.Status)).
+		Set(expression.Name("FilesDone"), expression.Value(job.FilesDone)).
+		Set(expression.Name("BytesDone"), expression.Value(job.BytesDone)).
+		Set(expression.Name("UpdatedAt"), expression.Value(time.Now().UTC().Format(time.RFC3339))).
+		Set(expression.Name("ExpiresAt"), expression.Value(time.Now().Add(JobRetention).Unix()))
+	if job.ResultKey != "" {
+		update = update.Set(expression.Name("ResultKey"), expression.Value(job.ResultKey))
+	}
+	if job.Error != "" {
+		update = update.Set(expression.Name("Error"), expression.Value(job.Error))
+	}
+	if len(job.Items) > 0 {
+		update = update.Set(expression.Name("Items"), expression.Value(job.Items))
+	}
+	cond := expression.Equal(expression.Name("Status"), expression.Value(JobRunning))
+
+	return updateJob(ctx, job.JobID, update, cond)
+}
+
+// ListStaleJobs returns up to limit queued or running jobs that haven't been
+// updated since before
+func ListStaleJobs(ctx context.Context, before time.Time, limit int) ([]Job, error) {
+	filter := expression.In(expression.Name("Status"), expression.Value(JobQueued), expression.Value(JobRunning)).
+		And(expression.LessThan(expression.Name("UpdatedAt"), expression.Value(before.UTC().Format(time.RFC3339))))
+
+	expr, err := expression.NewBuilder().WithFilter(filter).Build()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build stale job filter: %v", err)
+	}
+
+	var jobs []Job
+	paginator := dynamodb.NewScanPaginator(dbClient, &dynamodb.ScanInput{
+		TableName:                 aws.String("Jobs"),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		FilterExpression:          expr.Filter(),
+	})
+
+	for paginator.HasMorePages() && len(jobs) < limit {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan jobs: %v", err)
+		}
+
+		var pageJobs []Job
+		err = attributevalue.UnmarshalListOfMaps(page.Items, &pageJobs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal jobs: %v", err)
+		}
+
+		jobs = append(jobs, pageJobs...)
+	}
+
+	if len(jobs) > limit {
+		jobs = jobs[:limit]
+	}
+
+	return jobs, nil
+}
+
+// FailStaleJob fails a queued or running job whose worker went away, provided
+// it wasn't updated since it was found stale. It reports whether the job was
+// failed.
+func FailStaleJob(ctx context.Context, job Job, reason string) (bool, error) {
+	update := expression.Set(expression.Name("Status"), expression.Value(JobFailed)).
+		Set(expression.Name("Error"), expression.Value(reason)).
+		Set(expression.Name("UpdatedAt"), expression.Value(time.Now().UTC().Format(time.RFC3339))).
+		Set(expression.Name("ExpiresAt"), expression.Value(time.Now().Add(JobRetention).Unix()))
+	cond := expression.Equal(expression.Name("Status"), expression.Value(job.Status)).
+		And(expression.Equal(expression.Name("UpdatedAt"), expression.Value(job.UpdatedAt)))
+
+	err := updateJob(ctx, job.JobID, update, cond)
+
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func updateJob(ctx context.Context, jobID string, update expression.UpdateBuilder, cond expression.ConditionBuilder) error {
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return fmt.Errorf("failed to build job update: %v", err)
+	}
+
+	_, err = dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String("Jobs"),
+		Key: map[string]types.AttributeValue{
+			"JobID": &types.AttributeValueMemberS{Value: jobID},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update job %s: %w", jobID, err)
+	}
+
+	return nil
+}
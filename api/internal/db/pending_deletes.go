@@ -0,0 +1,183 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+)
+
+const (
+	// PendingDeleteObject deletes the S3 object at Key
+	PendingDeleteObject = "object"
+	// PendingDeleteBlob deletes a blob and its object once nothing references it
+	PendingDeleteBlob = "blob"
+)
+
+// PendingDelete is an outbox row for storage that has to be removed after its
+// metadata was deleted. It stays until the delete succeeded, and is retried
+// from NextAttemptAt onwards.
+type PendingDelete struct {
+	OpID          string `dynamodbav:"OpID"`
+	Kind          string `dynamodbav:"Kind"`
+	FileID        string `dynamodbav:"FileID"`
+	Key           string `dynamodbav:"Key"`
+	BlobID        string `dynamodbav:"BlobID,omitempty"`
+	Attempts      int    `dynamodbav:"Attempts"`
+	NextAttemptAt string `dynamodbav:"NextAttemptAt"`
+	LastError     string `dynamodbav:"LastError,omitempty"`
+	CreatedAt     string `dynamodbav:"CreatedAt"`
+}
+
+func newPendingDelete(file File) PendingDelete {
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	op := PendingDelete{
+		OpID:          uuid.New().String(),
+		Kind:          PendingDeleteObject,
+		FileID:        file.FileID,
+		Key:           file.ObjectKey(),
+		NextAttemptAt: now,
+		CreatedAt:     now,
+	}
+	if file.BlobID != "" {
+		op.Kind = PendingDeleteBlob
+		op.BlobID = file.BlobID
+	}
+
+	return op
+}
+
+// SchedulePendingDelete records that the object at key is to be deleted at a
+// later time, for objects that are only kept for a while
+func SchedulePendingDelete(ctx context.Context, key string, at time.Time) error {
+	op := PendingDelete{
+		OpID:          uuid.New().String(),
+		Kind:          PendingDeleteObject,
+		Key:           key,
+		NextAttemptAt: at.UTC().Format(time.RFC3339),
+		CreatedAt:     time.Now().UTC().Format(time.RFC3339),
+	}
+
+	item, err := attributevalue.MarshalMap(op)
+	if err != nil {
+		return fmt.Errorf("failed to marshal pending delete: %v", err)
+	}
+
+	_, err = dbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String("PendingDeletes"),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to schedule delete of %s: %v", key, err)
+	}
+
+	return nil
+}
+
+// ListDuePendingDeletes returns up to limit pending deletes whose next attempt is due
+func ListDuePendingDeletes(ctx context.Context, now time.Time, limit int) ([]PendingDelete, error) {
+	filter := expression.LessThanEqual(expression.Name("NextAttemptAt"), expression.Value(now.UTC().Format(time.RFC3339)))
+
+	expr, err := expression.NewBuilder().WithFilter(filter).Build()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build pending delete filter: %v", err)
+	}
+
+	var ops []PendingDelete
+	paginator := dynamodb.NewScanPaginator(dbClient, &dynamodb.ScanInput{
+		TableName:                 aws.String("PendingDeletes"),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		FilterExpression:          expr.Filter(),
+	})
+
+	for paginator.HasMorePages() && len(ops) < limit {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan pending deletes: %v", err)
+		}
+
+		var pageOps []PendingDelete
+		err = attributevalue.UnmarshalListOfMaps(page.Items, &pageOps)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal pending deletes: %v", err)
+		}
+
+		ops = append(ops, pageOps...)
+	}
+
+	if len(ops) > limit {
+		ops = ops[:limit]
+	}
+
+	return ops, nil
+}
+
+// CompletePendingDelete removes a pending delete once its storage is gone
+func CompletePendingDelete(ctx context.Context, opID string) error {
+	_, err := dbClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String("PendingDeletes"),
+		Key: map[string]types.AttributeValue{
+			"OpID": &types.AttributeValueMemberS{Value: opID},
+		},
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to complete pending delete %s: %v", opID, err)
+	}
+
+	return nil
+}
+
+// CompletePendingDeletes removes many completed pending deletes at once
+func CompletePendingDeletes(ctx context.Context, opIDs []string) error {
+	requests := make([]types.WriteRequest, len(opIDs))
+	for i, opID := range opIDs {
+		requests[i] = types.WriteRequest{
+			DeleteRequest: &types.DeleteRequest{
+				Key: map[string]types.AttributeValue{
+					"OpID": &types.AttributeValueMemberS{Value: opID},
+				},
+			},
+		}
+	}
+
+	return BatchWrite(ctx, "PendingDeletes", requests)
+}
+
+// RetryPendingDelete records a failed attempt and when to try again
+func RetryPendingDelete(ctx context.Context, opID string, nextAttemptAt time.Time, cause error) error {
+	update := expression.Add(expression.Name("Attempts"), expression.Value(1)).
+		Set(expression.Name("NextAttemptAt"), expression.Value(nextAttemptAt.UTC().Format(time.RFC3339))).
+		Set(expression.Name("LastError"), expression.Value(cause.Error()))
+	cond := expression.AttributeExists(expression.Name("OpID"))
+
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return fmt.Errorf("failed to build pending delete update: %v", err)
+	}
+
+	_, err = dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String("PendingDeletes"),
+		Key: map[string]types.AttributeValue{
+			"OpID": &types.AttributeValueMemberS{Value: opID},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to reschedule pending delete %s: %v", opID, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,55 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListDuePendingDeletes(t *testing.T) {
+	// three pages of two due ops each
+	var pages int
+	fakeDynamoDB(t, func(op string, body map[string]interface{}) (int, string) {
+		if op != "Scan" || body["TableName"] != "PendingDeletes" {
+			return http.StatusBadRequest, `{"__type":"com.amazonaws.dynamodb.v20120810#ValidationException"}`
+		}
+		pages++
+
+		var items []string
+		for i := 0; i < 2; i++ {
+			items = append(items, fmt.Sprintf(`{"OpID":{"S":"op-%d-%d"},"Kind":{"S":"object"},"Key":{"S":"key"}}`, pages, i))
+		}
+		res := `{"Items":[` + strings.Join(items, ",") + `]`
+		if pages < 3 {
+			res += fmt.Sprintf(`,"LastEvaluatedKey":{"OpID":{"S":"op-%d-1"}}`, pages)
+		}
+		return http.StatusOK, res + `}`
+	})
+
+	tests := []struct {
+		limit     int
+		wantOps   int
+		wantPages int
+	}{
+		{limit: 1, wantOps: 1, wantPages: 1},
+		{limit: 2, wantOps: 2, wantPages: 1},
+		{limit: 3, wantOps: 3, wantPages: 2},
+		{limit: 100, wantOps: 6, wantPages: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("limit %d", tt.limit), func(t *testing.T) {
+			pages = 0
+			ops, err := ListDuePendingDeletes(context.Background(), time.Now(), tt.limit)
+			if err != nil {
+				t.Fatalf("ListDuePendingDeletes() error = %v", err)
+			}
+			if len(ops) != tt.wantOps || pages != tt.wantPages {
+				t.Errorf("ListDuePendingDeletes() = %d ops from %d pages, want %d from %d", len(ops), pages, tt.wantOps, tt.wantPages)
+			}
+		})
+	}
+}
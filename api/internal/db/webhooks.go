@@ -0,0 +1,428 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ErrWebhookNotFound is returned for webhooks that don't exist or belong to someone else
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+// Webhook is an endpoint a user registered to receive file events. Events is
+// the event type filter, no events means all of them.
+type Webhook struct {
+	WebhookID string   `dynamodbav:"WebhookID" json:"webhookId"`
+	UserID    string   `dynamodbav:"UserID" json:"userId"`
+	URL       string   `dynamodbav:"URL" json:"url"`
+	Secret    string   `dynamodbav:"Secret" json:"-"`
+	Events    []string `dynamodbav:"Events,omitempty,stringset" json:"events,omitempty"`
+	// Disabled is set once ConsecutiveFailures reaches the limit, until the
+	// owner enables the webhook again
+	Disabled            bool   `dynamodbav:"Disabled" json:"disabled"`
+	DisabledReason      string `dynamodbav:"DisabledReason,omitempty" json:"disabledReason,omitempty"`
+	ConsecutiveFailures int    `dynamodbav:"ConsecutiveFailures" json:"consecutiveFailures"`
+	CreatedAt           string `dynamodbav:"CreatedAt" json:"createdAt"`
+}
+
+// Subscribed reports whether the webhook wants events of the given type
+func (w Webhook) Subscribed(eventType string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+
+	for _, t := range w.Events {
+		if t == eventType {
+			return true
+		}
+	}
+
+	return false
+}
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// WebhookDelivery is one event sent to one webhook, along with the outcome of
+// its latest attempt. Pending deliveries are retried from NextAttemptAt onwards.
+type WebhookDelivery struct {
+	DeliveryID     string `dynamodbav:"DeliveryID" json:"deliveryId"`
+	WebhookID      string `dynamodbav:"WebhookID" json:"webhookId"`
+	EventType      string `dynamodbav:"EventType" json:"eventType"`
+	Payload        string `dynamodbav:"Payload" json:"payload"`
+	Status         string `dynamodbav:"Status" json:"status"`
+	Attempts       int    `dynamodbav:"Attempts" json:"attempts"`
+	NextAttemptAt  string `dynamodbav:"NextAttemptAt,omitempty" json:"nextAttemptAt,omitempty"`
+	LastStatusCode int    `dynamodbav:"LastStatusCode,omitempty" json:"lastStatusCode,omitempty"`
+	LastError      string `dynamodbav:"LastError,omitempty" json:"lastError,omitempty"`
+	CreatedAt      string `dynamodbav:"CreatedAt" json:"createdAt"`
+	UpdatedAt      string `dynamodbav:"UpdatedAt" json:"updatedAt"`
+}
+
+func CreateWebhook(ctx context.Context, webhook Webhook) error {
+	item, err := attributevalue.MarshalMap(webhook)
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook: %v", err)
+	}
+
+	_, err = dbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String("Webhooks"),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put webhook: %v", err)
+	}
+
+	return nil
+}
+
+func GetWebhook(ctx context.Context, webhookID string) (*Webhook, error) {
+	res, err := dbClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String("Webhooks"),
+		Key: map[string]types.AttributeValue{
+			"WebhookID": &types.AttributeValueMemberS{Value: webhookID},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhook: %v", err)
+	}
+
+	if res.Item == nil {
+		return nil, nil
+	}
+
+	var webhook Webhook
+	err = attributevalue.UnmarshalMap(res.Item, &webhook)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal webhook: %v", err)
+	}
+
+	return &webhook, nil
+}
+
+func ListUserWebhooks(ctx context.Context, userID string) ([]Webhook, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String("Webhooks"),
+		IndexName:              aws.String("UserID-index"),
+		KeyConditionExpression: aws.String("UserID = :uid"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":uid": &types.AttributeValueMemberS{Value: userID},
+		},
+	}
+
+	webhooks := []Webhook{}
+	paginator := dynamodb.NewQueryPaginator(dbClient, input)
+	for paginator.HasMorePages() {
+		res, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query user webhooks: %v", err)
+		}
+
+		var pageWebhooks []Webhook
+		err = attributevalue.UnmarshalListOfMaps(res.Items, &pageWebhooks)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal webhooks: %v", err)
+		}
+
+		webhooks = append(webhooks, pageWebhooks...)
+	}
+
+	return webhooks, nil
+}
+
+// DeleteWebhook removes a webhook owned by userID. Its delivery log is kept.
+func DeleteWebhook(ctx context.Context, webhookID, userID string) error {
+	cond := expression.Equal(expression.Name("UserID"), expression.Value(userID))
+
+	expr, err := expression.NewBuilder().WithCondition(cond).Build()
+	if err != nil {
+		return fmt.Errorf("failed to build webhook condition: %v", err)
+	}
+
+	_, err = dbClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String("Webhooks"),
+		Key: map[string]types.AttributeValue{
+			"WebhookID": &types.AttributeValueMemberS{Value: webhookID},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ConditionExpression:       expr.Condition(),
+	})
+
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return ErrWebhookNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete webhook %s: %v", webhookID, err)
+	}
+
+	return nil
+}
+
+// EnableWebhook re-enables a webhook owned by userID and clears its failures
+func EnableWebhook(ctx context.Context, webhookID, userID string) error {
+	update := expression.Set(expression.Name("Disabled"), expression.Value(false)).
+		Set(expression.Name("ConsecutiveFailures"), expression.Value(0)).
+		Remove(expression.Name("DisabledReason"))
+	cond := expression.Equal(expression.Name("UserID"), expression.Value(userID))
+
+	err := updateWebhook(ctx, webhookID, update, &cond)
+
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return ErrWebhookNotFound
+	}
+
+	return err
+}
+
+// RecordWebhookSuccess resets the failure count of a webhook
+func RecordWebhookSuccess(ctx context.Context, webhookID string) error {
+	return updateWebhook(ctx, webhookID, expression.Set(expression.Name("ConsecutiveFailures"), expression.Value(0)), nil)
+}
+
+// RecordWebhookFailure counts a failed attempt and disables the webhook once
+// limit consecutive attempts failed. It reports whether the webhook is disabled.
+func RecordWebhookFailure(ctx context.Context, webhookID string, limit int) (bool, error) {
+	update := expression.Add(expression.Name("ConsecutiveFailures"), expression.Value(1))
+
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(expression.AttributeExists(expression.Name("WebhookID"))).Build()
+	if err != nil {
+		return false, fmt.Errorf("failed to build webhook update: %v", err)
+	}
+
+	res, err := dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String("Webhooks"),
+		Key: map[string]types.AttributeValue{
+			"WebhookID": &types.AttributeValueMemberS{Value: webhookID},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ReturnValues:              types.ReturnValueAllNew,
+	})
+
+	// the webhook was deleted, there is nothing left to disable
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to update webhook %s: %v", webhookID, err)
+	}
+
+	var webhook Webhook
+	err = attributevalue.UnmarshalMap(res.Attributes, &webhook)
+	if err != nil {
+		return false, fmt.Errorf("failed to unmarshal webhook: %v", err)
+	}
+
+	if webhook.Disabled || webhook.ConsecutiveFailures < limit {
+		return webhook.Disabled, nil
+	}
+
+	update = expression.Set(expression.Name("Disabled"), expression.Value(true)).
+		Set(expression.Name("DisabledReason"), expression.Value(fmt.Sprintf("%d consecutive failed deliveries", webhook.ConsecutiveFailures)))
+
+	return true, updateWebhook(ctx, webhookID, update, nil)
+}
+
+func updateWebhook(ctx context.Context, webhookID string, update expression.UpdateBuilder, cond *expression.ConditionBuilder) error {
+	builder := expression.NewBuilder().WithUpdate(update)
+	if cond != nil {
+		builder = builder.WithCondition(*cond)
+	} else {
+		builder = builder.WithCondition(expression.AttributeExists(expression.Name("WebhookID")))
+	}
+
+	expr, err := builder.Build()
+	if err != nil {
+		return fmt.Errorf("failed to build webhook update: %v", err)
+	}
+
+	_, err = dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String("Webhooks"),
+		Key: map[string]types.AttributeValue{
+			"WebhookID": &types.AttributeValueMemberS{Value: webhookID},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+	})
+
+	if err != nil {
+		// wrapped so callers can tell failed conditions apart
+		return fmt.Errorf("failed to update webhook %s: %w", webhookID, err)
+	}
+
+	return nil
+}
+
+// CreateWebhookDelivery stores a new delivery and reports whether it did. A
+// delivery with the same ID is only created once, so redelivered events don't
+// reach a webhook twice.
+func CreateWebhookDelivery(ctx context.Context, delivery WebhookDelivery) (bool, error) {
+	item, err := attributevalue.MarshalMap(delivery)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal webhook delivery: %v", err)
+	}
+
+	_, err = dbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String("WebhookDeliveries"),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(DeliveryID)"),
+	})
+
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to put webhook delivery: %v", err)
+	}
+
+	return true, nil
+}
+
+// UpdateWebhookDelivery stores the outcome of a delivery attempt
+func UpdateWebhookDelivery(ctx context.Context, delivery WebhookDelivery) error {
+	item, err := attributevalue.MarshalMap(delivery)
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook delivery: %v", err)
+	}
+
+	_, err = dbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String("WebhookDeliveries"),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update webhook delivery %s: %v", delivery.DeliveryID, err)
+	}
+
+	return nil
+}
+
+// ClaimWebhookDelivery takes a pending delivery for one attempt by moving its
+// NextAttemptAt to until, so no other sender picks it up in the meantime. It
+// reports false if the delivery changed since it was read, meaning someone else
+// claimed or finished it.
+func ClaimWebhookDelivery(ctx context.Context, delivery WebhookDelivery, until time.Time) (bool, error) {
+	update := expression.Set(expression.Name("NextAttemptAt"), expression.Value(until.UTC().Format(time.RFC3339)))
+	cond := expression.Equal(expression.Name("Status"), expression.Value(DeliveryPending)).
+		And(expression.Equal(expression.Name("NextAttemptAt"), expression.Value(delivery.NextAttemptAt)))
+
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return false, fmt.Errorf("failed to build webhook delivery update: %v", err)
+	}
+
+	_, err = dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String("WebhookDeliveries"),
+		Key: map[string]types.AttributeValue{
+			"DeliveryID": &types.AttributeValueMemberS{Value: delivery.DeliveryID},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+	})
+
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to claim webhook delivery %s: %v", delivery.DeliveryID, err)
+	}
+
+	return true, nil
+}
+
+// ListDueWebhookDeliveries returns up to limit pending deliveries whose next attempt is due
+func ListDueWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]WebhookDelivery, error) {
+	filter := expression.Equal(expression.Name("Status"), expression.Value(DeliveryPending)).
+		And(expression.LessThanEqual(expression.Name("NextAttemptAt"), expression.Value(now.UTC().Format(time.RFC3339))))
+
+	expr, err := expression.NewBuilder().WithFilter(filter).Build()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build webhook delivery filter: %v", err)
+	}
+
+	var deliveries []WebhookDelivery
+	paginator := dynamodb.NewScanPaginator(dbClient, &dynamodb.ScanInput{
+		TableName:                 aws.String("WebhookDeliveries"),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		FilterExpression:          expr.Filter(),
+	})
+
+	for paginator.HasMorePages() && len(deliveries) < limit {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook deliveries: %v", err)
+		}
+
+		var pageDeliveries []WebhookDelivery
+		err = attributevalue.UnmarshalListOfMaps(page.Items, &pageDeliveries)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal webhook deliveries: %v", err)
+		}
+
+		deliveries = append(deliveries, pageDeliveries...)
+	}
+
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+
+	return deliveries, nil
+}
+
+// ListWebhookDeliveries returns a page of a webhook's delivery log, newest first
+func ListWebhookDeliveries(ctx context.Context, webhookID, cursor string, limit int32) ([]WebhookDelivery, string, error) {
+	startKey, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	res, err := dbClient.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String("WebhookDeliveries"),
+		IndexName:              aws.String("WebhookID-index"),
+		KeyConditionExpression: aws.String("WebhookID = :wid"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":wid": &types.AttributeValueMemberS{Value: webhookID},
+		},
+		ExclusiveStartKey: startKey,
+		Limit:             aws.Int32(limit),
+		ScanIndexForward:  aws.Bool(false),
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to query webhook deliveries: %v", err)
+	}
+
+	deliveries := []WebhookDelivery{}
+	err = attributevalue.UnmarshalListOfMaps(res.Items, &deliveries)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to unmarshal webhook deliveries: %v", err)
+	}
+
+	next, err := encodeCursor(res.LastEvaluatedKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return deliveries, next, nil
+}
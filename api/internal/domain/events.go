@@ -0,0 +1,96 @@
+// Package domain defines the events the backend reacts to when its tables change,
+// independently of the DynamoDB stream records they are derived from.
+package domain
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/johnnynu/agreatchaos/api/internal/db"
+)
+
+// Meta is shared by every event
+type Meta struct {
+	// EventID identifies the change the event was derived from. It is stable
+	// across redeliveries, so subscribers can use it to deduplicate.
+	EventID    string
+	OccurredAt time.Time
+}
+
+// Event is one of FileCreated, FileUpdated, FileUploaded, FileRenamed, FileDeleted or UserCreated
+type Event interface {
+	Metadata() Meta
+}
+
+func (m Meta) Metadata() Meta {
+	return m
+}
+
+// FileCreated is emitted when a file row is created, usually before its content is uploaded
+type FileCreated struct {
+	Meta
+	File db.File
+}
+
+// FileUpdated is emitted for every change to an existing file row, before the
+// more specific FileUploaded and FileRenamed
+type FileUpdated struct {
+	Meta
+	File db.File
+}
+
+// FileUploaded is emitted when a file's content becomes available
+type FileUploaded struct {
+	Meta
+	File db.File
+}
+
+// FileRenamed is emitted when a file's name changes
+type FileRenamed struct {
+	Meta
+	File    db.File
+	OldName string
+}
+
+// FileDeleted is emitted when a file row is removed
+type FileDeleted struct {
+	Meta
+	File db.File
+}
+
+// UserCreated is emitted when a user signs in for the first time
+type UserCreated struct {
+	Meta
+	User db.User
+}
+
+// Subscriber handles events, using a type switch to pick the ones it cares about.
+// It may be called again with an event it already saw if a delivery is retried.
+type Subscriber func(ctx context.Context, event Event) error
+
+// Dispatcher fans events out to its subscribers
+type Dispatcher struct {
+	subscribers []Subscriber
+}
+
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{}
+}
+
+func (d *Dispatcher) Subscribe(subscriber Subscriber) {
+	d.subscribers = append(d.subscribers, subscriber)
+}
+
+// Dispatch calls every subscriber, even if an earlier one failed, and returns
+// all of their errors
+func (d *Dispatcher) Dispatch(ctx context.Context, event Event) error {
+	var errs []error
+	for _, subscriber := range d.subscribers {
+		if err := subscriber(ctx, event); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/uuid"
+	"github.com/johnnynu/agreatchaos/api/internal/db"
+	"github.com/johnnynu/agreatchaos/api/internal/domain"
+	"github.com/johnnynu/agreatchaos/api/pkg/utils"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+func init() {
+	StreamDispatcher.Subscribe(auditEvent)
+}
+
+// recordAudit appends an audit entry for an API request. actorID defaults to
+// the subject of the request's JWT. Handlers that hand out access to content
+// fail when the entry can't be written, the others only log it.
+func recordAudit(ctx context.Context, request events.APIGatewayProxyRequest, action, actorID string, file *db.File) error {
+	return recordAuditDetails(ctx, request, action, actorID, file, "")
+}
+
+// recordAuditDetails is recordAudit with details on the action, such as the
+// job it started
+func recordAuditDetails(ctx context.Context, request events.APIGatewayProxyRequest, action, actorID string, file *db.File, details string) error {
+	if actorID == "" {
+		actorID = jwtSubject(request)
+	}
+
+	entry := db.AuditEntry{
+		EntryID:   uuid.New().String(),
+		Action:    action,
+		ActorID:   actorID,
+		IP:        request.RequestContext.Identity.SourceIP,
+		UserAgent: request.RequestContext.Identity.UserAgent,
+		RequestID: request.RequestContext.RequestID,
+		Details:   details,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	if entry.UserAgent == "" {
+		entry.UserAgent = request.Headers["user-agent"]
+	}
+	if file != nil {
+		entry.FileID = file.FileID
+		entry.FileName = file.FileName
+		entry.OwnerID = file.UserID
+	}
+
+	err := db.CreateAuditEntry(ctx, entry)
+	if err != nil {
+		return fmt.Errorf("failed to record %s: %v", action, err)
+	}
+
+	return nil
+}
+
+// auditEvent records the actions that are only visible on the stream. The
+// entry IDs derive from the event IDs so redelivered records are written once.
+func auditEvent(ctx context.Context, event domain.Event) error {
+	var entry db.AuditEntry
+	switch e := event.(type) {
+	case domain.FileUploaded:
+		entry = streamAuditEntry(event, db.AuditUploadCompleted, e.File)
+	case domain.FileRenamed:
+		entry = streamAuditEntry(event, db.AuditRename, e.File)
+		entry.Details = fmt.Sprintf("renamed from %q", e.OldName)
+	default:
+		return nil
+	}
+
+	return db.CreateAuditEntry(ctx, entry)
+}
+
+func streamAuditEntry(event domain.Event, action string, file db.File) db.AuditEntry {
+	meta := event.Metadata()
+
+	return db.AuditEntry{
+		EntryID:   meta.EventID + "/" + action,
+		Action:    action,
+		ActorID:   file.UserID,
+		OwnerID:   file.UserID,
+		FileID:    file.FileID,
+		FileName:  file.FileName,
+		CreatedAt: meta.OccurredAt.UTC().Format(time.RFC3339Nano),
+	}
+}
+
+// FileAuditLog returns a page of a file's history to its owner
+func FileAuditLog(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := jwtSubject(request)
+	if userID == "" {
+		log.Println("Unable to extract user ID from JWT claims")
+		return utils.ResponseError(fmt.Errorf("unable to extract user ID from JWT claims"))
+	}
+
+	fileID := request.PathParameters["fileId"]
+	if fileID == "" {
+		return utils.ResponseError(errors.New("fileID is required"))
+	}
+
+	limit, err := pageSize(request)
+	if err != nil {
+		return events.APIGatewayProxyResponse{StatusCode: 400, Body: err.Error()}, nil
+	}
+
+	entries, cursor, err := db.ListFileAudit(ctx, fileID, userID, request.QueryStringParameters["cursor"], limit)
+	return auditPage(entries, cursor, err)
+}
+
+// UserAuditLog returns a page of the caller's own activity
+func UserAuditLog(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := jwtSubject(request)
+	if userID == "" {
+		log.Println("Unable to extract user ID from JWT claims")
+		return utils.ResponseError(fmt.Errorf("unable to extract user ID from JWT claims"))
+	}
+
+	limit, err := pageSize(request)
+	if err != nil {
+		return events.APIGatewayProxyResponse{StatusCode: 400, Body: err.Error()}, nil
+	}
+
+	entries, cursor, err := db.ListUserAudit(ctx, userID, request.QueryStringParameters["cursor"], limit)
+	return auditPage(entries, cursor, err)
+}
+
+func auditPage(entries []db.AuditEntry, cursor string, err error) (events.APIGatewayProxyResponse, error) {
+	if errors.Is(err, db.ErrInvalidCursor) {
+		return events.APIGatewayProxyResponse{StatusCode: 400, Body: err.Error()}, nil
+	}
+	if err != nil {
+		log.Printf("Error listing audit entries: %v", err)
+		return utils.ResponseError(err)
+	}
+
+	return utils.ResponseOK(struct {
+		Entries    []db.AuditEntry `json:"entries"`
+		NextCursor string          `json:"nextCursor,omitempty"`
+	}{entries, cursor})
+}
+
+func pageSize(request events.APIGatewayProxyRequest) (int32, error) {
+	value := request.QueryStringParameters["limit"]
+	if value == "" {
+		return defaultPageSize, nil
+	}
+
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 || limit > maxPageSize {
+		return 0, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+	}
+
+	return int32(limit), nil
+}
+
+// jwtSubject returns the user ID from the JWT claims the authorizer verified
+func jwtSubject(request events.APIGatewayProxyRequest) string {
+	if jwt, ok := request.RequestContext.Authorizer["jwt"].(map[string]interface{}); ok {
+		if claims, ok := jwt["claims"].(map[string]interface{}); ok {
+			if sub, ok := claims["sub"].(string); ok {
+				return sub
+			}
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,275 @@
+package handlers
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/uuid"
+	"github.com/johnnynu/agreatchaos/api/internal/db"
+	"github.com/johnnynu/agreatchaos/api/pkg/utils"
+)
+
+const (
+	jobBulkDownload = "bulk_download"
+
+	maxBulkDownloadFiles = 1000
+	maxBulkDownloadBytes = maxJobBytes
+	bulkDownloadPartSize = 16 * 1024 * 1024
+)
+
+type BulkDownloadRequest struct {
+	FileIDs []string `json:"fileIds"`
+}
+
+func init() {
+	jobRunners[jobBulkDownload] = runBulkDownload
+}
+
+// CreateBulkDownload starts a job that packs the caller's files into a ZIP
+// archive. The job's progress and result are read with GetJob.
+func CreateBulkDownload(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := jwtSubject(request)
+	if userID == "" {
+		log.Println("Unable to extract user ID from JWT claims")
+		return utils.ResponseError(fmt.Errorf("unable to extract user ID from JWT claims"))
+	}
+
+	var req BulkDownloadRequest
+	err := json.Unmarshal([]byte(request.Body), &req)
+	if err != nil {
+		return events.APIGatewayProxyResponse{StatusCode: 400, Body: "invalid request body"}, nil
+	}
+
+	if len(req.FileIDs) == 0 || len(req.FileIDs) > maxBulkDownloadFiles {
+		return events.APIGatewayProxyResponse{StatusCode: 400, Body: fmt.Sprintf("between 1 and %d fileIds are required", maxBulkDownloadFiles)}, nil
+	}
+
+	seen := make(map[string]bool)
+	var files []*db.File
+	var fileIDs []string
+	var total int64
+	for _, fileID := range req.FileIDs {
+		if seen[fileID] {
+			continue
+		}
+		seen[fileID] = true
+
+		file, err := db.GetFile(ctx, fileID)
+		if err != nil {
+			log.Printf("Error getting file: %v", err)
+			return utils.ResponseError(err)
+		}
+		if file == nil || file.UserID != userID {
+			return events.APIGatewayProxyResponse{StatusCode: 404, Body: fmt.Sprintf("file %s not found", fileID)}, nil
+		}
+		if !downloadable(file) {
+			return events.APIGatewayProxyResponse{StatusCode: 400, Body: fmt.Sprintf("file %s is %s", fileID, unavailableReason(file))}, nil
+		}
+
+		files = append(files, file)
+		fileIDs = append(fileIDs, fileID)
+		total += file.FileSize
+	}
+
+	if total > maxBulkDownloadBytes {
+		return events.APIGatewayProxyResponse{StatusCode: 400, Body: fmt.Sprintf("bulk downloads are limited to %d bytes", int64(maxBulkDownloadBytes))}, nil
+	}
+
+	now := time.Now()
+	job := db.Job{
+		JobID:      uuid.New().String(),
+		UserID:     userID,
+		Kind:       jobBulkDownload,
+		Status:     db.JobQueued,
+		FileIDs:    fileIDs,
+		FilesTotal: len(fileIDs),
+		BytesTotal: total,
+		CreatedAt:  now.UTC().Format(time.RFC3339),
+		UpdatedAt:  now.UTC().Format(time.RFC3339),
+		// a job the stream never picks up still goes away
+		ExpiresAt: now.Add(db.JobRetention).Unix(),
+	}
+
+	// the archive hands out every file's content, so each one is audited
+	// before the job can run
+	auditErrs := make([]error, len(files))
+	forEachBounded(len(files), bulkConcurrency, func(i int) {
+		auditErrs[i] = recordAuditDetails(ctx, request, db.AuditBulkDownload, userID, files[i], "job "+job.JobID)
+	})
+	err = errors.Join(auditErrs...)
+	if err != nil {
+		log.Printf("Error recording audit entries: %v", err)
+		return utils.ResponseError(err)
+	}
+
+	err = db.CreateJob(ctx, job)
+	if err != nil {
+		log.Printf("Error creating job: %v", err)
+		return utils.ResponseError(err)
+	}
+
+	res, err := utils.ResponseOK(job)
+	res.StatusCode = 202
+	return res, err
+}
+
+// downloadable reports whether a file's content may be handed out. Once a
+// scanner is configured, that takes a clean scan, whatever the file's status.
+func downloadable(file *db.File) bool {
+	// files from before upload statuses existed have none
+	stored := file.Status == "" || file.Status == db.FileStatusUploaded || file.Status == db.FileStatusFlagged
+
+	return stored && (uploadScanner == nil || file.ScanStatus == db.ScanClean)
+}
+
+// unavailableReason says why a file isn't downloadable, for error messages
+func unavailableReason(file *db.File) string {
+	if file.Status == "" || file.Status == db.FileStatusUploaded || file.Status == db.FileStatusFlagged {
+		return "waiting on a malware scan"
+	}
+
+	return file.Status
+}
+
+// runBulkDownload streams the job's files into a ZIP archive under tmpPrefix.
+// The archive is written as a multipart upload, so it is never held in memory,
+// and uses ZIP64 records once it or an entry outgrows the classic format.
+func runBulkDownload(ctx context.Context, s3Client *s3.Client, job *db.Job) error {
+	bucket := "chaosfiles-filestorage"
+	key := tmpPrefix + "bulk/" + job.JobID + ".zip"
+
+	w, err := newMultipartWriter(ctx, s3Client, bucket, key, "application/zip", max(bulkDownloadPartSize, int(job.BytesTotal/(maxParts-1))+1))
+	if err != nil {
+		return err
+	}
+
+	err = writeBulkArchive(ctx, s3Client, bucket, job, w)
+	if err != nil {
+		if abortErr := w.Abort(); abortErr != nil {
+			log.Printf("Error aborting archive upload: %v", abortErr)
+		}
+		return err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	err = db.SchedulePendingDelete(ctx, key, time.Now().Add(db.JobRetention))
+	if err != nil {
+		return err
+	}
+
+	job.ResultKey = key
+	return nil
+}
+
+func writeBulkArchive(ctx context.Context, s3Client *s3.Client, bucket string, job *db.Job, w io.Writer) error {
+	progress := &jobProgress{job: job}
+	archive := zip.NewWriter(w)
+	names := archiveNames{}
+
+	for _, fileID := range job.FileIDs {
+		// the file may have changed since the job was created
+		file, err := db.GetFile(ctx, fileID)
+		if err != nil {
+			return err
+		}
+		if file == nil || file.UserID != job.UserID || !downloadable(file) {
+			log.Printf("Skipping file %s, no longer available", fileID)
+			job.FilesDone++
+			continue
+		}
+
+		modified, err := time.Parse(time.RFC3339, file.UpdatedAt)
+		if err != nil {
+			modified = time.Now()
+		}
+
+		entry, err := archive.CreateHeader(&zip.FileHeader{
+			Name:     names.unique(file.FileName),
+			Method:   zip.Store, // most uploads are already compressed
+			Modified: modified,
+		})
+		if err != nil {
+			return err
+		}
+
+		obj, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(file.ObjectKey()),
+		})
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", fileID, err)
+		}
+
+		_, err = io.Copy(entry, &progressReader{r: obj.Body, job: job, progress: progress, ctx: ctx})
+		obj.Body.Close()
+		if err != nil {
+			return fmt.Errorf("error archiving %s: %v", fileID, err)
+		}
+
+		job.FilesDone++
+		progress.update(ctx, false)
+	}
+
+	return archive.Close()
+}
+
+// progressReader counts the bytes a job read into its progress
+type progressReader struct {
+	ctx      context.Context
+	r        io.Reader
+	job      *db.Job
+	progress *jobProgress
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.job.BytesDone += int64(n)
+	r.progress.update(r.ctx, false)
+	return n, err
+}
+
+// archiveNames makes file names unique within an archive, the way desktop file
+// managers do: "a.txt", "a (1).txt", "a (2).txt"
+type archiveNames map[string]bool
+
+func (names archiveNames) unique(name string) string {
+	name = archiveEntryName(name)
+
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	candidate := name
+	for i := 1; names[strings.ToLower(candidate)]; i++ {
+		candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+
+	names[strings.ToLower(candidate)] = true
+	return candidate
+}
+
+// archiveEntryName turns a file name into a relative path that can't escape
+// the directory the archive is extracted to
+func archiveEntryName(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	name = path.Clean("/" + name)
+	name = strings.TrimPrefix(name, "/")
+	if name == "" || name == "." {
+		return "file"
+	}
+
+	return name
+}
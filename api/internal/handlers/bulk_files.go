@@ -0,0 +1,358 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/johnnynu/agreatchaos/api/internal/db"
+	"github.com/johnnynu/agreatchaos/api/pkg/utils"
+)
+
+const (
+	bulkDelete  = "delete"
+	bulkMove    = "move"
+	bulkTag     = "tag"
+	bulkTrash   = "trash"
+	bulkRestore = "restore"
+
+	maxBulkFiles = 1000
+	maxBulkTags  = 20
+	maxTagLength = 64
+	// bulkConcurrency bounds the requests a bulk action has in flight
+	bulkConcurrency = 8
+	// deleteObjectsBatchSize is the most keys DeleteObjects takes at once
+	deleteObjectsBatchSize = 1000
+)
+
+type BulkFilesRequest struct {
+	Action  string   `json:"action"`
+	FileIDs []string `json:"fileIds"`
+	// FolderID is where move puts the files, empty for the root
+	FolderID string `json:"folderId"`
+	// Tags are added to the files by tag
+	Tags []string `json:"tags"`
+}
+
+// bulkResult is the outcome of a bulk action for one file
+type bulkResult struct {
+	FileID string `json:"fileId"`
+	OK     bool   `json:"ok"`
+	Error  string `json:"error,omitempty"`
+}
+
+// BulkFiles applies an action to many of the caller's files at once. Files are
+// handled independently, so the response reports on each of them instead of
+// failing the whole request.
+func BulkFiles(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := jwtSubject(request)
+	if userID == "" {
+		log.Println("Unable to extract user ID from JWT claims")
+		return utils.ResponseError(fmt.Errorf("unable to extract user ID from JWT claims"))
+	}
+
+	var req BulkFilesRequest
+	err := json.Unmarshal([]byte(request.Body), &req)
+	if err != nil {
+		return events.APIGatewayProxyResponse{StatusCode: 400, Body: "invalid request body"}, nil
+	}
+
+	fileIDs := uniqueIDs(req.FileIDs)
+	if len(fileIDs) == 0 || len(fileIDs) > maxBulkFiles {
+		return events.APIGatewayProxyResponse{StatusCode: 400, Body: fmt.Sprintf("between 1 and %d fileIds are required", maxBulkFiles)}, nil
+	}
+
+	var apply func(ctx context.Context, fileID string) error
+	switch req.Action {
+	case bulkDelete:
+		results := bulkDeleteFiles(ctx, request, userID, fileIDs)
+		return utils.ResponseOK(map[string]interface{}{"results": results})
+	case bulkMove:
+		if req.FolderID != "" {
+			owned, err := ownsFolder(ctx, userID, req.FolderID)
+			if err != nil {
+				log.Printf("Error getting folder: %v", err)
+				return utils.ResponseError(err)
+			}
+			if !owned {
+				return events.APIGatewayProxyResponse{StatusCode: 404, Body: "folder not found"}, nil
+			}
+		}
+		apply = func(ctx context.Context, fileID string) error {
+			return db.MoveFile(ctx, fileID, userID, req.FolderID)
+		}
+	case bulkTag:
+		tags, err := cleanTags(req.Tags)
+		if err != nil {
+			return events.APIGatewayProxyResponse{StatusCode: 400, Body: err.Error()}, nil
+		}
+		apply = func(ctx context.Context, fileID string) error {
+			return db.AddFileTags(ctx, fileID, userID, tags)
+		}
+	case bulkTrash:
+		apply = func(ctx context.Context, fileID string) error {
+			return db.TrashFile(ctx, fileID, userID)
+		}
+	case bulkRestore:
+		apply = func(ctx context.Context, fileID string) error {
+			return db.RestoreFile(ctx, fileID, userID)
+		}
+	default:
+		return events.APIGatewayProxyResponse{StatusCode: 400, Body: fmt.Sprintf("unknown action %q", req.Action)}, nil
+	}
+
+	results := make([]bulkResult, len(fileIDs))
+	forEachBounded(len(fileIDs), bulkConcurrency, func(i int) {
+		results[i] = newBulkResult(fileIDs[i], apply(ctx, fileIDs[i]))
+	})
+
+	return utils.ResponseOK(map[string]interface{}{"results": results})
+}
+
+// bulkDeleteFiles deletes the user's files in transactions of up to
+// db.DeleteFilesLimit files, and their objects with DeleteObjects.
+// Deduplicated files go through DeleteFile one by one, as they also drop
+// their blob reference.
+func bulkDeleteFiles(ctx context.Context, request events.APIGatewayProxyRequest, userID string, fileIDs []string) []bulkResult {
+	results := make([]bulkResult, len(fileIDs))
+	files := make([]*db.File, len(fileIDs))
+
+	found, err := db.GetFiles(ctx, fileIDs)
+	if err != nil {
+		for i, fileID := range fileIDs {
+			results[i] = newBulkResult(fileID, err)
+		}
+		return results
+	}
+
+	byID := make(map[string]*db.File, len(found))
+	for i := range found {
+		byID[found[i].FileID] = &found[i]
+	}
+	for i, fileID := range fileIDs {
+		file := byID[fileID]
+		if file == nil || file.UserID != userID {
+			results[i] = newBulkResult(fileID, db.ErrFileNotFound)
+			continue
+		}
+		files[i] = file
+	}
+
+	var plain []db.File
+	var shared []int
+	for i, file := range files {
+		switch {
+		case file == nil:
+		case file.BlobID != "":
+			shared = append(shared, i)
+		default:
+			plain = append(plain, *file)
+		}
+	}
+
+	var ops []db.PendingDelete
+	var mu sync.Mutex
+	forEachBounded(len(shared), bulkConcurrency, func(j int) {
+		i := shared[j]
+		file, op, err := db.DeleteFile(ctx, fileIDs[i], userID)
+		results[i] = newBulkResult(fileIDs[i], err)
+		if err != nil {
+			return
+		}
+
+		mu.Lock()
+		ops = append(ops, *op)
+		mu.Unlock()
+		logDeleteAudit(ctx, request, userID, file)
+	})
+
+	// each chunk is deleted in one transaction, and reported on as a whole
+	var chunks [][]db.File
+	for start := 0; start < len(plain); start += db.DeleteFilesLimit {
+		chunks = append(chunks, plain[start:min(start+db.DeleteFilesLimit, len(plain))])
+	}
+	index := make(map[string]int, len(fileIDs))
+	for i, fileID := range fileIDs {
+		index[fileID] = i
+	}
+	forEachBounded(len(chunks), bulkConcurrency, func(j int) {
+		deleted, err := db.DeleteFiles(ctx, chunks[j])
+		for _, file := range chunks[j] {
+			i := index[file.FileID]
+			op, ok := deleted[file.FileID]
+			switch {
+			case err != nil:
+				results[i] = newBulkResult(file.FileID, err)
+			case !ok:
+				results[i] = newBulkResult(file.FileID, db.ErrFileNotFound)
+			default:
+				results[i] = newBulkResult(file.FileID, nil)
+				mu.Lock()
+				ops = append(ops, op)
+				mu.Unlock()
+				logDeleteAudit(ctx, request, userID, files[i])
+			}
+		}
+	})
+
+	// the files are gone at this point, storage the batch can't remove is left
+	// to the pending delete worker
+	err = deletePendingObjects(ctx, ops)
+	if err != nil {
+		log.Printf("Error deleting storage of bulk deleted files, leaving it to the worker: %v", err)
+	}
+
+	return results
+}
+
+// deletePendingObjects runs pending object deletes with DeleteObjects and
+// completes the ones that went through. Blob deletes need their reference
+// count checked, so they run one by one.
+func deletePendingObjects(ctx context.Context, ops []db.PendingDelete) error {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to load SDK config, %v", err)
+	}
+	s3Client := s3.NewFromConfig(cfg)
+	bucket := "chaosfiles-filestorage"
+
+	var objects []db.PendingDelete
+	var blobs []db.PendingDelete
+	for _, op := range ops {
+		if op.Kind == db.PendingDeleteObject {
+			objects = append(objects, op)
+		} else {
+			blobs = append(blobs, op)
+		}
+	}
+
+	forEachBounded(len(blobs), bulkConcurrency, func(i int) {
+		err := runPendingDelete(ctx, blobs[i])
+		if err != nil {
+			log.Printf("Error running pending delete %s: %v", blobs[i].OpID, err)
+		}
+	})
+
+	// derived objects have known names, deleting the ones that don't exist is a no-op
+	var keys []string
+	owner := make(map[string]string)
+	for _, op := range objects {
+		opKeys := []string{op.Key, derivedKey(op.Key, "preview.json")}
+		for _, size := range thumbnailSizes {
+			opKeys = append(opKeys, derivedKey(op.Key, "thumb_"+size.name+".jpg"))
+		}
+		for _, key := range opKeys {
+			keys = append(keys, key)
+			owner[key] = op.OpID
+		}
+	}
+
+	failed := make(map[string]bool)
+	for start := 0; start < len(keys); start += deleteObjectsBatchSize {
+		batch := keys[start:min(start+deleteObjectsBatchSize, len(keys))]
+
+		ids := make([]types.ObjectIdentifier, len(batch))
+		for i, key := range batch {
+			ids[i] = types.ObjectIdentifier{Key: aws.String(key)}
+		}
+
+		res, err := s3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &types.Delete{Objects: ids, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return fmt.Errorf("unable to delete objects from S3, %v", err)
+		}
+
+		for _, objErr := range res.Errors {
+			log.Printf("Error deleting %s: %s", aws.ToString(objErr.Key), aws.ToString(objErr.Message))
+			failed[owner[aws.ToString(objErr.Key)]] = true
+		}
+	}
+
+	var completed []string
+	for _, op := range objects {
+		if !failed[op.OpID] {
+			completed = append(completed, op.OpID)
+		}
+	}
+
+	return db.CompletePendingDeletes(ctx, completed)
+}
+
+// logDeleteAudit records the delete of one file of a bulk delete
+func logDeleteAudit(ctx context.Context, request events.APIGatewayProxyRequest, userID string, file *db.File) {
+	err := recordAudit(ctx, request, db.AuditDelete, userID, file)
+	if err != nil {
+		log.Printf("Error recording audit entry: %v", err)
+	}
+}
+
+func newBulkResult(fileID string, err error) bulkResult {
+	if err == nil {
+		return bulkResult{FileID: fileID, OK: true}
+	}
+	if !errors.Is(err, db.ErrFileNotFound) {
+		log.Printf("Bulk action failed for file %s: %v", fileID, err)
+	}
+
+	return bulkResult{FileID: fileID, Error: err.Error()}
+}
+
+// forEachBounded calls fn for 0..n-1 with at most limit calls running at once
+func forEachBounded(n, limit int, fn func(i int)) {
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func uniqueIDs(ids []string) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, id := range ids {
+		if id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		unique = append(unique, id)
+	}
+
+	return unique
+}
+
+// cleanTags trims and dedupes tags, and rejects empty or overlong ones
+func cleanTags(tags []string) ([]string, error) {
+	tags = uniqueIDs(tags)
+	if len(tags) == 0 || len(tags) > maxBulkTags {
+		return nil, fmt.Errorf("between 1 and %d tags are required", maxBulkTags)
+	}
+
+	cleaned := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || len(tag) > maxTagLength {
+			return nil, fmt.Errorf("tags must be between 1 and %d characters", maxTagLength)
+		}
+		cleaned = append(cleaned, tag)
+	}
+
+	return uniqueIDs(cleaned), nil
+}
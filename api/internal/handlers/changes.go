@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/johnnynu/agreatchaos/api/internal/db"
+	"github.com/johnnynu/agreatchaos/api/internal/domain"
+	"github.com/johnnynu/agreatchaos/api/pkg/utils"
+)
+
+// changeCursorMargin keeps cursors from being used right up to the retention
+// limit, when their next entries may already have expired
+const changeCursorMargin = 24 * time.Hour
+
+func init() {
+	StreamDispatcher.Subscribe(recordChange)
+}
+
+// recordChange appends file changes to their owner's change log. Entries are
+// appended once per stream event, so retried records don't repeat them.
+func recordChange(ctx context.Context, event domain.Event) error {
+	var change db.Change
+	switch e := event.(type) {
+	case domain.FileCreated:
+		change = db.Change{Op: db.ChangeCreate, File: e.File}
+	case domain.FileUpdated:
+		change = db.Change{Op: db.ChangeUpdate, File: e.File}
+	case domain.FileDeleted:
+		change = db.Change{Op: db.ChangeDelete, File: e.File}
+	default:
+		return nil
+	}
+
+	meta := event.Metadata()
+	change.UserID = change.File.UserID
+	change.FileID = change.File.FileID
+	change.EventID = meta.EventID
+	change.OccurredAt = meta.OccurredAt.UTC().Format(time.RFC3339)
+	change.ExpiresAt = time.Now().Add(db.ChangeRetention).Unix()
+
+	_, err := db.AppendChange(ctx, change)
+
+	if errors.Is(err, db.ErrUserNotFound) {
+		log.Printf("No user %s for the change to file %s", change.UserID, change.FileID)
+		return nil
+	}
+
+	return err
+}
+
+// ListChanges returns the caller's file changes after a cursor. Without a
+// cursor, or with one older than the change log retention, it asks the client
+// to resync: list every file, then follow the returned cursor.
+func ListChanges(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := jwtSubject(request)
+	if userID == "" {
+		log.Println("Unable to extract user ID from JWT claims")
+		return utils.ResponseError(fmt.Errorf("unable to extract user ID from JWT claims"))
+	}
+
+	limit, err := pageSize(request)
+	if err != nil {
+		return events.APIGatewayProxyResponse{StatusCode: 400, Body: err.Error()}, nil
+	}
+
+	now := time.Now()
+	cursor := request.QueryStringParameters["cursor"]
+
+	var seq int64
+	var issuedAt time.Time
+	if cursor != "" {
+		seq, issuedAt, err = decodeChangeCursor(cursor)
+		if err != nil {
+			return events.APIGatewayProxyResponse{StatusCode: 400, Body: err.Error()}, nil
+		}
+	}
+
+	if cursor == "" || issuedAt.Before(now.Add(-db.ChangeRetention+changeCursorMargin)) {
+		user, err := db.GetUser(ctx, userID)
+		if err != nil {
+			log.Printf("Error getting user: %v", err)
+			return utils.ResponseError(err)
+		}
+		if user == nil {
+			return utils.ResponseError(utils.ErrNotFound)
+		}
+
+		return utils.ResponseOK(changesResponse{
+			Changes: []db.Change{},
+			Cursor:  encodeChangeCursor(user.ChangeSeq, now),
+			Resync:  true,
+		})
+	}
+
+	changes, err := db.ListChanges(ctx, userID, seq, limit)
+	if err != nil {
+		log.Printf("Error listing changes: %v", err)
+		return utils.ResponseError(err)
+	}
+
+	res := changesResponse{
+		Changes: changes,
+		Cursor:  encodeChangeCursor(seq, now),
+		HasMore: len(changes) == int(limit),
+	}
+	if len(changes) > 0 {
+		last := changes[len(changes)-1]
+		// while there are more changes, the cursor is only as fresh as the last one returned
+		issuedAt = now
+		if res.HasMore {
+			issuedAt, err = time.Parse(time.RFC3339, last.OccurredAt)
+			if err != nil {
+				issuedAt = now
+			}
+		}
+		res.Cursor = encodeChangeCursor(last.Seq, issuedAt)
+	}
+
+	return utils.ResponseOK(res)
+}
+
+type changesResponse struct {
+	Changes []db.Change `json:"changes"`
+	Cursor  string      `json:"cursor"`
+	HasMore bool        `json:"hasMore"`
+	// Resync tells the client its state can't be brought up to date with changes
+	Resync bool `json:"resync,omitempty"`
+}
+
+// encodeChangeCursor encodes a change sequence number along with the time up to
+// which the client has seen every change
+func encodeChangeCursor(seq int64, issuedAt time.Time) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d.%d", seq, issuedAt.Unix())))
+}
+
+func decodeChangeCursor(cursor string) (int64, time.Time, error) {
+	invalid := errors.New("invalid cursor")
+
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, time.Time{}, invalid
+	}
+
+	seqPart, timePart, ok := strings.Cut(string(b), ".")
+	if !ok {
+		return 0, time.Time{}, invalid
+	}
+
+	seq, err := strconv.ParseInt(seqPart, 10, 64)
+	if err != nil || seq < 0 {
+		return 0, time.Time{}, invalid
+	}
+
+	issuedAt, err := strconv.ParseInt(timePart, 10, 64)
+	if err != nil {
+		return 0, time.Time{}, invalid
+	}
+
+	return seq, time.Unix(issuedAt, 0), nil
+}
@@ -6,7 +6,6 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -24,8 +23,9 @@ type CompleteUploadRequest struct {
 }
 
 type Part struct {
-	ETag       string `json:"ETag"`
-	PartNumber int32  `json:"PartNumber"`
+	ETag           string `json:"ETag"`
+	PartNumber     int32  `json:"PartNumber"`
+	ChecksumSHA256 string `json:"ChecksumSHA256,omitempty"`
 }
 
 func CompleteUpload(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
@@ -72,6 +72,7 @@ func CompleteUpload(ctx context.Context, request events.APIGatewayProxyRequest)
 
 	if file.UserID != userID {
 		log.Printf("user %s does not own file %s", userID, req.FileID)
+		return utils.ResponseError(errors.New("file not found"))
 	}
 
 	// set up s3 client
@@ -89,10 +90,13 @@ func CompleteUpload(ctx context.Context, request events.APIGatewayProxyRequest)
 			ETag: aws.String(part.ETag),
 			PartNumber: aws.Int32(part.PartNumber),
 		}
+		if part.ChecksumSHA256 != "" {
+			completedParts[i].ChecksumSHA256 = aws.String(part.ChecksumSHA256)
+		}
 	}
 
 	// call CompleteMultipartUpload
-	_, err = s3Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+	completeResp, err := s3Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
 		Bucket: aws.String("chaosfiles-filestorage"),
 		Key: aws.String(req.FileID),
 		UploadId: aws.String(req.UploadID),
@@ -106,12 +110,15 @@ func CompleteUpload(ctx context.Context, request events.APIGatewayProxyRequest)
 		return utils.ResponseError(err)
 	}
 
-	// update file status in the database
-	file.UpdatedAt = time.Now().Format(time.RFC3339)
-	err = db.UpdateFile(ctx, *file)
-	if err != nil {
-		log.Printf("error updating file metadata: %v", err)
-		return utils.ResponseError(err)
+	// the status is ProcessUpload's to set, once it has checked and scanned
+	// the object
+	checksum := aws.ToString(completeResp.ChecksumSHA256)
+	if checksum != "" {
+		err = db.RecordMultipartChecksum(ctx, req.FileID, checksum)
+		if err != nil {
+			log.Printf("error updating file metadata: %v", err)
+			return utils.ResponseError(err)
+		}
 	}
 
 	log.Printf("multipart upload completed successfully for file: %s", req.FileID)
@@ -119,5 +126,6 @@ func CompleteUpload(ctx context.Context, request events.APIGatewayProxyRequest)
 	return utils.ResponseOK(map[string]string{
 		"message": "Upload completed successfully",
 		"fileID":  req.FileID,
+		"checksumSHA256": checksum,
 	})
 }
\ No newline at end of file
@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/johnnynu/agreatchaos/api/internal/db"
+)
+
+const (
+	// CONTENT_TYPE_POLICY values, deciding what happens to uploads whose
+	// content doesn't match their declared type
+	contentTypeCorrect = "correct" // serve the detected type instead
+	contentTypeFlag    = "flag"    // keep the declared type and flag the file, the default
+	contentTypeReject  = "reject"  // fail the upload and delete the object, unless it is a shared blob
+
+	// sniffLength is how much of an object is read to detect its type
+	sniffLength = 512
+)
+
+// contentTypeAliases maps alternative spellings to the types sniffing returns
+var contentTypeAliases = map[string]string{
+	"image/jpg":                    "image/jpeg",
+	"image/pjpeg":                  "image/jpeg",
+	"application/x-zip-compressed": "application/zip",
+	"application/gzip":             "application/x-gzip",
+	"application/x-pdf":            "application/pdf",
+	"audio/mp3":                    "audio/mpeg",
+	"audio/x-wav":                  "audio/wave",
+	"audio/wav":                    "audio/wave",
+}
+
+// zipContainerTypes are formats stored as zip archives, which sniff as application/zip
+var zipContainerTypes = []string{
+	"application/vnd.openxmlformats-officedocument.",
+	"application/vnd.oasis.opendocument.",
+	"application/epub+zip",
+	"application/java-archive",
+	"application/vnd.android.package-archive",
+}
+
+// textContentTypes are non text/* types whose content sniffs as plain text
+var textContentTypes = map[string]bool{
+	"application/json":       true,
+	"application/javascript": true,
+	"application/xml":        true,
+	"application/x-yaml":     true,
+	"application/x-sh":       true,
+	"application/sql":        true,
+	"image/svg+xml":          true,
+}
+
+// riskyContentTypes can run script when a browser renders them inline
+var riskyContentTypes = map[string]bool{
+	"text/html":                     true,
+	"application/xhtml+xml":         true,
+	"image/svg+xml":                 true,
+	"text/xml":                      true,
+	"application/xml":               true,
+	"text/javascript":               true,
+	"application/javascript":        true,
+	"application/x-shockwave-flash": true,
+	"application/pdf":               true,
+}
+
+// sniffContentType detects the type of content from its first bytes, without
+// parameters. It returns application/octet-stream when nothing matches.
+func sniffContentType(data []byte) string {
+	// DetectContentType doesn't know these
+	switch {
+	case bytes.HasPrefix(bytes.TrimSpace(data), []byte("<svg")):
+		return "image/svg+xml"
+	case bytes.HasPrefix(data, []byte("7z\xbc\xaf\x27\x1c")):
+		return "application/x-7z-compressed"
+	}
+
+	return baseContentType(http.DetectContentType(data))
+}
+
+// baseContentType strips the parameters of a content type and lowercases it
+func baseContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	}
+
+	if alias, ok := contentTypeAliases[mediaType]; ok {
+		return alias
+	}
+
+	return mediaType
+}
+
+// contentTypeMatches reports whether content detected as detected may be what
+// was declared. Sniffing can't tell apart every type, so a generic detection
+// matches any declared type it could stand for.
+func contentTypeMatches(declared, detected string) bool {
+	declared = baseContentType(declared)
+
+	switch {
+	case declared == detected:
+		return true
+	case declared == "" || declared == "application/octet-stream":
+		return true
+	case detected == "application/octet-stream":
+		// unrecognised binary content
+		return !strings.HasPrefix(declared, "text/") && !textContentTypes[declared]
+	case detected == "text/plain":
+		return strings.HasPrefix(declared, "text/") || textContentTypes[declared]
+	case detected == "application/zip":
+		for _, prefix := range zipContainerTypes {
+			if strings.HasPrefix(declared, prefix) {
+				return true
+			}
+		}
+	case detected == "text/xml":
+		return declared == "application/xml"
+	}
+
+	return false
+}
+
+// applyContentTypePolicy records the type detected from a file's content and
+// applies the CONTENT_TYPE_POLICY when it doesn't match the declared type. It
+// reports whether the file was rejected, in which case the caller deletes the
+// object if it isn't shared.
+func applyContentTypePolicy(file *db.File, detected string) bool {
+	if file.DeclaredType == "" {
+		file.DeclaredType = file.FileType
+	}
+	file.DetectedType = detected
+
+	if detected == "" || contentTypeMatches(file.DeclaredType, detected) {
+		return false
+	}
+
+	log.Printf("File %s declared %s but its content is %s", file.FileID, file.DeclaredType, detected)
+	reason := fmt.Sprintf("declared type %s does not match detected type %s", file.DeclaredType, detected)
+
+	switch contentTypePolicy() {
+	case contentTypeCorrect:
+		file.FileType = detected
+	case contentTypeReject:
+		file.Status = db.FileStatusFailed
+		file.StatusReason = reason
+		return true
+	default:
+		file.Status = db.FileStatusFlagged
+		file.StatusReason = reason
+	}
+
+	return false
+}
+
+// contentTypePolicy returns the configured CONTENT_TYPE_POLICY
+func contentTypePolicy() string {
+	switch policy := os.Getenv("CONTENT_TYPE_POLICY"); policy {
+	case contentTypeCorrect, contentTypeReject:
+		return policy
+	}
+
+	return contentTypeFlag
+}
+
+// isRiskyContentType reports whether a type must never be rendered inline
+func isRiskyContentType(contentType string) bool {
+	return riskyContentTypes[baseContentType(contentType)]
+}
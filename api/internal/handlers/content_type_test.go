@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/johnnynu/agreatchaos/api/internal/db"
+)
+
+func TestApplyContentTypePolicy(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       string
+		declared     string
+		detected     string
+		wantRejected bool
+		wantStatus   string
+		wantType     string
+	}{
+		{name: "match", declared: "image/png", detected: "image/png", wantStatus: db.FileStatusUploaded, wantType: "image/png"},
+		{name: "nothing detected", declared: "image/png", detected: "", wantStatus: db.FileStatusUploaded, wantType: "image/png"},
+		{name: "mismatch is flagged by default", declared: "image/png", detected: "text/html", wantStatus: db.FileStatusFlagged, wantType: "image/png"},
+		{name: "mismatch is corrected", policy: contentTypeCorrect, declared: "image/png", detected: "text/html", wantStatus: db.FileStatusUploaded, wantType: "text/html"},
+		{name: "mismatch is rejected", policy: contentTypeReject, declared: "image/png", detected: "text/html", wantRejected: true, wantStatus: db.FileStatusFailed, wantType: "image/png"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CONTENT_TYPE_POLICY", tt.policy)
+
+			file := db.File{FileID: "f1", FileType: tt.declared, Status: db.FileStatusUploaded}
+			rejected := applyContentTypePolicy(&file, tt.detected)
+
+			if rejected != tt.wantRejected || file.Status != tt.wantStatus || file.FileType != tt.wantType {
+				t.Errorf("got rejected %v, status %q, type %q, want %v, %q, %q",
+					rejected, file.Status, file.FileType, tt.wantRejected, tt.wantStatus, tt.wantType)
+			}
+			if file.DeclaredType != tt.declared || file.DetectedType != tt.detected {
+				t.Errorf("declared %q detected %q, want %q and %q", file.DeclaredType, file.DetectedType, tt.declared, tt.detected)
+			}
+		})
+	}
+}
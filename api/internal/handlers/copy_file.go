@@ -0,0 +1,349 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/google/uuid"
+	"github.com/johnnynu/agreatchaos/api/internal/db"
+	"github.com/johnnynu/agreatchaos/api/pkg/utils"
+)
+
+const (
+	jobCopy = "copy"
+
+	maxFileNameLength = 255
+	// syncCopyLimit is the largest object copied during the request. A
+	// CopyObject of anything larger can outlast the API Gateway timeout.
+	syncCopyLimit = 100 * 1024 * 1024 // 100MB
+	// copyPartSize is the part size of multipart copies, raised for objects that
+	// would need more than maxParts
+	copyPartSize = 512 * 1024 * 1024
+	// copyConcurrency bounds the parts a multipart copy has in flight
+	copyConcurrency = 8
+)
+
+type CopyFileRequest struct {
+	// Name is the name of the copy, by default the file's name with " (copy)"
+	Name string `json:"name"`
+	// FolderID is the folder of the copy, by default the file's folder. Use
+	// "root" to copy to the root.
+	FolderID string `json:"folderId"`
+}
+
+func init() {
+	jobRunners[jobCopy] = runCopy
+}
+
+// CopyFile duplicates one of the caller's files without its content leaving
+// S3. Deduplicated files only gain a blob reference, objects up to
+// syncCopyLimit are copied right away, and larger ones are copied part by part
+// by a job whose progress is read with GetJob.
+func CopyFile(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := jwtSubject(request)
+	if userID == "" {
+		log.Println("Unable to extract user ID from JWT claims")
+		return utils.ResponseError(fmt.Errorf("unable to extract user ID from JWT claims"))
+	}
+
+	fileID := request.PathParameters["fileId"]
+	if fileID == "" {
+		return utils.ResponseError(errors.New("fileID is required"))
+	}
+
+	var req CopyFileRequest
+	if request.Body != "" {
+		err := json.Unmarshal([]byte(request.Body), &req)
+		if err != nil {
+			return events.APIGatewayProxyResponse{StatusCode: 400, Body: "invalid request body"}, nil
+		}
+	}
+
+	src, err := db.GetFile(ctx, fileID)
+	if err != nil {
+		log.Printf("Error getting file: %v", err)
+		return utils.ResponseError(err)
+	}
+	if src == nil || src.UserID != userID {
+		return utils.ResponseError(utils.ErrNotFound)
+	}
+	if !downloadable(src) {
+		return events.APIGatewayProxyResponse{StatusCode: 400, Body: fmt.Sprintf("file is %s", unavailableReason(src))}, nil
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = copyName(src.FileName)
+	}
+	if len(name) > maxFileNameLength {
+		return events.APIGatewayProxyResponse{StatusCode: 400, Body: "name is too long"}, nil
+	}
+
+	folderID := src.FolderID
+	switch req.FolderID {
+	case "":
+	case "root":
+		folderID = ""
+	default:
+		owned, err := ownsFolder(ctx, userID, req.FolderID)
+		if err != nil {
+			log.Printf("Error getting folder: %v", err)
+			return utils.ResponseError(err)
+		}
+		if !owned {
+			return events.APIGatewayProxyResponse{StatusCode: 404, Body: "folder not found"}, nil
+		}
+		folderID = req.FolderID
+	}
+
+	remaining, limited, err := quotaRemaining(ctx, userID)
+	if err != nil {
+		log.Printf("Error checking quota: %v", err)
+		return utils.ResponseError(err)
+	}
+	if limited && src.FileSize > remaining {
+		return events.APIGatewayProxyResponse{StatusCode: 403, Body: errQuotaExceeded.Error()}, nil
+	}
+
+	now := time.Now().Format(time.RFC3339)
+	dst := db.File{
+		FileID:    uuid.New().String(),
+		UserID:    userID,
+		FileName:  name,
+		FileSize:  src.FileSize,
+		FileType:  src.FileType,
+		FolderID:  folderID,
+		Tags:      src.Tags,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Status:    db.FileStatusPending,
+	}
+
+	err = recordAuditDetails(ctx, request, db.AuditCopy, userID, src, "copy "+dst.FileID)
+	if err != nil {
+		log.Printf("Error recording audit entry: %v", err)
+		return utils.ResponseError(err)
+	}
+
+	// the blob is already stored, scanned and thumbnailed, the copy shares all of it
+	if src.BlobID != "" {
+		dst.BlobID = src.BlobID
+		dst.ChecksumSHA256 = src.ChecksumSHA256
+		dst.Status = src.Status
+		dst.StatusReason = src.StatusReason
+		dst.DeclaredType = src.DeclaredType
+		dst.DetectedType = src.DetectedType
+		dst.ScanStatus = src.ScanStatus
+		dst.ScanSignature = src.ScanSignature
+		dst.ScanEngine = src.ScanEngine
+		dst.ScannedAt = src.ScannedAt
+		dst.Thumbnails = src.Thumbnails
+
+		err = db.CreateBlobFile(ctx, dst)
+		if errors.Is(err, db.ErrConditionFailed) {
+			return events.APIGatewayProxyResponse{StatusCode: 409, Body: "file content is no longer available"}, nil
+		}
+		if err != nil {
+			log.Printf("Error creating file copy: %v", err)
+			return utils.ResponseError(err)
+		}
+
+		return utils.ResponseOK(dst)
+	}
+
+	// the row has to exist before the object, or the object would be quarantined
+	err = db.CreateFile(ctx, dst)
+	if err != nil {
+		log.Printf("Error creating file copy: %v", err)
+		return utils.ResponseError(err)
+	}
+
+	if src.FileSize > syncCopyLimit {
+		nowTime := time.Now()
+		job := db.Job{
+			JobID:      uuid.New().String(),
+			UserID:     userID,
+			Kind:       jobCopy,
+			Status:     db.JobQueued,
+			FileIDs:    []string{src.FileID, dst.FileID},
+			FilesTotal: 1,
+			BytesTotal: src.FileSize,
+			CreatedAt:  nowTime.UTC().Format(time.RFC3339),
+			UpdatedAt:  nowTime.UTC().Format(time.RFC3339),
+			ExpiresAt:  nowTime.Add(db.JobRetention).Unix(),
+		}
+
+		err = db.CreateJob(ctx, job)
+		if err != nil {
+			log.Printf("Error creating job: %v", err)
+			discardFile(ctx, dst)
+			return utils.ResponseError(err)
+		}
+
+		res, err := utils.ResponseOK(map[string]interface{}{"file": dst, "job": job})
+		res.StatusCode = 202
+		return res, err
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return utils.ResponseError(err)
+	}
+
+	bucket := "chaosfiles-filestorage"
+	_, err = s3.NewFromConfig(cfg).CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(dst.ObjectKey()),
+		CopySource:  aws.String(copySource(bucket, src.ObjectKey())),
+		ContentType: aws.String(dst.FileType),
+		// the copy is a new upload, it doesn't keep the source's metadata
+		MetadataDirective: types.MetadataDirectiveReplace,
+	})
+	if err != nil {
+		log.Printf("Error copying object: %v", err)
+		discardFile(ctx, dst)
+		return utils.ResponseError(err)
+	}
+
+	return utils.ResponseOK(dst)
+}
+
+// runCopy copies an object too large to copy during the request with
+// UploadPartCopy. The job's FileIDs are the source and the copy.
+func runCopy(ctx context.Context, s3Client *s3.Client, job *db.Job) error {
+	bucket := "chaosfiles-filestorage"
+
+	src, err := db.GetFile(ctx, job.FileIDs[0])
+	if err != nil {
+		return err
+	}
+	dst, err := db.GetFile(ctx, job.FileIDs[1])
+	if err != nil {
+		return err
+	}
+	if dst == nil {
+		return fmt.Errorf("copy was deleted before it was written")
+	}
+	if src == nil || src.UserID != job.UserID || !downloadable(src) {
+		discardFile(ctx, *dst)
+		return fmt.Errorf("file is no longer available")
+	}
+
+	err = copyObjectParts(ctx, s3Client, bucket, src, dst, job)
+	if err != nil {
+		discardFile(ctx, *dst)
+		return err
+	}
+
+	job.FilesDone = 1
+	return nil
+}
+
+// copyObjectParts copies src's object to dst's in parts copied side by side
+func copyObjectParts(ctx context.Context, s3Client *s3.Client, bucket string, src, dst *db.File, job *db.Job) error {
+	ranges := copyPartRanges(src.FileSize)
+
+	upload, err := s3Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(dst.ObjectKey()),
+		ContentType: aws.String(dst.FileType),
+	})
+	if err != nil {
+		return fmt.Errorf("error creating multipart upload: %v", err)
+	}
+
+	parts := make([]types.CompletedPart, len(ranges))
+	progress := &jobProgress{job: job}
+	var mu sync.Mutex
+	var copyErr error
+
+	forEachBounded(len(ranges), copyConcurrency, func(i int) {
+		mu.Lock()
+		failed := copyErr != nil
+		mu.Unlock()
+		if failed {
+			return
+		}
+
+		first, last := ranges[i][0], ranges[i][1]
+		res, err := s3Client.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+			Bucket:          aws.String(bucket),
+			Key:             aws.String(dst.ObjectKey()),
+			UploadId:        upload.UploadId,
+			PartNumber:      aws.Int32(int32(i + 1)),
+			CopySource:      aws.String(copySource(bucket, src.ObjectKey())),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", first, last)),
+		})
+
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			if copyErr == nil {
+				copyErr = fmt.Errorf("error copying part %d: %v", i+1, err)
+			}
+			return
+		}
+
+		parts[i] = types.CompletedPart{ETag: res.CopyPartResult.ETag, PartNumber: aws.Int32(int32(i + 1))}
+		job.BytesDone += last - first + 1
+		progress.update(ctx, false)
+	})
+
+	if copyErr == nil {
+		_, copyErr = s3Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(bucket),
+			Key:             aws.String(dst.ObjectKey()),
+			UploadId:        upload.UploadId,
+			MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+		})
+	}
+	if copyErr != nil {
+		_, err := s3Client.AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(bucket),
+			Key:      aws.String(dst.ObjectKey()),
+			UploadId: upload.UploadId,
+		})
+		if err != nil {
+			log.Printf("Error aborting multipart copy: %v", err)
+		}
+		return copyErr
+	}
+
+	progress.update(ctx, true)
+	return nil
+}
+
+// copyPartRanges splits an object of size bytes into the inclusive byte ranges
+// of its copy parts, copyPartSize each unless that would take more than maxParts
+func copyPartRanges(size int64) [][2]int64 {
+	partSize := max(int64(copyPartSize), size/maxParts+1)
+
+	var ranges [][2]int64
+	for first := int64(0); first < size; first += partSize {
+		ranges = append(ranges, [2]int64{first, min(first+partSize, size) - 1})
+	}
+
+	return ranges
+}
+
+// copyName names a copy after its source: "a.txt" becomes "a (copy).txt"
+func copyName(name string) string {
+	ext := path.Ext(name)
+	if ext == name {
+		ext = ""
+	}
+
+	return strings.TrimSuffix(name, ext) + " (copy)" + ext
+}
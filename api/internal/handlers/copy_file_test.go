@@ -0,0 +1,51 @@
+package handlers
+
+import "testing"
+
+func TestCopyPartRanges(t *testing.T) {
+	const gb = 1024 * 1024 * 1024
+
+	tests := []struct {
+		name      string
+		size      int64
+		wantParts int
+		wantSize  int64
+	}{
+		{name: "one byte", size: 1, wantParts: 1, wantSize: 1},
+		{name: "under one part", size: copyPartSize - 1, wantParts: 1, wantSize: copyPartSize - 1},
+		{name: "exactly one part", size: copyPartSize, wantParts: 1, wantSize: copyPartSize},
+		{name: "one byte over a part", size: copyPartSize + 1, wantParts: 2, wantSize: copyPartSize},
+		{name: "exact multiple", size: 10 * copyPartSize, wantParts: 10, wantSize: copyPartSize},
+		{name: "at the part limit", size: maxParts * copyPartSize, wantParts: maxParts, wantSize: copyPartSize + 1},
+		{name: "past the part limit", size: maxParts*copyPartSize + 1, wantParts: maxParts, wantSize: copyPartSize + 1},
+		{name: "largest object", size: 5 * 1024 * gb, wantParts: maxParts, wantSize: 5*1024*gb/maxParts + 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranges := copyPartRanges(tt.size)
+			if len(ranges) != tt.wantParts {
+				t.Fatalf("copyPartRanges(%d) = %d parts, want %d", tt.size, len(ranges), tt.wantParts)
+			}
+			if got := ranges[0][1] - ranges[0][0] + 1; got != tt.wantSize {
+				t.Errorf("first part = %d bytes, want %d", got, tt.wantSize)
+			}
+
+			// the parts have to cover the object exactly, in order
+			var next int64
+			for i, r := range ranges {
+				if r[0] != next || r[1] < r[0] {
+					t.Fatalf("part %d = bytes %d-%d, want it to start at %d", i+1, r[0], r[1], next)
+				}
+				next = r[1] + 1
+			}
+			if next != tt.size {
+				t.Errorf("parts end at %d, want %d", next, tt.size)
+			}
+		})
+	}
+
+	if ranges := copyPartRanges(0); len(ranges) != 0 {
+		t.Errorf("copyPartRanges(0) = %v, want no parts", ranges)
+	}
+}
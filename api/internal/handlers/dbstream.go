@@ -4,48 +4,160 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"strings"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/johnnynu/agreatchaos/api/internal/db"
+	"github.com/johnnynu/agreatchaos/api/internal/domain"
 )
 
-func HandleStream(ctx context.Context, e events.DynamoDBEvent) error {
+// StreamDispatcher receives the domain events derived from the table streams.
+// Features subscribe to it from their init functions.
+var StreamDispatcher = domain.NewDispatcher()
+
+func init() {
+	StreamDispatcher.Subscribe(logEvent)
+}
+
+func HandleStream(ctx context.Context, e events.DynamoDBEvent) (events.DynamoDBEventResponse, error) {
+	return DispatchStream(ctx, StreamDispatcher, e), nil
+}
+
+// DispatchStream turns stream records into domain events and dispatches them.
+// Records are processed in order and processing stops at the first failure:
+// the stream is retried from the failed record onwards, so handling the records
+// after it would only deliver them twice.
+func DispatchStream(ctx context.Context, dispatcher *domain.Dispatcher, e events.DynamoDBEvent) events.DynamoDBEventResponse {
+	var res events.DynamoDBEventResponse
+
 	for _, record := range e.Records {
-		if record.EventName == "INSERT" || record.EventName == "MODIFY" {
-			convertedImage, err := convertDDBStreamImage(record.Change.NewImage)
-			if err != nil {
-				log.Printf("Error converting DynamoDB stream image: %v", err)
-				continue
-			}
+		err := dispatchRecord(ctx, dispatcher, record)
+		if err != nil {
+			log.Printf("Error handling stream record %s: %v", record.EventID, err)
+			res.BatchItemFailures = append(res.BatchItemFailures, events.DynamoDBBatchItemFailure{
+				ItemIdentifier: record.Change.SequenceNumber,
+			})
+			break
+		}
+	}
 
-			var file db.File
-			err = attributevalue.UnmarshalMap(convertedImage, &file)
-			if err != nil {
-				log.Printf("Error unmarshalling DynamoDB event: %v", err)
-				continue
-			}
+	return res
+}
 
-			fmt.Printf("File updated: %s\n", file.FileName)
-			// Here you can implement real-time notifications or trigger other processes
-		} else if record.EventName == "REMOVE" {
-			convertedImage, err := convertDDBStreamImage(record.Change.OldImage)
-			if err != nil {
-				log.Printf("Error converting DynamoDB stream image: %v", err)
-				continue
-			}
+func dispatchRecord(ctx context.Context, dispatcher *domain.Dispatcher, record events.DynamoDBEventRecord) error {
+	domainEvents, err := streamRecordEvents(record)
+	if err != nil {
+		return err
+	}
 
-			var file db.File
-			err = attributevalue.UnmarshalMap(convertedImage, &file)
-			if err != nil {
-				log.Printf("Error unmarshalling DynamoDB event: %v", err)
-				continue
-			}
+	for _, event := range domainEvents {
+		err = dispatcher.Dispatch(ctx, event)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// streamRecordEvents derives the domain events for a record of the users or
+// FileMetadata stream. The streams must include both new and old images.
+func streamRecordEvents(record events.DynamoDBEventRecord) ([]domain.Event, error) {
+	meta := domain.Meta{
+		EventID:    record.EventID,
+		OccurredAt: record.Change.ApproximateCreationDateTime.Time,
+	}
+
+	if strings.Contains(record.EventSourceArn, ":table/users/") {
+		if record.EventName != "INSERT" {
+			return nil, nil
+		}
 
-			fmt.Printf("File deleted: %s\n", file.FileName)
-			// Here you can implement cleanup processes or notifications
+		var user db.User
+		err := unmarshalStreamImage(record.Change.NewImage, &user)
+		if err != nil {
+			return nil, err
 		}
+
+		return []domain.Event{domain.UserCreated{Meta: meta, User: user}}, nil
+	}
+
+	switch record.EventName {
+	case "INSERT":
+		var file db.File
+		err := unmarshalStreamImage(record.Change.NewImage, &file)
+		if err != nil {
+			return nil, err
+		}
+
+		domainEvents := []domain.Event{domain.FileCreated{Meta: meta, File: file}}
+		// deduplicated files can be created with their content already in place
+		if file.Status == db.FileStatusUploaded {
+			domainEvents = append(domainEvents, domain.FileUploaded{Meta: meta, File: file})
+		}
+
+		return domainEvents, nil
+	case "MODIFY":
+		var file, oldFile db.File
+		err := unmarshalStreamImage(record.Change.NewImage, &file)
+		if err != nil {
+			return nil, err
+		}
+		err = unmarshalStreamImage(record.Change.OldImage, &oldFile)
+		if err != nil {
+			return nil, err
+		}
+
+		domainEvents := []domain.Event{domain.FileUpdated{Meta: meta, File: file}}
+		if file.Status == db.FileStatusUploaded && oldFile.Status != db.FileStatusUploaded {
+			domainEvents = append(domainEvents, domain.FileUploaded{Meta: meta, File: file})
+		}
+		if file.FileName != oldFile.FileName {
+			domainEvents = append(domainEvents, domain.FileRenamed{Meta: meta, File: file, OldName: oldFile.FileName})
+		}
+
+		return domainEvents, nil
+	case "REMOVE":
+		var file db.File
+		err := unmarshalStreamImage(record.Change.OldImage, &file)
+		if err != nil {
+			return nil, err
+		}
+
+		return []domain.Event{domain.FileDeleted{Meta: meta, File: file}}, nil
+	}
+
+	return nil, fmt.Errorf("unknown stream event %q", record.EventName)
+}
+
+func unmarshalStreamImage(image map[string]events.DynamoDBAttributeValue, out interface{}) error {
+	convertedImage, err := convertDDBStreamImage(image)
+	if err != nil {
+		return fmt.Errorf("error converting DynamoDB stream image: %v", err)
+	}
+
+	err = attributevalue.UnmarshalMap(convertedImage, out)
+	if err != nil {
+		return fmt.Errorf("error unmarshalling DynamoDB stream image: %v", err)
+	}
+
+	return nil
+}
+
+func logEvent(ctx context.Context, event domain.Event) error {
+	switch e := event.(type) {
+	case domain.FileCreated:
+		log.Printf("File created: %s", e.File.FileID)
+	case domain.FileUploaded:
+		log.Printf("File uploaded: %s", e.File.FileID)
+	case domain.FileRenamed:
+		log.Printf("File renamed: %s from %q to %q", e.File.FileID, e.OldName, e.File.FileName)
+	case domain.FileDeleted:
+		log.Printf("File deleted: %s", e.File.FileID)
+	case domain.UserCreated:
+		log.Printf("User created: %s", e.User.UID)
 	}
 
 	return nil
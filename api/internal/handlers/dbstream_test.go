@@ -0,0 +1,222 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/johnnynu/agreatchaos/api/internal/domain"
+)
+
+const (
+	fileStreamArn = "arn:aws:dynamodb:us-east-1:123456789012:table/FileMetadata/stream/2024-01-01T00:00:00.000"
+	userStreamArn = "arn:aws:dynamodb:us-east-1:123456789012:table/users/stream/2024-01-01T00:00:00.000"
+)
+
+func fileImage(fileID, name, status string) map[string]events.DynamoDBAttributeValue {
+	image := map[string]events.DynamoDBAttributeValue{
+		"FileID":   events.NewStringAttribute(fileID),
+		"UserID":   events.NewStringAttribute("user-1"),
+		"FileName": events.NewStringAttribute(name),
+		"FileSize": events.NewNumberAttribute("42"),
+	}
+	if status != "" {
+		image["Status"] = events.NewStringAttribute(status)
+	}
+
+	return image
+}
+
+func streamRecord(eventID, eventName, arn string, oldImage, newImage map[string]events.DynamoDBAttributeValue) events.DynamoDBEventRecord {
+	return events.DynamoDBEventRecord{
+		EventID:        eventID,
+		EventName:      eventName,
+		EventSourceArn: arn,
+		Change: events.DynamoDBStreamRecord{
+			SequenceNumber: "seq-" + eventID,
+			OldImage:       oldImage,
+			NewImage:       newImage,
+		},
+	}
+}
+
+// eventNames describes events by type and file or user ID, which is all the
+// derivation decides
+func eventNames(domainEvents []domain.Event) []string {
+	var names []string
+	for _, event := range domainEvents {
+		switch e := event.(type) {
+		case domain.FileCreated:
+			names = append(names, "created:"+e.File.FileID)
+		case domain.FileUpdated:
+			names = append(names, "updated:"+e.File.FileID)
+		case domain.FileUploaded:
+			names = append(names, "uploaded:"+e.File.FileID)
+		case domain.FileRenamed:
+			names = append(names, "renamed:"+e.File.FileID+":"+e.OldName)
+		case domain.FileDeleted:
+			names = append(names, "deleted:"+e.File.FileID)
+		case domain.UserCreated:
+			names = append(names, "user:"+e.User.UID)
+		}
+	}
+
+	return names
+}
+
+func TestStreamRecordEvents(t *testing.T) {
+	tests := []struct {
+		name    string
+		record  events.DynamoDBEventRecord
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:   "insert pending file",
+			record: streamRecord("1", "INSERT", fileStreamArn, nil, fileImage("f1", "a.txt", "pending")),
+			want:   []string{"created:f1"},
+		},
+		{
+			name:   "insert deduplicated file",
+			record: streamRecord("2", "INSERT", fileStreamArn, nil, fileImage("f1", "a.txt", "uploaded")),
+			want:   []string{"created:f1", "uploaded:f1"},
+		},
+		{
+			name:   "modify to uploaded",
+			record: streamRecord("3", "MODIFY", fileStreamArn, fileImage("f1", "a.txt", "pending"), fileImage("f1", "a.txt", "uploaded")),
+			want:   []string{"updated:f1", "uploaded:f1"},
+		},
+		{
+			name:   "modify already uploaded",
+			record: streamRecord("4", "MODIFY", fileStreamArn, fileImage("f1", "a.txt", "uploaded"), fileImage("f1", "a.txt", "uploaded")),
+			want:   []string{"updated:f1"},
+		},
+		{
+			name:   "rename",
+			record: streamRecord("5", "MODIFY", fileStreamArn, fileImage("f1", "a.txt", "uploaded"), fileImage("f1", "b.txt", "uploaded")),
+			want:   []string{"updated:f1", "renamed:f1:a.txt"},
+		},
+		{
+			name:   "remove",
+			record: streamRecord("6", "REMOVE", fileStreamArn, fileImage("f1", "a.txt", "uploaded"), nil),
+			want:   []string{"deleted:f1"},
+		},
+		{
+			name: "user insert",
+			record: streamRecord("7", "INSERT", userStreamArn, nil, map[string]events.DynamoDBAttributeValue{
+				"uid":   events.NewStringAttribute("user-1"),
+				"email": events.NewStringAttribute("a@example.com"),
+			}),
+			want: []string{"user:user-1"},
+		},
+		{
+			name:   "user modify is ignored",
+			record: streamRecord("8", "MODIFY", userStreamArn, nil, nil),
+		},
+		{
+			name: "bad image",
+			record: streamRecord("9", "INSERT", fileStreamArn, nil, map[string]events.DynamoDBAttributeValue{
+				"FileID":   events.NewStringAttribute("f1"),
+				"FileSize": events.NewStringAttribute("not a number"),
+			}),
+			wantErr: true,
+		},
+		{
+			name:    "unknown event",
+			record:  streamRecord("10", "TRUNCATE", fileStreamArn, nil, nil),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := streamRecordEvents(tt.record)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("streamRecordEvents() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if names := eventNames(got); !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("streamRecordEvents() = %v, want %v", names, tt.want)
+			}
+			for _, event := range got {
+				if event.Metadata().EventID != tt.record.EventID {
+					t.Errorf("event ID = %q, want %q", event.Metadata().EventID, tt.record.EventID)
+				}
+			}
+		})
+	}
+}
+
+func TestDispatchStream(t *testing.T) {
+	failing := errors.New("subscriber failed")
+
+	tests := []struct {
+		name         string
+		records      []events.DynamoDBEventRecord
+		failOn       string
+		wantSeen     []string
+		wantFailures []string
+	}{
+		{
+			name: "all records handled",
+			records: []events.DynamoDBEventRecord{
+				streamRecord("1", "INSERT", fileStreamArn, nil, fileImage("f1", "a.txt", "pending")),
+				streamRecord("2", "REMOVE", fileStreamArn, fileImage("f2", "b.txt", "uploaded"), nil),
+			},
+			wantSeen: []string{"created:f1", "deleted:f2"},
+		},
+		{
+			name: "subscriber failure stops at the record",
+			records: []events.DynamoDBEventRecord{
+				streamRecord("1", "INSERT", fileStreamArn, nil, fileImage("f1", "a.txt", "pending")),
+				streamRecord("2", "INSERT", fileStreamArn, nil, fileImage("f2", "b.txt", "pending")),
+				streamRecord("3", "INSERT", fileStreamArn, nil, fileImage("f3", "c.txt", "pending")),
+			},
+			failOn:       "created:f2",
+			wantSeen:     []string{"created:f1", "created:f2"},
+			wantFailures: []string{"seq-2"},
+		},
+		{
+			name: "bad image stops at the record",
+			records: []events.DynamoDBEventRecord{
+				streamRecord("1", "INSERT", fileStreamArn, nil, fileImage("f1", "a.txt", "pending")),
+				streamRecord("2", "INSERT", fileStreamArn, nil, map[string]events.DynamoDBAttributeValue{
+					"FileSize": events.NewStringAttribute("not a number"),
+				}),
+				streamRecord("3", "INSERT", fileStreamArn, nil, fileImage("f3", "c.txt", "pending")),
+			},
+			wantSeen:     []string{"created:f1"},
+			wantFailures: []string{"seq-2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen []string
+			dispatcher := domain.NewDispatcher()
+			dispatcher.Subscribe(func(ctx context.Context, event domain.Event) error {
+				name := eventNames([]domain.Event{event})[0]
+				seen = append(seen, name)
+				if name == tt.failOn {
+					return failing
+				}
+				return nil
+			})
+
+			res := DispatchStream(context.Background(), dispatcher, events.DynamoDBEvent{Records: tt.records})
+
+			if !reflect.DeepEqual(seen, tt.wantSeen) {
+				t.Errorf("dispatched %v, want %v", seen, tt.wantSeen)
+			}
+
+			var failures []string
+			for _, failure := range res.BatchItemFailures {
+				failures = append(failures, failure.ItemIdentifier)
+			}
+			if !reflect.DeepEqual(failures, tt.wantFailures) {
+				t.Errorf("BatchItemFailures = %v, want %v", failures, tt.wantFailures)
+			}
+		})
+	}
+}
@@ -45,16 +45,22 @@ func DeleteFile(ctx context.Context, request events.APIGatewayProxyRequest) (eve
         return utils.ResponseError(fmt.Errorf("unable to extract user ID from JWT claims"))
     }
 
-	err := db.DeleteFile(ctx, fileID, userID)
+	file, op, err := db.DeleteFile(ctx, fileID, userID)
 	if err != nil {
 		log.Printf("Error deleting file: %v", err)
 		return utils.ResponseError(err)
 	}
 
-	err = deleteFileFromS3(ctx, fileID)
+	err = recordAudit(ctx, request, db.AuditDelete, userID, file)
 	if err != nil {
-		log.Printf("Error deleting file from S3: %v", err)
-		return utils.ResponseError(err)
+		log.Printf("Error recording audit entry: %v", err)
+	}
+
+	// The file is already gone from the user's list at this point. If its storage
+	// can't be removed right away, the pending delete worker retries it.
+	err = runPendingDelete(ctx, *op)
+	if err != nil {
+		log.Printf("Error deleting storage for file %s, leaving it to the worker: %v", file.FileID, err)
 	}
 
 	log.Printf("File %s deleted successfully", fileID)
@@ -65,7 +71,7 @@ func DeleteFile(ctx context.Context, request events.APIGatewayProxyRequest) (eve
 	}, nil
 }
 
-func deleteFileFromS3(ctx context.Context, fileID string) error {
+func deleteFileFromS3(ctx context.Context, key string) error {
 	cfg, err := config.LoadDefaultConfig(ctx)
 	if err != nil {
 		return fmt.Errorf("unable to load SDK config, %v", err)
@@ -73,9 +79,15 @@ func deleteFileFromS3(ctx context.Context, fileID string) error {
 
 	s3Client := s3.NewFromConfig(cfg)
 
+	// thumbnails and other derived objects go first, retries still find them
+	err = deleteDerivedObjects(ctx, s3Client, "chaosfiles-filestorage", key)
+	if err != nil {
+		return err
+	}
+
 	_, err = s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
 		Bucket: aws.String("chaosfiles-filestorage"),
-		Key: aws.String(fileID),
+		Key: aws.String(key),
 	})
 
 	if err != nil {
@@ -83,4 +95,19 @@ func deleteFileFromS3(ctx context.Context, fileID string) error {
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+// discardFile deletes a file the backend created but couldn't write the
+// content of
+func discardFile(ctx context.Context, file db.File) {
+	_, op, err := db.DeleteFile(ctx, file.FileID, file.UserID)
+	if err != nil {
+		log.Printf("Error deleting unwritten file %s: %v", file.FileID, err)
+		return
+	}
+
+	err = runPendingDelete(ctx, *op)
+	if err != nil {
+		log.Printf("Error deleting storage of file %s, leaving it to the worker: %v", file.FileID, err)
+	}
+}
@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnnynu/agreatchaos/api/internal/domain"
+)
+
+// sseKeepAlive is how often an idle event stream gets a comment, so proxies
+// don't close it
+const sseKeepAlive = 30 * time.Second
+
+// EventHub pushes the notifications WebSocket clients get to Server-Sent Events
+// clients instead. It serves the local server mode, where there is no WebSocket
+// API and no connections table: clients are kept in memory.
+type EventHub struct {
+	mu      sync.Mutex
+	clients map[*sseClient]bool
+}
+
+type sseClient struct {
+	userID string
+	// events is the subscribed event types, all of them if empty
+	events   map[string]bool
+	messages chan notification
+}
+
+func NewEventHub() *EventHub {
+	return &EventHub{clients: make(map[*sseClient]bool)}
+}
+
+// Notify is a domain.Subscriber sending file events to the streams of everyone
+// who can see the file. Like notifyConnections it is best effort: a client that
+// falls behind loses messages rather than holding up the others.
+func (h *EventHub) Notify(ctx context.Context, event domain.Event) error {
+	msg, ok := fileNotification(event)
+	if !ok {
+		return nil
+	}
+
+	recipients := make(map[string]bool)
+	for _, userID := range notificationRecipients(msg.File) {
+		recipients[userID] = true
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for client := range h.clients {
+		if !recipients[client.userID] || (len(client.events) > 0 && !client.events[msg.Type]) {
+			continue
+		}
+
+		select {
+		case client.messages <- msg:
+		default:
+			log.Printf("Dropping %s notification for a slow client of %s", msg.Type, client.userID)
+		}
+	}
+
+	return nil
+}
+
+// ServeEvents streams userID's notifications as Server-Sent Events until the
+// request is canceled. The optional events query parameter is a comma
+// separated list of event types, like the WebSocket subscribe message.
+func (h *EventHub) ServeEvents(w http.ResponseWriter, r *http.Request, userID string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	client := &sseClient{userID: userID, events: make(map[string]bool), messages: make(chan notification, 64)}
+	if types := r.URL.Query().Get("events"); types != "" {
+		for _, eventType := range strings.Split(types, ",") {
+			if !notificationTypes[eventType] {
+				http.Error(w, fmt.Sprintf("unknown event type %q", eventType), http.StatusBadRequest)
+				return
+			}
+			client.events[eventType] = true
+		}
+	}
+
+	h.mu.Lock()
+	h.clients[client] = true
+	h.mu.Unlock()
+
+	defer func() {
+		h.mu.Lock()
+		delete(h.clients, client)
+		h.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case msg := <-client.messages:
+			payload, err := json.Marshal(msg)
+			if err != nil {
+				log.Printf("Error marshaling notification: %v", err)
+				continue
+			}
+			fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", msg.EventID, msg.Type, payload)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnnynu/agreatchaos/api/internal/db"
+	"github.com/johnnynu/agreatchaos/api/internal/domain"
+)
+
+func TestEventHub(t *testing.T) {
+	hub := NewEventHub()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hub.ServeEvents(w, r, r.URL.Query().Get("user"))
+	}))
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "?user=user-1&events=file.deleted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	// the client is registered once the headers are flushed
+	meta := domain.Meta{EventID: "evt-1", OccurredAt: time.Now()}
+	hub.Notify(context.Background(), domain.FileCreated{Meta: meta, File: db.File{FileID: "f1", UserID: "user-1"}})
+	hub.Notify(context.Background(), domain.FileDeleted{Meta: meta, File: db.File{FileID: "f2", UserID: "user-2"}})
+	hub.Notify(context.Background(), domain.FileDeleted{Meta: domain.Meta{EventID: "evt-3"}, File: db.File{FileID: "f3", UserID: "user-1"}})
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	var got []string
+	for len(got) < 3 {
+		select {
+		case line := <-lines:
+			got = append(got, line)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out, got %q", got)
+		}
+	}
+
+	if got[0] != "id: evt-3" || got[1] != "event: file.deleted" || !strings.Contains(got[2], `"FileID":"f3"`) {
+		t.Errorf("got %q, want only the subscribed event of user-1", got)
+	}
+}
+
+func TestEventHubRejectsUnknownTypes(t *testing.T) {
+	rec := httptest.NewRecorder()
+	NewEventHub().ServeEvents(rec, httptest.NewRequest(http.MethodGet, "/events?events=file.exploded", nil), "user-1")
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", rec.Code)
+	}
+}
@@ -0,0 +1,553 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/uuid"
+	"github.com/johnnynu/agreatchaos/api/internal/db"
+	"github.com/johnnynu/agreatchaos/api/pkg/utils"
+)
+
+const (
+	jobExtract = "extract"
+
+	maxExtractEntries = 10000
+	maxExtractBytes   = maxJobBytes
+	// maxExtractRatio is the most an archive may expand, once it expanded past
+	// extractRatioFloor. Real archives rarely get past 20:1, bombs go far beyond.
+	maxExtractRatio   = 100
+	extractRatioFloor = 64 * 1024 * 1024
+	// maxExtractItems caps the per-entry errors kept on the job
+	maxExtractItems = 100
+
+	extractBlockSize = 8 * 1024 * 1024
+	extractPartSize  = 16 * 1024 * 1024
+)
+
+var (
+	errExtractTooLarge = errors.New("archive expands past the extraction limit")
+	errExtractRatio    = errors.New("archive expands more than any real archive does")
+)
+
+type ExtractRequest struct {
+	// FolderID is the folder the archive's folder is created in, empty for the root
+	FolderID string `json:"folderId"`
+}
+
+func init() {
+	jobRunners[jobExtract] = runExtract
+}
+
+// ExtractArchive starts a job that unpacks an uploaded zip or tar archive into
+// a new folder named after it. Every entry becomes a file of its own.
+func ExtractArchive(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := jwtSubject(request)
+	if userID == "" {
+		log.Println("Unable to extract user ID from JWT claims")
+		return utils.ResponseError(fmt.Errorf("unable to extract user ID from JWT claims"))
+	}
+
+	fileID := request.PathParameters["fileId"]
+	if fileID == "" {
+		return utils.ResponseError(errors.New("fileID is required"))
+	}
+
+	var req ExtractRequest
+	if request.Body != "" {
+		err := json.Unmarshal([]byte(request.Body), &req)
+		if err != nil {
+			return events.APIGatewayProxyResponse{StatusCode: 400, Body: "invalid request body"}, nil
+		}
+	}
+
+	file, err := db.GetFile(ctx, fileID)
+	if err != nil {
+		log.Printf("Error getting file: %v", err)
+		return utils.ResponseError(err)
+	}
+	if file == nil || file.UserID != userID {
+		return utils.ResponseError(utils.ErrNotFound)
+	}
+	if !downloadable(file) {
+		return events.APIGatewayProxyResponse{StatusCode: 400, Body: fmt.Sprintf("file is %s", unavailableReason(file))}, nil
+	}
+	if !extractable(file) {
+		return events.APIGatewayProxyResponse{StatusCode: 400, Body: "only zip, tar and tar.gz archives can be extracted"}, nil
+	}
+	if file.FileSize > maxExtractBytes {
+		return events.APIGatewayProxyResponse{StatusCode: 400, Body: fmt.Sprintf("archives larger than %d bytes can't be extracted", int64(maxExtractBytes))}, nil
+	}
+
+	if req.FolderID != "" {
+		owned, err := ownsFolder(ctx, userID, req.FolderID)
+		if err != nil {
+			log.Printf("Error getting folder: %v", err)
+			return utils.ResponseError(err)
+		}
+		if !owned {
+			return events.APIGatewayProxyResponse{StatusCode: 404, Body: "folder not found"}, nil
+		}
+	}
+
+	remaining, limited, err := quotaRemaining(ctx, userID)
+	if err != nil {
+		log.Printf("Error checking quota: %v", err)
+		return utils.ResponseError(err)
+	}
+	if limited && remaining == 0 {
+		return events.APIGatewayProxyResponse{StatusCode: 403, Body: errQuotaExceeded.Error()}, nil
+	}
+
+	now := time.Now()
+	job := db.Job{
+		JobID:     uuid.New().String(),
+		UserID:    userID,
+		Kind:      jobExtract,
+		Status:    db.JobQueued,
+		FileIDs:   []string{fileID},
+		FolderID:  req.FolderID,
+		CreatedAt: now.UTC().Format(time.RFC3339),
+		UpdatedAt: now.UTC().Format(time.RFC3339),
+		ExpiresAt: now.Add(db.JobRetention).Unix(),
+	}
+
+	err = recordAuditDetails(ctx, request, db.AuditExtract, userID, file, "job "+job.JobID)
+	if err != nil {
+		log.Printf("Error recording audit entry: %v", err)
+		return utils.ResponseError(err)
+	}
+
+	err = db.CreateJob(ctx, job)
+	if err != nil {
+		log.Printf("Error creating job: %v", err)
+		return utils.ResponseError(err)
+	}
+
+	res, err := utils.ResponseOK(job)
+	res.StatusCode = 202
+	return res, err
+}
+
+func extractable(file *db.File) bool {
+	switch previewKind(file) {
+	case previewZip, previewTar, previewTgz:
+		return true
+	}
+
+	return false
+}
+
+// runExtract unpacks the job's archive. Limits are enforced on the bytes
+// actually extracted, not on the sizes the archive declares. Entries that can't
+// be extracted are reported on the job, while hitting a limit fails the whole
+// job and keeps the files extracted so far.
+func runExtract(ctx context.Context, s3Client *s3.Client, job *db.Job) error {
+	bucket := "chaosfiles-filestorage"
+
+	file, err := db.GetFile(ctx, job.FileIDs[0])
+	if err != nil {
+		return err
+	}
+	if file == nil || file.UserID != job.UserID || !downloadable(file) {
+		return fmt.Errorf("archive is no longer available")
+	}
+
+	limit := int64(maxExtractBytes)
+	remaining, limited, err := quotaRemaining(ctx, job.UserID)
+	if err != nil {
+		return err
+	}
+	if limited {
+		limit = min(limit, remaining)
+	}
+
+	root := db.Folder{
+		FolderID:  uuid.New().String(),
+		UserID:    job.UserID,
+		Name:      archiveFolderName(file.FileName),
+		ParentID:  job.FolderID,
+		CreatedAt: time.Now().Format(time.RFC3339),
+	}
+	err = db.CreateFolder(ctx, root)
+	if err != nil {
+		return err
+	}
+
+	x := &extractor{
+		ctx:      ctx,
+		s3Client: s3Client,
+		bucket:   bucket,
+		job:      job,
+		progress: &jobProgress{job: job},
+		folders:  map[string]string{"": root.FolderID},
+		limit:    limit,
+		limited:  limited,
+	}
+
+	switch previewKind(file) {
+	case previewZip:
+		err = x.extractZip(file)
+	case previewTar:
+		err = x.extractTar(file, false)
+	case previewTgz:
+		err = x.extractTar(file, true)
+	default:
+		err = fmt.Errorf("%s is not an archive", file.FileName)
+	}
+
+	x.progress.update(ctx, true)
+	return err
+}
+
+// extractor writes the entries of one archive as files
+type extractor struct {
+	ctx      context.Context
+	s3Client *s3.Client
+	bucket   string
+	job      *db.Job
+	progress *jobProgress
+	// folders maps directory paths within the archive to their folder IDs
+	folders map[string]string
+	entries int
+	// written is what the archive expanded to so far. limit is the most it may
+	// expand to, limited is set when that comes from the owner's quota.
+	written int64
+	limit   int64
+	limited bool
+	// compressed counts the archive bytes read, for archives that don't
+	// declare their sizes up front
+	compressed *countingReader
+}
+
+func (x *extractor) extractZip(file *db.File) error {
+	src := newObjectReader(x.ctx, x.s3Client, x.bucket, file.ObjectKey(), file.FileSize, extractBlockSize,
+		2*file.FileSize+4*extractBlockSize)
+	src.maxBlocks = 4
+
+	archive, err := zip.NewReader(src, file.FileSize)
+	if err != nil {
+		return fmt.Errorf("invalid zip archive: %v", err)
+	}
+
+	if len(archive.File) > maxExtractEntries {
+		return fmt.Errorf("archive has more than %d entries", maxExtractEntries)
+	}
+
+	// zip declares its sizes up front, so bombs are turned down before anything
+	// is written. archive/zip fails entries whose content doesn't match them.
+	var total uint64
+	for _, f := range archive.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if f.UncompressedSize64 > extractRatioFloor && f.UncompressedSize64 > maxExtractRatio*f.CompressedSize64 {
+			return errExtractRatio
+		}
+
+		total += f.UncompressedSize64
+		x.job.FilesTotal++
+	}
+	if total > uint64(x.limit) {
+		return x.limitError()
+	}
+	x.job.BytesTotal = int64(total)
+	x.progress.update(x.ctx, true)
+
+	for _, f := range archive.File {
+		err := x.entry(f.Name, f.Mode(), int64(f.UncompressedSize64), func() (io.ReadCloser, error) {
+			return f.Open()
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// extractTar streams a tar archive, which doesn't declare its sizes up front,
+// so the ratio limit is checked against the compressed bytes read so far
+func (x *extractor) extractTar(file *db.File, compressed bool) error {
+	obj, err := x.s3Client.GetObject(x.ctx, &s3.GetObjectInput{
+		Bucket: aws.String(x.bucket),
+		Key:    aws.String(file.ObjectKey()),
+	})
+	if err != nil {
+		return fmt.Errorf("error reading archive: %v", err)
+	}
+	defer obj.Body.Close()
+
+	raw := &countingReader{r: obj.Body}
+	var src io.Reader = raw
+	if compressed {
+		x.compressed = raw
+		gz, err := gzip.NewReader(raw)
+		if err != nil {
+			return fmt.Errorf("invalid gzip archive: %v", err)
+		}
+		defer gz.Close()
+		src = gz
+	}
+
+	tr := tar.NewReader(src)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("invalid tar archive: %v", err)
+		}
+
+		if header.Typeflag != tar.TypeDir {
+			x.job.FilesTotal++
+		}
+
+		err = x.entry(header.Name, header.FileInfo().Mode(), header.Size, func() (io.ReadCloser, error) {
+			return io.NopCloser(tr), nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// entry extracts one archive entry. It only returns errors that end the
+// extraction, problems with the entry itself are recorded on the job.
+func (x *extractor) entry(name string, mode fs.FileMode, size int64, open func() (io.ReadCloser, error)) error {
+	x.entries++
+	if x.entries > maxExtractEntries {
+		return fmt.Errorf("archive has more than %d entries", maxExtractEntries)
+	}
+
+	entryPath, err := safeEntryPath(name)
+	if err != nil {
+		x.skip(name, err)
+		return nil
+	}
+
+	if mode.IsDir() {
+		_, err := x.folder(entryPath)
+		return err
+	}
+
+	x.job.FilesDone++
+	if !mode.IsRegular() {
+		x.skip(name, errors.New("not a regular file"))
+		return nil
+	}
+
+	if x.written+size > x.limit {
+		return x.limitError()
+	}
+
+	dir, base := path.Split(entryPath)
+	folderID, err := x.folder(strings.TrimSuffix(dir, "/"))
+	if err != nil {
+		return err
+	}
+
+	r, err := open()
+	if err != nil {
+		x.skip(name, err)
+		return nil
+	}
+	defer r.Close()
+
+	guarded := &expansionGuard{r: r, x: x}
+	fileID, err := x.writeFile(base, folderID, size, &progressReader{ctx: x.ctx, r: guarded, job: x.job, progress: x.progress})
+	if guarded.err != nil {
+		return guarded.err
+	}
+	if err != nil {
+		x.skip(name, err)
+		return nil
+	}
+
+	log.Printf("Extracted %s from job %s as file %s", entryPath, x.job.JobID, fileID)
+	return nil
+}
+
+// writeFile creates the file for an entry and uploads its content. ProcessUpload
+// picks the object up like any other upload, so extracted files are sniffed and
+// scanned too.
+func (x *extractor) writeFile(name, folderID string, size int64, r io.Reader) (string, error) {
+	fileType := mime.TypeByExtension(path.Ext(name))
+	if fileType == "" {
+		fileType = "application/octet-stream"
+	}
+
+	now := time.Now().Format(time.RFC3339)
+	file := db.File{
+		FileID:    uuid.New().String(),
+		UserID:    x.job.UserID,
+		FileName:  name,
+		FileSize:  size,
+		FileType:  fileType,
+		FolderID:  folderID,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Status:    db.FileStatusPending,
+	}
+
+	// the row has to exist before the object, or the object would be quarantined
+	err := db.CreateFile(x.ctx, file)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = uploadStream(x.ctx, x.s3Client, x.bucket, file.ObjectKey(), fileType, r, extractPartSize, nil)
+	if err != nil {
+		discardFile(x.ctx, file)
+		return "", err
+	}
+
+	return file.FileID, nil
+}
+
+// folder returns the folder of a directory within the archive, creating it
+// and any missing parents
+func (x *extractor) folder(dir string) (string, error) {
+	if folderID, ok := x.folders[dir]; ok {
+		return folderID, nil
+	}
+
+	parent, name := path.Split(dir)
+	parentID, err := x.folder(strings.TrimSuffix(parent, "/"))
+	if err != nil {
+		return "", err
+	}
+
+	folder := db.Folder{
+		FolderID:  uuid.New().String(),
+		UserID:    x.job.UserID,
+		Name:      name,
+		ParentID:  parentID,
+		CreatedAt: time.Now().Format(time.RFC3339),
+	}
+	err = db.CreateFolder(x.ctx, folder)
+	if err != nil {
+		return "", err
+	}
+
+	x.folders[dir] = folder.FolderID
+	return folder.FolderID, nil
+}
+
+// skip records an entry that couldn't be extracted
+func (x *extractor) skip(name string, err error) {
+	log.Printf("Skipping entry %q of job %s: %v", name, x.job.JobID, err)
+	if len(x.job.Items) < maxExtractItems {
+		x.job.Items = append(x.job.Items, db.JobItem{Name: name, Error: err.Error()})
+	}
+}
+
+func (x *extractor) limitError() error {
+	if x.limited {
+		return errQuotaExceeded
+	}
+	return errExtractTooLarge
+}
+
+// safeEntryPath validates an entry name and returns it as a clean relative
+// path. Names that would land outside the extraction folder are refused
+// rather than rewritten, since a rewritten name would silently collide.
+func safeEntryPath(name string) (string, error) {
+	if strings.ContainsRune(name, 0) {
+		return "", errors.New("invalid entry name")
+	}
+
+	name = strings.ReplaceAll(name, "\\", "/")
+	if strings.HasPrefix(name, "/") || (len(name) > 1 && name[1] == ':') {
+		return "", errors.New("absolute entry paths are not extracted")
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", errors.New("entry path escapes the archive")
+		}
+	}
+
+	name = strings.Trim(path.Clean(name), "/")
+	if name == "" || name == "." {
+		return "", errors.New("empty entry name")
+	}
+
+	return name, nil
+}
+
+// archiveFolderName names the folder an archive is extracted to after it
+func archiveFolderName(fileName string) string {
+	name := fileName
+	lower := strings.ToLower(name)
+	for _, ext := range []string{".tar.gz", ".tgz", ".tar", ".zip"} {
+		if strings.HasSuffix(lower, ext) {
+			name = name[:len(name)-len(ext)]
+			break
+		}
+	}
+
+	name = strings.NewReplacer("/", "_", "\\", "_").Replace(name)
+	if !validFolderName(name) {
+		return "archive"
+	}
+
+	return name
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// expansionGuard fails the read of an entry once the archive expanded past the
+// extractor's limit, or more than maxExtractRatio over the compressed bytes
+// read. err keeps the failure, which ends the whole extraction.
+type expansionGuard struct {
+	r   io.Reader
+	x   *extractor
+	err error
+}
+
+func (g *expansionGuard) Read(p []byte) (int, error) {
+	if g.err != nil {
+		return 0, g.err
+	}
+
+	n, err := g.r.Read(p)
+	g.x.written += int64(n)
+
+	if g.x.written > g.x.limit {
+		g.err = g.x.limitError()
+	} else if c := g.x.compressed; c != nil && g.x.written > extractRatioFloor && g.x.written > maxExtractRatio*c.n {
+		g.err = errExtractRatio
+	}
+	if g.err != nil {
+		return n, g.err
+	}
+
+	return n, err
+}
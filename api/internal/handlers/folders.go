@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/uuid"
+	"github.com/johnnynu/agreatchaos/api/internal/db"
+	"github.com/johnnynu/agreatchaos/api/pkg/utils"
+)
+
+const maxFolderNameLength = 255
+
+type CreateFolderRequest struct {
+	Name     string `json:"name"`
+	ParentID string `json:"parentId"`
+}
+
+// CreateFolder creates a folder at the root or in one of the caller's folders
+func CreateFolder(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := jwtSubject(request)
+	if userID == "" {
+		log.Println("Unable to extract user ID from JWT claims")
+		return utils.ResponseError(fmt.Errorf("unable to extract user ID from JWT claims"))
+	}
+
+	var req CreateFolderRequest
+	err := json.Unmarshal([]byte(request.Body), &req)
+	if err != nil {
+		return events.APIGatewayProxyResponse{StatusCode: 400, Body: "invalid request body"}, nil
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if !validFolderName(req.Name) {
+		return events.APIGatewayProxyResponse{StatusCode: 400, Body: "invalid folder name"}, nil
+	}
+
+	if req.ParentID != "" {
+		owned, err := ownsFolder(ctx, userID, req.ParentID)
+		if err != nil {
+			log.Printf("Error getting folder: %v", err)
+			return utils.ResponseError(err)
+		}
+		if !owned {
+			return utils.ResponseError(utils.ErrNotFound)
+		}
+	}
+
+	folder := db.Folder{
+		FolderID:  uuid.New().String(),
+		UserID:    userID,
+		Name:      req.Name,
+		ParentID:  req.ParentID,
+		CreatedAt: time.Now().Format(time.RFC3339),
+	}
+
+	err = db.CreateFolder(ctx, folder)
+	if err != nil {
+		log.Printf("Error creating folder: %v", err)
+		return utils.ResponseError(err)
+	}
+
+	return utils.ResponseOK(folder)
+}
+
+// ListFolders returns all of the caller's folders, clients build the tree from
+// their parent IDs
+func ListFolders(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := jwtSubject(request)
+	if userID == "" {
+		log.Println("Unable to extract user ID from JWT claims")
+		return utils.ResponseError(errors.New("unable to extract user ID from JWT claims"))
+	}
+
+	folders, err := db.ListUserFolders(ctx, userID)
+	if err != nil {
+		log.Printf("Error listing folders: %v", err)
+		return utils.ResponseError(err)
+	}
+
+	return utils.ResponseOK(folders)
+}
+
+// ownsFolder reports whether folderID is one of the user's folders
+func ownsFolder(ctx context.Context, userID, folderID string) (bool, error) {
+	folder, err := db.GetFolder(ctx, folderID)
+	if err != nil {
+		return false, err
+	}
+
+	return folder != nil && folder.UserID == userID, nil
+}
+
+func validFolderName(name string) bool {
+	return name != "" && name != "." && name != ".." && len(name) <= maxFolderNameLength &&
+		!strings.ContainsAny(name, "/\\\x00")
+}
@@ -3,12 +3,14 @@ package handlers
 import (
 	"context"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/johnnynu/agreatchaos/api/internal/db"
 	"github.com/johnnynu/agreatchaos/api/pkg/utils"
 )
@@ -26,6 +28,15 @@ func GenerateDownloadURL(ctx context.Context, request events.APIGatewayProxyRequ
 	if file == nil {
 		return utils.ResponseError(errors.New("file not found"))
 	}
+	if !downloadable(file) {
+		return events.APIGatewayProxyResponse{StatusCode: 403, Body: fmt.Sprintf("file is %s", unavailableReason(file))}, nil
+	}
+
+	// downloads must be traceable, so no URL is issued without an audit entry
+	err = recordAudit(ctx, request, db.AuditDownloadURL, "", file)
+	if err != nil {
+		return utils.ResponseError(err)
+	}
 
 	cfg, err := config.LoadDefaultConfig(ctx)
 	if err != nil {
@@ -36,11 +47,19 @@ func GenerateDownloadURL(ctx context.Context, request events.APIGatewayProxyRequ
 
 	// Generate pre signed url
 	presignClient := s3.NewPresignClient(s3Client)
-	presignedUrl, err := presignClient.PresignGetObject(ctx, &s3.GetObjectInput{
+	getInput := &s3.GetObjectInput{
 		Bucket: aws.String("chaosfiles-filestorage"),
-		Key: aws.String(fileID),
+		Key: aws.String(file.ObjectKey()),
 		ResponseContentType: aws.String(file.FileType),
-	}, s3.WithPresignExpires(time.Minute * 15))
+		// have S3 return the stored checksum so the downloader can verify the body
+		ChecksumMode: types.ChecksumModeEnabled,
+	}
+	// content that could run script in our origin is never rendered inline
+	if isRiskyContentType(file.FileType) || isRiskyContentType(file.DetectedType) {
+		getInput.ResponseContentDisposition = aws.String(fmt.Sprintf("attachment; filename=%q", file.FileName))
+	}
+
+	presignedUrl, err := presignClient.PresignGetObject(ctx, getInput, s3.WithPresignExpires(time.Minute * 15))
 
 	if err != nil {
 		return utils.ResponseError(err)
@@ -51,5 +70,6 @@ func GenerateDownloadURL(ctx context.Context, request events.APIGatewayProxyRequ
 		"downloadUrl": presignedUrl.URL,
 		"fileName": file.FileName,
 		"contentType": file.FileType,
+		"checksumSHA256": file.ChecksumSHA256,
 	})
 }
\ No newline at end of file
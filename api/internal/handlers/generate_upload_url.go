@@ -2,17 +2,23 @@ package handlers
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"math"
+	"net/http"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/google/uuid"
 	"github.com/johnnynu/agreatchaos/api/internal/db"
 	"github.com/johnnynu/agreatchaos/api/pkg/utils"
@@ -22,6 +28,10 @@ const (
 	maxFileSize = 1 * 1024 * 1024 * 1024 * 1024 // 1TB
 	maxParts    = 10000
 	multipartThreshold = 100 * 1024 * 1024 // 100MB
+	maxSinglePartSize = 5 * 1024 * 1024 * 1024 // 5GB, the largest object S3 accepts in a single PUT
+
+	// blobFileIDMetadata is the object metadata naming the file a blob upload was started for
+	blobFileIDMetadata = "file-id"
 )
 
 type UploadURLRequest struct {
@@ -29,8 +39,22 @@ type UploadURLRequest struct {
     FileType  string `json:"fileType"`
     FileSize  int64  `json:"fileSize"`
     ChunkSize int64  `json:"chunkSize"`
+    // ChecksumSHA256 is the base64 SHA-256 of the whole object, used for single part uploads
+    ChecksumSHA256 string `json:"checksumSHA256"`
+    // PartChecksums holds the base64 SHA-256 of each part, in order, for multipart uploads
+    PartChecksums []string `json:"partChecksums"`
+    // Dedup stores the content in a blob shared by every file of the user with the same checksum
+    Dedup bool `json:"dedup"`
+    // UploadMethod selects "put" (the default) or "post" for single part uploads.
+    // A POST policy makes S3 enforce the declared size and content type.
+    UploadMethod string `json:"uploadMethod"`
 }
 
+const (
+	uploadMethodPut  = "put"
+	uploadMethodPost = "post"
+)
+
 func GenerateUploadURL(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	log.Println("GenerateUploadURL function started")
 
@@ -75,6 +99,67 @@ func GenerateUploadURL(ctx context.Context, request events.APIGatewayProxyReques
         return utils.ResponseError(fmt.Errorf("unable to extract user ID from JWT claims"))
     }
 
+	if req.ChecksumSHA256 != "" && !isSHA256Checksum(req.ChecksumSHA256) {
+		log.Printf("Invalid checksumSHA256: %s", req.ChecksumSHA256)
+		return utils.ResponseError(errors.New("checksumSHA256 must be a base64 encoded SHA-256 digest"))
+	}
+
+	for i, checksum := range req.PartChecksums {
+		if !isSHA256Checksum(checksum) {
+			log.Printf("Invalid checksum for part %d: %s", i+1, checksum)
+			return utils.ResponseError(fmt.Errorf("partChecksums[%d] must be a base64 encoded SHA-256 digest", i))
+		}
+	}
+
+	switch req.UploadMethod {
+	case "", uploadMethodPut:
+	case uploadMethodPost:
+		if req.Dedup {
+			log.Println("dedup uploads require the put upload method")
+			return utils.ResponseError(errors.New("dedup uploads require the put upload method"))
+		}
+
+		if req.FileSize > maxSinglePartSize {
+			log.Printf("File size %d exceeds the POST upload limit %d", req.FileSize, maxSinglePartSize)
+			return utils.ResponseError(errors.New("post uploads are limited to 5GB"))
+		}
+	default:
+		log.Printf("Unknown upload method: %s", req.UploadMethod)
+		return utils.ResponseError(fmt.Errorf("uploadMethod must be %q or %q", uploadMethodPut, uploadMethodPost))
+	}
+
+	// Dedup uploads always go through a single PUT, so that S3 verifies the
+	// whole-object checksum the blob is addressed by
+	var blob *db.Blob
+	if req.Dedup {
+		if req.ChecksumSHA256 == "" {
+			log.Println("checksumSHA256 is required for dedup uploads")
+			return utils.ResponseError(errors.New("checksumSHA256 is required for dedup uploads"))
+		}
+
+		if req.FileSize > maxSinglePartSize {
+			log.Printf("File size %d exceeds the dedup limit %d", req.FileSize, maxSinglePartSize)
+			return utils.ResponseError(errors.New("dedup uploads are limited to 5GB"))
+		}
+
+		blob, err = db.AcquireBlob(ctx, blobIDFromChecksum(userID, req.ChecksumSHA256), req.FileSize)
+		if errors.Is(err, db.ErrBlobDeleting) {
+			return events.APIGatewayProxyResponse{StatusCode: 409, Body: "content with this checksum is being deleted, retry shortly"}, nil
+		}
+		if err != nil {
+			log.Printf("Error acquiring blob: %v", err)
+			return utils.ResponseError(err)
+		}
+
+		if blob.Size != req.FileSize {
+			log.Printf("Blob %s has size %d, request declared %d", blob.BlobID, blob.Size, req.FileSize)
+			if _, err := db.ReleaseBlob(ctx, blob.BlobID); err != nil {
+				log.Printf("Error releasing blob: %v", err)
+			}
+			return utils.ResponseError(errors.New("fileSize does not match the content with this checksum"))
+		}
+	}
+
 	fileID := uuid.New().String()
 
     file := db.File{
@@ -85,36 +170,107 @@ func GenerateUploadURL(ctx context.Context, request events.APIGatewayProxyReques
 		FileSize: req.FileSize,
         CreatedAt: time.Now().Format(time.RFC3339),
         UpdatedAt: time.Now().Format(time.RFC3339),
+        Status:    db.FileStatusPending,
     }
+	if blob != nil {
+		file.BlobID = blob.BlobID
+		file.ChecksumSHA256 = req.ChecksumSHA256
+		if blob.Status == db.BlobStatusAvailable {
+			file.Status = db.FileStatusUploaded
+			// nothing is deleted on a reject, the blob belongs to the other files too
+			applyContentTypePolicy(&file, blob.DetectedType)
+			file.ScanStatus = blob.ScanStatus
+			file.ScanSignature = blob.ScanSignature
+			file.Thumbnails = blob.Thumbnails
+			if blob.ScanStatus == db.ScanInfected {
+				file.Status = db.FileStatusQuarantined
+				file.StatusReason = "malware detected: " + blob.ScanSignature
+			}
+		}
+	}
 
     log.Printf("Attempting to create file: %+v", file)
 
     err = db.CreateFile(ctx, file)
     if err != nil {
         log.Printf("Error creating file: %v", err)
+		if blob != nil {
+			if _, err := db.ReleaseBlob(ctx, blob.BlobID); err != nil {
+				log.Printf("Error releasing blob: %v", err)
+			}
+		}
         return utils.ResponseError(err)
     }
 
-	if req.FileSize < multipartThreshold {
+	err = recordAudit(ctx, request, db.AuditUploadInitiated, userID, &file)
+	if err != nil {
+		log.Printf("Error recording audit entry: %v", err)
+	}
+
+	if blob != nil && blob.Status == db.BlobStatusAvailable {
+		log.Printf("Content for file %s already stored in blob %s", fileID, blob.BlobID)
+
+		response := struct {
+			FileID       string `json:"fileID"`
+			Deduplicated bool   `json:"deduplicated"`
+		}{
+			FileID:       fileID,
+			Deduplicated: true,
+		}
+
+		return utils.ResponseOK(response)
+	}
+
+	if req.UploadMethod == uploadMethodPost {
+		post, err := presignPostObject(ctx, cfg, "chaosfiles-filestorage", fileID, req.FileType, req.ChecksumSHA256, req.FileSize, time.Minute*15)
+		if err != nil {
+			log.Printf("Error generating POST policy: %v", err)
+			return utils.ResponseError(err)
+		}
+
+		response := struct {
+			*presignedPost
+			FileID string `json:"fileID"`
+		}{
+			presignedPost: post,
+			FileID:        fileID,
+		}
+
+		return utils.ResponseOK(response)
+	}
+
+	if req.FileSize < multipartThreshold || blob != nil {
 	// Handle single part upload
 	// Generate pre signed url
 	presignClient := s3.NewPresignClient(s3Client)
-	presignedUrl, err := presignClient.PresignPutObject(ctx, &s3.PutObjectInput{
+	putInput := &s3.PutObjectInput{
 		Bucket: aws.String("chaosfiles-filestorage"),
-		Key: aws.String(fileID),
+		Key: aws.String(file.ObjectKey()),
 		ContentType: aws.String(req.FileType),
-	}, s3.WithPresignExpires(time.Minute * 15))
+	}
+	// S3 rejects the PUT if the body does not hash to the declared checksum
+	if req.ChecksumSHA256 != "" {
+		putInput.ChecksumSHA256 = aws.String(req.ChecksumSHA256)
+	}
+	// blob keys don't name the file, so tell ProcessUpload which one is waiting on it
+	if blob != nil {
+		putInput.Metadata = map[string]string{blobFileIDMetadata: fileID}
+	}
+
+	presignedUrl, err := presignClient.PresignPutObject(ctx, putInput, s3.WithPresignExpires(time.Minute * 15))
 
 	if err != nil {
 		return utils.ResponseError(err)
 	}
 
     response := struct {
-        UploadURL string `json:"uploadUrl"`
-        FileID    string `json:"fileID"`
+        UploadURL string            `json:"uploadUrl"`
+        FileID    string            `json:"fileID"`
+        Headers   map[string]string `json:"headers,omitempty"`
     }{
         UploadURL: presignedUrl.URL,
         FileID:    fileID,
+        Headers:   presignedHeaders(presignedUrl.SignedHeader),
     }
 
 	// Return the presigned url
@@ -132,12 +288,22 @@ func GenerateUploadURL(ctx context.Context, request events.APIGatewayProxyReques
 			return utils.ResponseError(errors.New("file size results in too many parts"))
 		}
 
-		// initiate multipart upload
-		createResp, err := s3Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		if len(req.PartChecksums) > 0 && len(req.PartChecksums) != numParts {
+			log.Printf("Got %d part checksums for %d parts", len(req.PartChecksums), numParts)
+			return utils.ResponseError(fmt.Errorf("partChecksums must contain exactly %d entries", numParts))
+		}
+
+		createInput := &s3.CreateMultipartUploadInput{
 			Bucket: aws.String("chaosfiles-filestorage"),
 			Key: aws.String(fileID),
 			ContentType: aws.String(req.FileType),
-		})
+		}
+		if len(req.PartChecksums) > 0 {
+			createInput.ChecksumAlgorithm = types.ChecksumAlgorithmSha256
+		}
+
+		// initiate multipart upload
+		createResp, err := s3Client.CreateMultipartUpload(ctx, createInput)
 		if err != nil {
 			log.Printf("Error creating multipart upload: %v", err)
 			return utils.ResponseError(err)
@@ -147,14 +313,20 @@ func GenerateUploadURL(ctx context.Context, request events.APIGatewayProxyReques
 
 		// Generate pre-signed URLs for each part
 		partUrls := make([]string, numParts)
+		partHeaders := make([]map[string]string, numParts)
 		for i := 0; i < numParts; i++ {
 			partNumber := int32(i + 1)
-			presignedReq, err := presignClient.PresignUploadPart(ctx, &s3.UploadPartInput{
+			partInput := &s3.UploadPartInput{
 				Bucket: aws.String("chaosfiles-filestorage"),
 				Key: aws.String(fileID),
 				UploadId: aws.String(uploadID),
 				PartNumber: &partNumber,
-			}, s3.WithPresignExpires(time.Hour*24))
+			}
+			if len(req.PartChecksums) > 0 {
+				partInput.ChecksumSHA256 = aws.String(req.PartChecksums[i])
+			}
+
+			presignedReq, err := presignClient.PresignUploadPart(ctx, partInput, s3.WithPresignExpires(time.Hour*24))
 
 			if err != nil {
 				log.Printf("Error generating pre-signed URL for part %d: %v", partNumber, err)
@@ -162,18 +334,55 @@ func GenerateUploadURL(ctx context.Context, request events.APIGatewayProxyReques
 			}
 
 			partUrls[i] = presignedReq.URL
+			partHeaders[i] = presignedHeaders(presignedReq.SignedHeader)
 		}
 
 		response := struct {
-			UploadID string   `json:"uploadId"`
-			FileID   string   `json:"fileID"`
-			PartUrls []string `json:"partUrls"`
+			UploadID    string              `json:"uploadId"`
+			FileID      string              `json:"fileID"`
+			PartUrls    []string            `json:"partUrls"`
+			PartHeaders []map[string]string `json:"partHeaders,omitempty"`
 		}{
 			UploadID: uploadID,
 			FileID:   fileID,
 			PartUrls: partUrls,
 		}
+		if len(req.PartChecksums) > 0 {
+			response.PartHeaders = partHeaders
+		}
 
 		return utils.ResponseOK(response)
 	}
+}
+
+// isSHA256Checksum reports whether s is a base64 encoded SHA-256 digest, the format S3 expects
+func isSHA256Checksum(s string) bool {
+	digest, err := base64.StdEncoding.DecodeString(s)
+	return err == nil && len(digest) == sha256.Size
+}
+
+// blobIDFromChecksum converts a base64 SHA-256 checksum into the ID of the
+// user's blob for that content. Blobs are only shared between the files of one
+// user: a checksum alone doesn't prove the uploader has the content, so a
+// blob shared across users would hand it to anyone who knows its digest.
+func blobIDFromChecksum(userID, checksum string) string {
+	digest, _ := base64.StdEncoding.DecodeString(checksum)
+	return userID + "/" + hex.EncodeToString(digest)
+}
+
+// presignedHeaders returns the signed headers the client has to send along with a presigned request
+func presignedHeaders(signed http.Header) map[string]string {
+	headers := make(map[string]string)
+	for name, values := range signed {
+		if strings.EqualFold(name, "Host") || len(values) == 0 {
+			continue
+		}
+		headers[name] = values[0]
+	}
+
+	if len(headers) == 0 {
+		return nil
+	}
+
+	return headers
 }
\ No newline at end of file
@@ -0,0 +1,316 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/uuid"
+	"github.com/johnnynu/agreatchaos/api/internal/db"
+	"github.com/johnnynu/agreatchaos/api/pkg/utils"
+)
+
+const (
+	jobImport = "import"
+
+	maxImportURLLength = 2048
+	maxImportBytes     = maxJobBytes
+	maxImportRedirects = 5
+	// importTimeout bounds a whole import, importHeaderTimeout how long the
+	// remote server may take to start answering
+	importTimeout       = 10 * time.Minute
+	importHeaderTimeout = 30 * time.Second
+	importPartSize      = 16 * 1024 * 1024
+
+	defaultImportName = "download"
+)
+
+var errImportTooLarge = errors.New("remote file exceeds the import limit")
+
+type ImportURLRequest struct {
+	URL string `json:"url"`
+	// FolderID is the folder of the imported file, empty for the root
+	FolderID string `json:"folderId"`
+}
+
+func init() {
+	jobRunners[jobImport] = runImport
+}
+
+// ImportURL creates a pending file for a remote HTTP(S) URL and starts a job
+// that fetches it. The file's name, type and size come from the response once
+// the job gets it.
+func ImportURL(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := jwtSubject(request)
+	if userID == "" {
+		log.Println("Unable to extract user ID from JWT claims")
+		return utils.ResponseError(fmt.Errorf("unable to extract user ID from JWT claims"))
+	}
+
+	var req ImportURLRequest
+	err := json.Unmarshal([]byte(request.Body), &req)
+	if err != nil {
+		return events.APIGatewayProxyResponse{StatusCode: 400, Body: "invalid request body"}, nil
+	}
+
+	source, err := validateImportURL(req.URL)
+	if err != nil {
+		return events.APIGatewayProxyResponse{StatusCode: 400, Body: err.Error()}, nil
+	}
+
+	if req.FolderID != "" {
+		owned, err := ownsFolder(ctx, userID, req.FolderID)
+		if err != nil {
+			log.Printf("Error getting folder: %v", err)
+			return utils.ResponseError(err)
+		}
+		if !owned {
+			return events.APIGatewayProxyResponse{StatusCode: 404, Body: "folder not found"}, nil
+		}
+	}
+
+	remaining, limited, err := quotaRemaining(ctx, userID)
+	if err != nil {
+		log.Printf("Error checking quota: %v", err)
+		return utils.ResponseError(err)
+	}
+	if limited && remaining == 0 {
+		return events.APIGatewayProxyResponse{StatusCode: 403, Body: errQuotaExceeded.Error()}, nil
+	}
+
+	now := time.Now()
+	file := db.File{
+		FileID:    uuid.New().String(),
+		UserID:    userID,
+		FileName:  importName("", source),
+		FileType:  "application/octet-stream",
+		FolderID:  req.FolderID,
+		CreatedAt: now.Format(time.RFC3339),
+		UpdatedAt: now.Format(time.RFC3339),
+		Status:    db.FileStatusPending,
+	}
+
+	err = db.CreateFile(ctx, file)
+	if err != nil {
+		log.Printf("Error creating file: %v", err)
+		return utils.ResponseError(err)
+	}
+
+	job := db.Job{
+		JobID:      uuid.New().String(),
+		UserID:     userID,
+		Kind:       jobImport,
+		Status:     db.JobQueued,
+		FileIDs:    []string{file.FileID},
+		SourceURL:  source.String(),
+		FilesTotal: 1,
+		CreatedAt:  now.UTC().Format(time.RFC3339),
+		UpdatedAt:  now.UTC().Format(time.RFC3339),
+		ExpiresAt:  now.Add(db.JobRetention).Unix(),
+	}
+
+	err = db.CreateJob(ctx, job)
+	if err != nil {
+		log.Printf("Error creating job: %v", err)
+		discardFile(ctx, file)
+		return utils.ResponseError(err)
+	}
+
+	err = recordAuditDetails(ctx, request, db.AuditImport, userID, &file, source.String())
+	if err != nil {
+		log.Printf("Error recording audit entry: %v", err)
+	}
+
+	res, err := utils.ResponseOK(map[string]interface{}{"file": file, "job": job})
+	res.StatusCode = 202
+	return res, err
+}
+
+// validateImportURL accepts absolute http and https URLs. Hosts given as IP
+// addresses are checked right away, names are checked when they are dialed.
+func validateImportURL(rawURL string) (*url.URL, error) {
+	if rawURL == "" || len(rawURL) > maxImportURLLength {
+		return nil, fmt.Errorf("url must be between 1 and %d characters", maxImportURLLength)
+	}
+
+	source, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.New("invalid url")
+	}
+	if source.Scheme != "http" && source.Scheme != "https" {
+		return nil, errors.New("url must be http or https")
+	}
+	if source.Hostname() == "" {
+		return nil, errors.New("url must have a host")
+	}
+	if err := checkHost(source.Hostname()); err != nil {
+		return nil, err
+	}
+
+	return source, nil
+}
+
+// runImport fetches the job's URL into its file. The file is updated with the
+// response's details right before its object appears, so ProcessUpload checks
+// the content against them like for any other upload.
+func runImport(ctx context.Context, s3Client *s3.Client, job *db.Job) error {
+	bucket := "chaosfiles-filestorage"
+
+	file, err := db.GetFile(ctx, job.FileIDs[0])
+	if err != nil {
+		return err
+	}
+	if file == nil {
+		return fmt.Errorf("file was deleted before it was imported")
+	}
+
+	err = importFile(ctx, s3Client, bucket, job, file)
+	if err != nil {
+		discardFile(ctx, *file)
+		return err
+	}
+
+	job.FilesDone = 1
+	return nil
+}
+
+func importFile(ctx context.Context, s3Client *s3.Client, bucket string, job *db.Job, file *db.File) error {
+	limit := int64(maxImportBytes)
+	remaining, limited, err := quotaRemaining(ctx, job.UserID)
+	if err != nil {
+		return err
+	}
+	if limited {
+		limit = min(limit, remaining)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, importTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, job.SourceURL, nil)
+	if err != nil {
+		return fmt.Errorf("invalid url: %v", err)
+	}
+
+	res, err := importClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("error fetching %s: %v", job.SourceURL, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("remote server answered %s", res.Status)
+	}
+	if res.ContentLength > limit {
+		return importLimitError(limited)
+	}
+
+	file.FileName = importName(res.Header.Get("Content-Disposition"), res.Request.URL)
+	file.FileType = importType(res.Header.Get("Content-Type"), file.FileName)
+	if res.ContentLength > 0 {
+		job.BytesTotal = res.ContentLength
+	}
+
+	progress := &jobProgress{job: job}
+	progress.update(ctx, true)
+
+	body := &sizeLimitReader{r: res.Body, limit: limit, err: importLimitError(limited)}
+	_, err = uploadStream(ctx, s3Client, bucket, file.ObjectKey(), file.FileType,
+		&progressReader{ctx: ctx, r: body, job: job, progress: progress}, importPartSize,
+		func(size int64) error {
+			file.FileSize = size
+			return db.UpdateFileDetails(ctx, *file)
+		})
+	if err != nil {
+		return err
+	}
+
+	progress.update(ctx, true)
+	return nil
+}
+
+// importClient fetches remote files without ever connecting to a private,
+// loopback or link-local address
+func importClient() *http.Client {
+	return &http.Client{
+		Transport: safeTransport(importHeaderTimeout),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxImportRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxImportRedirects)
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("redirect to unsupported scheme %q", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
+
+// importName names an imported file after the Content-Disposition filename, or
+// else the last segment of the URL it was fetched from
+func importName(disposition string, source *url.URL) string {
+	name := ""
+	if _, params, err := mime.ParseMediaType(disposition); err == nil {
+		name = params["filename"]
+	}
+	if name == "" {
+		name = path.Base(source.Path)
+	}
+
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == "/" || len(name) > maxFileNameLength {
+		return defaultImportName
+	}
+
+	return name
+}
+
+// importType takes the type of an imported file from its Content-Type, or
+// else its extension
+func importType(contentType, name string) string {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && mediaType != "" {
+		return mediaType
+	}
+	if byExt := mime.TypeByExtension(path.Ext(name)); byExt != "" {
+		return byExt
+	}
+
+	return "application/octet-stream"
+}
+
+func importLimitError(limited bool) error {
+	if limited {
+		return errQuotaExceeded
+	}
+	return errImportTooLarge
+}
+
+// sizeLimitReader fails with err once more than limit bytes were read
+type sizeLimitReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+	err   error
+}
+
+func (r *sizeLimitReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.read += int64(n)
+	if r.read > r.limit {
+		return n, r.err
+	}
+
+	return n, err
+}
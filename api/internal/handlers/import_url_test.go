@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// redirectServer redirects /hops/N to /hops/N-1 and answers /hops/0
+func redirectServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ftp" {
+			http.Redirect(w, r, "ftp://files.example.com/data.bin", http.StatusFound)
+			return
+		}
+
+		hops, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/hops/"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if hops > 0 {
+			http.Redirect(w, r, fmt.Sprintf("/hops/%d", hops-1), http.StatusFound)
+			return
+		}
+		io.WriteString(w, "content")
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestImportClientRedirects(t *testing.T) {
+	allowLocalAddresses(t)
+	server := redirectServer(t)
+
+	tests := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{name: "no redirect", path: "/hops/0"},
+		{name: "redirect limit", path: fmt.Sprintf("/hops/%d", maxImportRedirects)},
+		{name: "past the redirect limit", path: fmt.Sprintf("/hops/%d", maxImportRedirects+1), wantErr: true},
+		{name: "unsupported scheme", path: "/ftp", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, server.URL+tt.path, nil)
+			res, err := importClient().Do(req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Do() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				res.Body.Close()
+				if res.Request.URL.Path != "/hops/0" {
+					t.Errorf("ended at %s, want /hops/0", res.Request.URL.Path)
+				}
+			}
+		})
+	}
+}
+
+func TestImportClientBlocksPrivateAddresses(t *testing.T) {
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, server.URL, nil)
+	_, err := importClient().Do(req)
+	if !errors.Is(err, errBlockedAddress) {
+		t.Errorf("Do() error = %v, want errBlockedAddress", err)
+	}
+	if called {
+		t.Error("the loopback server was reached")
+	}
+}
+
+func TestValidateImportURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		wantErr bool
+	}{
+		{name: "https", url: "https://files.example.com/data.bin"},
+		{name: "http", url: "http://files.example.com/data.bin"},
+		{name: "empty", url: "", wantErr: true},
+		{name: "too long", url: "https://files.example.com/" + strings.Repeat("a", maxImportURLLength), wantErr: true},
+		{name: "ftp", url: "ftp://files.example.com/data.bin", wantErr: true},
+		{name: "no host", url: "https:///data.bin", wantErr: true},
+		{name: "loopback", url: "http://127.0.0.1:8080/data.bin", wantErr: true},
+		{name: "loopback v6", url: "http://[::1]/data.bin", wantErr: true},
+		{name: "instance metadata", url: "http://169.254.169.254/latest/meta-data", wantErr: true},
+		{name: "private", url: "http://192.168.1.10/data.bin", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := validateImportURL(tt.url); (err != nil) != tt.wantErr {
+				t.Errorf("validateImportURL(%q) error = %v, wantErr %v", tt.url, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSizeLimitReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		limited bool
+		size    int
+		wantErr error
+	}{
+		{name: "at the limit", size: 10},
+		{name: "past the import limit", size: 11, wantErr: errImportTooLarge},
+		{name: "past the quota", limited: true, size: 11, wantErr: errQuotaExceeded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &sizeLimitReader{r: strings.NewReader(strings.Repeat("x", tt.size)), limit: 10, err: importLimitError(tt.limited)}
+			_, err := io.ReadAll(r)
+			if err != tt.wantErr {
+				t.Errorf("ReadAll() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestImportName(t *testing.T) {
+	source, _ := url.Parse("https://files.example.com/reports/q3.pdf?token=abc")
+	bare, _ := url.Parse("https://files.example.com/")
+
+	tests := []struct {
+		name        string
+		disposition string
+		source      *url.URL
+		want        string
+	}{
+		{name: "disposition", disposition: `attachment; filename="summary.pdf"`, source: source, want: "summary.pdf"},
+		{name: "encoded disposition", disposition: `attachment; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`, source: source, want: "résumé.pdf"},
+		{name: "url path", source: source, want: "q3.pdf"},
+		{name: "invalid disposition", disposition: "attachment; filename=", source: source, want: "q3.pdf"},
+		{name: "path traversal", disposition: `attachment; filename="../../etc/passwd"`, source: source, want: "passwd"},
+		{name: "windows path", disposition: `attachment; filename="C:\\temp\\notes.txt"`, source: source, want: "notes.txt"},
+		{name: "nothing to go by", source: bare, want: defaultImportName},
+		{name: "too long", disposition: `attachment; filename="` + strings.Repeat("a", maxFileNameLength+1) + `"`, source: source, want: defaultImportName},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := importName(tt.disposition, tt.source); got != tt.want {
+				t.Errorf("importName(%q) = %q, want %q", tt.disposition, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImportType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		name        string
+		want        string
+	}{
+		{contentType: "image/png; charset=binary", name: "photo", want: "image/png"},
+		{name: "page.html", want: "text/html; charset=utf-8"},
+		{name: "data", want: "application/octet-stream"},
+	}
+
+	for _, tt := range tests {
+		if got := importType(tt.contentType, tt.name); got != tt.want {
+			t.Errorf("importType(%q, %q) = %q, want %q", tt.contentType, tt.name, got, tt.want)
+		}
+	}
+}
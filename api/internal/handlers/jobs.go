@@ -0,0 +1,306 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/johnnynu/agreatchaos/api/internal/db"
+	"github.com/johnnynu/agreatchaos/api/pkg/utils"
+)
+
+// tmpPrefix holds objects produced by jobs, which are deleted after JobRetention
+const tmpPrefix = "tmp/"
+
+const (
+	// jobProgressInterval is how often a running job stores its progress
+	jobProgressInterval = 5 * time.Second
+
+	// A job runs within a single worker invocation. jobFinishMargin is how
+	// long before the invocation's deadline a job is stopped so that its
+	// failure can still be recorded.
+	jobFinishMargin = 30 * time.Second
+
+	// invokeTimeout bounds each asynchronous invocation of the job worker
+	invokeTimeout = 10 * time.Second
+
+	// maxJobBytes is the most a job may read or write, sized to finish well
+	// within the Lambda timeout
+	maxJobBytes = 5 * 1024 * 1024 * 1024 // 5GB
+
+	// jobStaleAfter is longer than any invocation can last, so a job queued or
+	// running without an update for that long lost its worker
+	jobStaleAfter      = 20 * time.Minute
+	staleJobsBatchSize = 100
+	jobTimedOutReason  = "job timed out"
+)
+
+// invokeClient invokes the job worker. Asynchronous invocations are answered
+// as soon as they are queued, so it gives up quickly.
+var invokeClient = &http.Client{Timeout: invokeTimeout}
+
+// lambdaEndpoint is the Lambda API of a region, replaced in tests
+var lambdaEndpoint = func(region string) string {
+	return fmt.Sprintf("https://lambda.%s.amazonaws.com", region)
+}
+
+// JobRequest is the event the job worker is invoked with
+type JobRequest struct {
+	JobID string `json:"jobId"`
+}
+
+// jobRunners run jobs by kind. A runner updates the job's progress as it goes
+// and sets its ResultKey if it produces an object.
+var jobRunners = map[string]func(ctx context.Context, s3Client *s3.Client, job *db.Job) error{}
+
+// HandleJobStream hands the jobs inserted in the Jobs table to the job worker,
+// named by JOB_WORKER_FUNCTION, with asynchronous invocations. Jobs run outside
+// the stream, so a long one doesn't hold up the jobs behind it on the shard.
+// Like DispatchStream, it stops at the first record it can't dispatch so that
+// the stream retries from there.
+func HandleJobStream(ctx context.Context, e events.DynamoDBEvent) (events.DynamoDBEventResponse, error) {
+	var res events.DynamoDBEventResponse
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return res, fmt.Errorf("unable to load SDK config, %v", err)
+	}
+
+	for _, record := range e.Records {
+		if record.EventName != "INSERT" {
+			continue
+		}
+
+		var job db.Job
+		err := unmarshalStreamImage(record.Change.NewImage, &job)
+		if err == nil {
+			err = dispatchJob(ctx, cfg, os.Getenv("JOB_WORKER_FUNCTION"), job)
+		}
+		if err != nil {
+			log.Printf("Error dispatching job from stream record %s: %v", record.EventID, err)
+			res.BatchItemFailures = append(res.BatchItemFailures, events.DynamoDBBatchItemFailure{
+				ItemIdentifier: record.Change.SequenceNumber,
+			})
+			break
+		}
+	}
+
+	return res, nil
+}
+
+// dispatchJob invokes the job worker for a job without waiting for it to run
+func dispatchJob(ctx context.Context, cfg aws.Config, function string, job db.Job) error {
+	if function == "" {
+		return errors.New("JOB_WORKER_FUNCTION is not set")
+	}
+
+	payload, err := json.Marshal(JobRequest{JobID: job.JobID})
+	if err != nil {
+		return fmt.Errorf("failed to marshal job request: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, invokeTimeout)
+	defer cancel()
+
+	endpoint := fmt.Sprintf("%s/2015-03-31/functions/%s/invocations", lambdaEndpoint(cfg.Region), url.PathEscape(function))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Amz-Invocation-Type", "Event")
+
+	creds, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to retrieve credentials, %v", err)
+	}
+
+	payloadHash := sha256.Sum256(payload)
+	err = v4.NewSigner().SignHTTP(ctx, creds, req, hex.EncodeToString(payloadHash[:]), "lambda", cfg.Region, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to sign request: %v", err)
+	}
+
+	res, err := invokeClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusAccepted {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("invoking %s failed with %s: %s", function, res.Status, body)
+	}
+
+	return nil
+}
+
+// RunJobWorker runs one job dispatched by HandleJobStream, in an invocation
+// of its own. An error is only returned when the job couldn't be claimed or
+// its outcome recorded, so that Lambda retries the invocation.
+func RunJobWorker(ctx context.Context, req JobRequest) error {
+	job, err := db.GetJob(ctx, req.JobID)
+	if err != nil {
+		return err
+	}
+	if job == nil {
+		log.Printf("Job %s no longer exists", req.JobID)
+		return nil
+	}
+
+	return runJob(ctx, job)
+}
+
+// runJob claims a queued job and runs it to completion. The job's own failure
+// is recorded on it, the returned error is about claiming or recording it. A
+// job still running close to the invocation's deadline is stopped and failed.
+func runJob(ctx context.Context, job *db.Job) error {
+	claimed, err := db.ClaimJob(ctx, job.JobID)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		log.Printf("Job %s was already claimed", job.JobID)
+		return nil
+	}
+
+	runCtx := ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithDeadline(ctx, deadline.Add(-jobFinishMargin))
+		defer cancel()
+	}
+
+	job.Status = db.JobRunning
+	err = runJobKind(runCtx, job)
+	if err != nil && ctx.Err() == nil && errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+		err = errors.New(jobTimedOutReason)
+	}
+	if err != nil {
+		log.Printf("Job %s failed: %v", job.JobID, err)
+		job.Status = db.JobFailed
+		job.Error = err.Error()
+	} else {
+		job.Status = db.JobSucceeded
+	}
+
+	return db.FinishJob(ctx, *job)
+}
+
+func runJobKind(ctx context.Context, job *db.Job) error {
+	runner, ok := jobRunners[job.Kind]
+	if !ok {
+		return fmt.Errorf("unknown job kind %q", job.Kind)
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to load SDK config, %v", err)
+	}
+
+	return runner(ctx, s3.NewFromConfig(cfg), job)
+}
+
+// SweepStaleJobs fails the jobs whose worker went away without recording their
+// outcome, such as when an invocation was killed or never ran. It is run on a
+// schedule.
+func SweepStaleJobs(ctx context.Context, event events.CloudWatchEvent) error {
+	jobs, err := db.ListStaleJobs(ctx, time.Now().Add(-jobStaleAfter), staleJobsBatchSize)
+	if err != nil {
+		log.Printf("Error listing stale jobs: %v", err)
+		return err
+	}
+
+	for _, job := range jobs {
+		failed, err := db.FailStaleJob(ctx, job, jobTimedOutReason)
+		if err != nil {
+			log.Printf("Error failing stale job %s: %v", job.JobID, err)
+			continue
+		}
+		if failed {
+			log.Printf("Failed job %s, last updated at %s", job.JobID, job.UpdatedAt)
+		}
+	}
+
+	return nil
+}
+
+// jobProgress stores a job's progress at most every jobProgressInterval
+type jobProgress struct {
+	job  *db.Job
+	last time.Time
+}
+
+func (p *jobProgress) update(ctx context.Context, force bool) {
+	if !force && time.Since(p.last) < jobProgressInterval {
+		return
+	}
+
+	p.last = time.Now()
+	err := db.UpdateJobProgress(ctx, *p.job)
+	if err != nil {
+		log.Printf("Error updating progress of job %s: %v", p.job.JobID, err)
+	}
+}
+
+// GetJob returns the status and progress of one of the caller's jobs. Once a
+// job that produced an object succeeded, it includes a short-lived URL to it.
+func GetJob(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := jwtSubject(request)
+	if userID == "" {
+		log.Println("Unable to extract user ID from JWT claims")
+		return utils.ResponseError(fmt.Errorf("unable to extract user ID from JWT claims"))
+	}
+
+	jobID := request.PathParameters["jobId"]
+	if jobID == "" {
+		return utils.ResponseError(errors.New("jobID is required"))
+	}
+
+	job, err := db.GetJob(ctx, jobID)
+	if err != nil {
+		log.Printf("Error getting job: %v", err)
+		return utils.ResponseError(err)
+	}
+	if job == nil || job.UserID != userID {
+		return utils.ResponseError(utils.ErrNotFound)
+	}
+
+	res := struct {
+		*db.Job
+		DownloadURL string `json:"downloadUrl,omitempty"`
+	}{Job: job}
+
+	if job.Status == db.JobSucceeded && job.ResultKey != "" && time.Now().Unix() < job.ExpiresAt {
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return utils.ResponseError(err)
+		}
+
+		presignedUrl, err := s3.NewPresignClient(s3.NewFromConfig(cfg)).PresignGetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String("chaosfiles-filestorage"),
+			Key:    aws.String(job.ResultKey),
+		}, s3.WithPresignExpires(time.Minute*15))
+		if err != nil {
+			return utils.ResponseError(err)
+		}
+		res.DownloadURL = presignedUrl.URL
+	}
+
+	return utils.ResponseOK(res)
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/johnnynu/agreatchaos/api/internal/db"
+)
+
+func TestDispatchJob(t *testing.T) {
+	cfg := aws.Config{
+		Region: "us-east-1",
+		Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"}, nil
+		}),
+	}
+
+	tests := []struct {
+		name     string
+		function string
+		status   int
+		wantErr  bool
+	}{
+		{name: "queued", function: "chaos-job-worker", status: http.StatusAccepted},
+		{name: "throttled", function: "chaos-job-worker", status: http.StatusTooManyRequests, wantErr: true},
+		{name: "no worker configured", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *http.Request
+			var body []byte
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r
+				body, _ = io.ReadAll(r.Body)
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			saved := lambdaEndpoint
+			lambdaEndpoint = func(string) string { return server.URL }
+			t.Cleanup(func() { lambdaEndpoint = saved })
+
+			err := dispatchJob(context.Background(), cfg, tt.function, db.Job{JobID: "job-1"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("dispatchJob() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.function == "" {
+				if got != nil {
+					t.Error("the worker was invoked without a function name")
+				}
+				return
+			}
+
+			if got.URL.Path != "/2015-03-31/functions/"+tt.function+"/invocations" {
+				t.Errorf("path = %s", got.URL.Path)
+			}
+			if got.Header.Get("X-Amz-Invocation-Type") != "Event" {
+				t.Errorf("invocation type = %q, want Event", got.Header.Get("X-Amz-Invocation-Type"))
+			}
+			if !strings.Contains(got.Header.Get("Authorization"), "/us-east-1/lambda/aws4_request") {
+				t.Errorf("authorization = %q", got.Header.Get("Authorization"))
+			}
+
+			var req JobRequest
+			if err := json.Unmarshal(body, &req); err != nil || req.JobID != "job-1" {
+				t.Errorf("payload = %s", body)
+			}
+		})
+	}
+}
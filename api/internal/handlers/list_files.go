@@ -37,8 +37,17 @@ func ListFiles(ctx context.Context, request events.APIGatewayProxyRequest) (even
 		return utils.ResponseError(err)
 	}
 
+	// trashed files are only listed with ?trashed=true, and then only them
+	trashed := request.QueryStringParameters["trashed"] == "true"
+	listed := []db.File{}
+	for _, file := range files {
+		if (file.TrashedAt != "") == trashed {
+			listed = append(listed, file)
+		}
+	}
+
 	// Convert files to JSON
-	resBody, err := json.Marshal(files)
+	resBody, err := json.Marshal(listed)
 	if err != nil {
 		log.Printf("Error marshalling response: %v", err)
 		return utils.ResponseError(err)
@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// minPartSize is the smallest part S3 accepts, other than the last one
+const minPartSize = 5 * 1024 * 1024
+
+// multipartWriter writes an object of unknown size as a multipart upload,
+// buffering one part at a time. Close completes the upload and Abort
+// discards it.
+type multipartWriter struct {
+	ctx      context.Context
+	client   *s3.Client
+	bucket   string
+	key      string
+	partSize int
+	uploadID string
+	buf      bytes.Buffer
+	parts    []types.CompletedPart
+}
+
+func newMultipartWriter(ctx context.Context, client *s3.Client, bucket, key, contentType string, partSize int) (*multipartWriter, error) {
+	res, err := client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating multipart upload: %v", err)
+	}
+
+	return &multipartWriter{
+		ctx:      ctx,
+		client:   client,
+		bucket:   bucket,
+		key:      key,
+		partSize: max(partSize, minPartSize),
+		uploadID: aws.ToString(res.UploadId),
+	}, nil
+}
+
+func (w *multipartWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		chunk := min(len(p), w.partSize-w.buf.Len())
+		w.buf.Write(p[:chunk])
+		p = p[chunk:]
+		n += chunk
+
+		if w.buf.Len() == w.partSize {
+			err := w.flush()
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+func (w *multipartWriter) flush() error {
+	if len(w.parts) == maxParts {
+		return fmt.Errorf("object exceeds %d parts of %d bytes", maxParts, w.partSize)
+	}
+
+	partNumber := int32(len(w.parts) + 1)
+	res, err := w.client.UploadPart(w.ctx, &s3.UploadPartInput{
+		Bucket:     aws.String(w.bucket),
+		Key:        aws.String(w.key),
+		UploadId:   aws.String(w.uploadID),
+		PartNumber: aws.Int32(partNumber),
+		Body:       bytes.NewReader(w.buf.Bytes()),
+	})
+	if err != nil {
+		return fmt.Errorf("error uploading part %d: %v", partNumber, err)
+	}
+
+	w.parts = append(w.parts, types.CompletedPart{ETag: res.ETag, PartNumber: aws.Int32(partNumber)})
+	w.buf.Reset()
+
+	return nil
+}
+
+// Close uploads the buffered data as the last part and completes the upload
+func (w *multipartWriter) Close() error {
+	if w.buf.Len() > 0 || len(w.parts) == 0 {
+		err := w.flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := w.client.CompleteMultipartUpload(w.ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(w.bucket),
+		Key:             aws.String(w.key),
+		UploadId:        aws.String(w.uploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: w.parts},
+	})
+	if err != nil {
+		return fmt.Errorf("error completing multipart upload: %v", err)
+	}
+
+	return nil
+}
+
+// Abort discards the parts uploaded so far
+func (w *multipartWriter) Abort() error {
+	// use a fresh context, the writer's may be why the upload is aborted
+	_, err := w.client.AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(w.bucket),
+		Key:      aws.String(w.key),
+		UploadId: aws.String(w.uploadID),
+	})
+	if err != nil {
+		return fmt.Errorf("error aborting multipart upload: %v", err)
+	}
+
+	return nil
+}
+
+// uploadStream uploads r to key and returns its size. Content that fits in one
+// part is sent with a single PUT, anything larger goes through a multipartWriter.
+// beforeCommit, when set, is called with the size once all of r was read and
+// before the object appears in the bucket, and aborts the upload if it fails.
+func uploadStream(ctx context.Context, client *s3.Client, bucket, key, contentType string, r io.Reader, partSize int, beforeCommit func(size int64) error) (int64, error) {
+	head, err := io.ReadAll(io.LimitReader(r, minPartSize+1))
+	if err != nil {
+		return 0, err
+	}
+
+	if len(head) <= minPartSize {
+		if beforeCommit != nil {
+			err = beforeCommit(int64(len(head)))
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		_, err = client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(bucket),
+			Key:         aws.String(key),
+			ContentType: aws.String(contentType),
+			Body:        bytes.NewReader(head),
+		})
+		if err != nil {
+			return 0, fmt.Errorf("error uploading object: %v", err)
+		}
+
+		return int64(len(head)), nil
+	}
+
+	w, err := newMultipartWriter(ctx, client, bucket, key, contentType, partSize)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(w, io.MultiReader(bytes.NewReader(head), r))
+	if err == nil && beforeCommit != nil {
+		err = beforeCommit(n)
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		if abortErr := w.Abort(); abortErr != nil {
+			log.Printf("Error aborting upload of %s: %v", key, abortErr)
+		}
+		return 0, err
+	}
+
+	return n, nil
+}
@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/johnnynu/agreatchaos/api/internal/db"
+	"github.com/johnnynu/agreatchaos/api/internal/domain"
+)
+
+// errConnectionGone is returned by postToConnection for connections that were
+// closed without their disconnect being handled
+var errConnectionGone = errors.New("connection gone")
+
+// postTimeout bounds each post to a connection, so one unresponsive endpoint
+// can't hold up the stream batch
+const postTimeout = 5 * time.Second
+
+// connectionClient posts to the connection management API. Unlike
+// http.DefaultClient it gives up on a stalled connection.
+var connectionClient = &http.Client{Timeout: postTimeout}
+
+// notificationTypes are the event types pushed to WebSocket clients and webhooks
+var notificationTypes = map[string]bool{
+	"file.created":  true,
+	"file.uploaded": true,
+	"file.renamed":  true,
+	"file.deleted":  true,
+}
+
+// notification is the message pushed to WebSocket clients and webhooks
+type notification struct {
+	Type       string  `json:"type"`
+	EventID    string  `json:"eventId"`
+	OccurredAt string  `json:"occurredAt"`
+	File       db.File `json:"file"`
+	OldName    string  `json:"oldName,omitempty"`
+}
+
+func init() {
+	StreamDispatcher.Subscribe(notifyConnections)
+}
+
+// notifyConnections pushes file events to the connections of everyone who can
+// see the file. Delivery is best effort: clients resync with ListFiles when they
+// reconnect, so failed posts are logged rather than retried.
+func notifyConnections(ctx context.Context, event domain.Event) error {
+	msg, ok := fileNotification(event)
+	if !ok {
+		return nil
+	}
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification: %v", err)
+	}
+
+	var conns []db.Connection
+	for _, userID := range notificationRecipients(msg.File) {
+		userConns, err := db.ListUserConnections(ctx, userID)
+		if err != nil {
+			return err
+		}
+		conns = append(conns, userConns...)
+	}
+
+	if len(conns) == 0 {
+		return nil
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to load SDK config, %v", err)
+	}
+
+	for _, conn := range conns {
+		if !conn.Subscribed(msg.Type) {
+			continue
+		}
+
+		err := postToConnection(ctx, cfg, conn, payload)
+		if err == errConnectionGone {
+			log.Printf("Removing stale connection %s", conn.ConnectionID)
+			err = db.DeleteConnection(ctx, conn.ConnectionID)
+		}
+		if err != nil {
+			log.Printf("Error notifying connection %s: %v", conn.ConnectionID, err)
+		}
+	}
+
+	return nil
+}
+
+// fileNotification returns the message for a file event, which is also the
+// payload of webhook deliveries
+func fileNotification(event domain.Event) (notification, bool) {
+	var msg notification
+	switch e := event.(type) {
+	case domain.FileCreated:
+		msg = notification{Type: "file.created", File: e.File}
+	case domain.FileUploaded:
+		msg = notification{Type: "file.uploaded", File: e.File}
+	case domain.FileRenamed:
+		msg = notification{Type: "file.renamed", File: e.File, OldName: e.OldName}
+	case domain.FileDeleted:
+		msg = notification{Type: "file.deleted", File: e.File}
+	default:
+		return msg, false
+	}
+
+	meta := event.Metadata()
+	msg.EventID = meta.EventID
+	msg.OccurredAt = meta.OccurredAt.UTC().Format(time.RFC3339)
+
+	return msg, true
+}
+
+// notificationRecipients returns the users notified about changes to a file.
+// Files are only visible to their owner.
+func notificationRecipients(file db.File) []string {
+	return []string{file.UserID}
+}
+
+// postToConnection sends a message through the connection management API of
+// the WebSocket API the connection belongs to
+func postToConnection(ctx context.Context, cfg aws.Config, conn db.Connection, payload []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, postTimeout)
+	defer cancel()
+
+	endpoint := fmt.Sprintf("%s/@connections/%s", conn.Endpoint, url.PathEscape(conn.ConnectionID))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	creds, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to retrieve credentials, %v", err)
+	}
+
+	payloadHash := sha256.Sum256(payload)
+	err = v4.NewSigner().SignHTTP(ctx, creds, req, hex.EncodeToString(payloadHash[:]), "execute-api", cfg.Region, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to sign request: %v", err)
+	}
+
+	res, err := connectionClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusGone {
+		return errConnectionGone
+	}
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("posting to connection failed with %s: %s", res.Status, body)
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// errReadBudget is returned once an objectReader fetched as much as it may
+var errReadBudget = errors.New("read budget exhausted")
+
+// objectReader reads an S3 object with ranged GETs. Reads are fetched in
+// blocks, the latest maxBlocks of which are kept for later reads, and the total
+// fetched is capped by a budget so that a reader never downloads more of an
+// object than allowed.
+type objectReader struct {
+	ctx       context.Context
+	client    *s3.Client
+	bucket    string
+	key       string
+	size      int64
+	blockSize int64
+	budget    int64
+	fetched   int64
+	blocks    map[int64][]byte
+	// order holds the indexes of the cached blocks, oldest first
+	order []int64
+	// maxBlocks bounds the memory used by cached blocks, 0 keeps every block
+	maxBlocks int
+}
+
+func newObjectReader(ctx context.Context, client *s3.Client, bucket, key string, size, blockSize, budget int64) *objectReader {
+	return &objectReader{
+		ctx:       ctx,
+		client:    client,
+		bucket:    bucket,
+		key:       key,
+		size:      size,
+		blockSize: blockSize,
+		budget:    budget,
+		blocks:    make(map[int64][]byte),
+	}
+}
+
+func (r *objectReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= r.size {
+			return n, io.EOF
+		}
+
+		index := pos / r.blockSize
+		block, err := r.block(index)
+		if err != nil {
+			return n, err
+		}
+
+		n += copy(p[n:], block[pos-index*r.blockSize:])
+	}
+
+	return n, nil
+}
+
+func (r *objectReader) block(index int64) ([]byte, error) {
+	if block, ok := r.blocks[index]; ok {
+		return block, nil
+	}
+
+	start := index * r.blockSize
+	end := min(start+r.blockSize, r.size) - 1
+	if r.fetched+end-start+1 > r.budget {
+		return nil, errReadBudget
+	}
+
+	obj, err := r.client.GetObject(r.ctx, &s3.GetObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(r.key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", r.key, err)
+	}
+	defer obj.Body.Close()
+
+	block, err := io.ReadAll(obj.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", r.key, err)
+	}
+	if int64(len(block)) != end-start+1 {
+		return nil, fmt.Errorf("short read of %s at %d", r.key, start)
+	}
+
+	r.fetched += int64(len(block))
+	if r.maxBlocks > 0 && len(r.order) >= r.maxBlocks {
+		delete(r.blocks, r.order[0])
+		r.order = r.order[1:]
+	}
+	r.blocks[index] = block
+	r.order = append(r.order, index)
+
+	return block, nil
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// rangeServer serves ranged GETs of content and records the ranges requested
+func rangeServer(t *testing.T, content []byte) (*s3.Client, *[]string) {
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start, end int
+		fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(content)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(content[start : end+1])
+	}))
+	t.Cleanup(server.Close)
+
+	client := s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(server.URL),
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	})
+
+	return client, &ranges
+}
+
+func TestObjectReaderEvictsOldestBlock(t *testing.T) {
+	content := []byte(strings.Repeat("a", 10) + strings.Repeat("b", 10) + strings.Repeat("c", 10))
+	client, ranges := rangeServer(t, content)
+
+	r := newObjectReader(context.Background(), client, "bucket", "key", int64(len(content)), 10, 1000)
+	r.maxBlocks = 2
+
+	p := make([]byte, 10)
+	for _, off := range []int64{0, 10, 0, 20, 10} {
+		_, err := r.ReadAt(p, off)
+		if err != nil {
+			t.Fatalf("ReadAt(%d) error = %v", off, err)
+		}
+		if !bytes.Equal(p, content[off:off+10]) {
+			t.Errorf("ReadAt(%d) = %q", off, p)
+		}
+	}
+
+	// the third read is cached, reading the last block evicts the first one
+	// fetched and keeps the second
+	want := []string{"bytes=0-9", "bytes=10-19", "bytes=20-29"}
+	if strings.Join(*ranges, ",") != strings.Join(want, ",") {
+		t.Errorf("fetched %v, want %v", *ranges, want)
+	}
+	if _, ok := r.blocks[0]; ok {
+		t.Error("the oldest block is still cached")
+	}
+}
+
+func TestObjectReaderBudget(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 30)
+	client, _ := rangeServer(t, content)
+
+	r := newObjectReader(context.Background(), client, "bucket", "key", int64(len(content)), 10, 20)
+
+	_, err := r.ReadAt(make([]byte, 30), 0)
+	if err != errReadBudget {
+		t.Errorf("ReadAt() error = %v, want errReadBudget", err)
+	}
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/johnnynu/agreatchaos/api/internal/db"
+)
+
+const (
+	pendingDeleteBatchSize = 100
+	pendingDeleteBaseDelay = 30 * time.Second
+	pendingDeleteMaxDelay  = 6 * time.Hour
+)
+
+// ProcessPendingDeletes retries the storage deletes that didn't go through when
+// their files were deleted. It runs on a schedule.
+func ProcessPendingDeletes(ctx context.Context, event events.CloudWatchEvent) error {
+	ops, err := db.ListDuePendingDeletes(ctx, time.Now(), pendingDeleteBatchSize)
+	if err != nil {
+		log.Printf("Error listing pending deletes: %v", err)
+		return err
+	}
+
+	log.Printf("Processing %d pending deletes", len(ops))
+
+	for _, op := range ops {
+		err := runPendingDelete(ctx, op)
+		if err == nil {
+			continue
+		}
+
+		log.Printf("Pending delete %s failed after %d attempts: %v", op.OpID, op.Attempts+1, err)
+
+		err = db.RetryPendingDelete(ctx, op.OpID, time.Now().Add(pendingDeleteBackoff(op.Attempts)), err)
+		if err != nil {
+			log.Printf("Error rescheduling pending delete: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// runPendingDelete removes the storage of a deleted file and completes the
+// pending delete. It is safe to run more than once for the same op.
+func runPendingDelete(ctx context.Context, op db.PendingDelete) error {
+	var err error
+	switch op.Kind {
+	case db.PendingDeleteObject:
+		err = deleteFileFromS3(ctx, op.Key)
+	case db.PendingDeleteBlob:
+		err = deleteUnreferencedBlob(ctx, op.BlobID)
+	default:
+		err = fmt.Errorf("unknown pending delete kind %q", op.Kind)
+	}
+	if err != nil {
+		return err
+	}
+
+	return db.CompletePendingDelete(ctx, op.OpID)
+}
+
+// deleteUnreferencedBlob removes a blob and its object, unless it is still
+// referenced or was acquired again since the reference was dropped. The blob
+// is marked deleting first, so it can't be acquired and uploaded again while
+// its object is deleted.
+func deleteUnreferencedBlob(ctx context.Context, blobID string) error {
+	blob, err := db.GetBlob(ctx, blobID)
+	if err != nil {
+		return err
+	}
+
+	if blob == nil {
+		return nil
+	}
+
+	if blob.RefCount > 0 {
+		log.Printf("Blob %s still has %d references", blobID, blob.RefCount)
+		return nil
+	}
+
+	marked, err := db.MarkBlobDeleting(ctx, blobID)
+	if err != nil {
+		return err
+	}
+
+	if !marked {
+		log.Printf("Blob %s was acquired again before it could be deleted", blobID)
+		return nil
+	}
+
+	err = deleteFileFromS3(ctx, db.BlobKey(blobID))
+	if err != nil {
+		return err
+	}
+
+	_, err = db.DeleteBlob(ctx, blobID)
+	return err
+}
+
+// pendingDeleteBackoff doubles the delay with every failed attempt
+func pendingDeleteBackoff(attempts int) time.Duration {
+	delay := float64(pendingDeleteBaseDelay) * math.Pow(2, float64(attempts))
+	if delay > float64(pendingDeleteMaxDelay) {
+		return pendingDeleteMaxDelay
+	}
+
+	return time.Duration(delay)
+}
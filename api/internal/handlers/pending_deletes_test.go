@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPendingDeleteBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 0, want: pendingDeleteBaseDelay},
+		{attempts: 1, want: 2 * pendingDeleteBaseDelay},
+		{attempts: 3, want: 8 * pendingDeleteBaseDelay},
+		{attempts: 9, want: 512 * pendingDeleteBaseDelay},
+		{attempts: 10, want: pendingDeleteMaxDelay},
+		// far past the point where the delay would overflow a Duration
+		{attempts: 100, want: pendingDeleteMaxDelay},
+		{attempts: 2000, want: pendingDeleteMaxDelay},
+	}
+
+	for _, tt := range tests {
+		if got := pendingDeleteBackoff(tt.attempts); got != tt.want {
+			t.Errorf("pendingDeleteBackoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// presignedPost is a browser-style S3 POST upload: the form fields have to be
+// sent along with the file, which must be the last field of the form
+type presignedPost struct {
+	URL    string            `json:"uploadUrl"`
+	Fields map[string]string `json:"fields"`
+}
+
+// presignPostObject signs a POST policy that only accepts an object of exactly
+// size bytes with the given content type under key. Unlike a presigned PUT, S3
+// enforces the content-length-range condition itself. When checksum is set,
+// the form carries it and S3 rejects content that doesn't hash to it.
+func presignPostObject(ctx context.Context, cfg aws.Config, bucket, key, contentType, checksum string, size int64, expires time.Duration) (*presignedPost, error) {
+	creds, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve credentials, %v", err)
+	}
+
+	now := time.Now().UTC()
+	date := now.Format("20060102")
+	amzDate := now.Format("20060102T150405Z")
+	credential := fmt.Sprintf("%s/%s/%s/s3/aws4_request", creds.AccessKeyID, date, cfg.Region)
+
+	fields := map[string]string{
+		"key":              key,
+		"Content-Type":     contentType,
+		"x-amz-algorithm":  "AWS4-HMAC-SHA256",
+		"x-amz-credential": credential,
+		"x-amz-date":       amzDate,
+	}
+	if creds.SessionToken != "" {
+		fields["x-amz-security-token"] = creds.SessionToken
+	}
+	if checksum != "" {
+		fields["x-amz-checksum-algorithm"] = "SHA256"
+		fields["x-amz-checksum-sha256"] = checksum
+	}
+
+	conditions := []interface{}{
+		map[string]string{"bucket": bucket},
+		[]interface{}{"content-length-range", size, size},
+	}
+	for name, value := range fields {
+		conditions = append(conditions, map[string]string{name: value})
+	}
+
+	policy, err := json.Marshal(map[string]interface{}{
+		"expiration": now.Add(expires).Format("2006-01-02T15:04:05.000Z"),
+		"conditions": conditions,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal POST policy, %v", err)
+	}
+
+	encodedPolicy := base64.StdEncoding.EncodeToString(policy)
+
+	signingKey := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	signingKey = hmacSHA256(signingKey, cfg.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+
+	fields["policy"] = encodedPolicy
+	fields["x-amz-signature"] = hex.EncodeToString(hmacSHA256(signingKey, encodedPolicy))
+
+	return &presignedPost{
+		URL:    fmt.Sprintf("https://%s.s3.%s.amazonaws.com/", bucket, cfg.Region),
+		Fields: fields,
+	}, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestPresignPostObject(t *testing.T) {
+	cfg := aws.Config{
+		Region: "us-east-1",
+		Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"}, nil
+		}),
+	}
+	checksum := "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="
+
+	tests := []struct {
+		name     string
+		checksum string
+	}{
+		{name: "without checksum"},
+		{name: "with checksum", checksum: checksum},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			post, err := presignPostObject(context.Background(), cfg, "bucket", "file-1", "image/png", tt.checksum, 42, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			raw, err := base64.StdEncoding.DecodeString(post.Fields["policy"])
+			if err != nil {
+				t.Fatal(err)
+			}
+			var policy struct {
+				Conditions []json.RawMessage `json:"conditions"`
+			}
+			if err := json.Unmarshal(raw, &policy); err != nil {
+				t.Fatal(err)
+			}
+
+			// every field but the policy and signature is bound by an exact condition
+			exact := map[string]string{}
+			for _, condition := range policy.Conditions {
+				var match map[string]string
+				if json.Unmarshal(condition, &match) == nil {
+					for name, value := range match {
+						exact[name] = value
+					}
+				}
+			}
+			for name, value := range post.Fields {
+				if name == "policy" || name == "x-amz-signature" {
+					continue
+				}
+				if exact[name] != value {
+					t.Errorf("field %s = %q has condition %q", name, value, exact[name])
+				}
+			}
+
+			if tt.checksum == "" {
+				if _, ok := post.Fields["x-amz-checksum-sha256"]; ok {
+					t.Error("checksum field set without a checksum")
+				}
+				return
+			}
+			if post.Fields["x-amz-checksum-sha256"] != tt.checksum || post.Fields["x-amz-checksum-algorithm"] != "SHA256" {
+				t.Errorf("checksum fields = %q, %q", post.Fields["x-amz-checksum-algorithm"], post.Fields["x-amz-checksum-sha256"])
+			}
+		})
+	}
+}
@@ -5,8 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/johnnynu/agreatchaos/api/internal/db"
 	"github.com/johnnynu/agreatchaos/api/pkg/utils"
 )
@@ -39,7 +43,40 @@ func PreviewFile(ctx context.Context, request events.APIGatewayProxyRequest) (ev
 
     log.Printf("File found: %+v", file)
 
-    res, err := json.Marshal(file)
+    err = recordAudit(ctx, request, db.AuditPreview, "", file)
+    if err != nil {
+        log.Printf("Error recording audit entry: %v", err)
+        return utils.ResponseError(err)
+    }
+
+    // files whose content can't be handed out only show their metadata
+    thumbnails := file.Thumbnails
+    if !downloadable(file) {
+        thumbnails = nil
+    }
+
+    thumbnailURLs, err := presignThumbnails(ctx, thumbnails)
+    if err != nil {
+        log.Printf("Error presigning thumbnails: %v", err)
+        return utils.ResponseError(err)
+    }
+
+    cfg, err := config.LoadDefaultConfig(ctx)
+    if err != nil {
+        return utils.ResponseError(err)
+    }
+
+    // a file whose content can't be previewed is still returned with its metadata
+    preview, err := getFilePreview(ctx, s3.NewFromConfig(cfg), "chaosfiles-filestorage", file)
+    if err != nil {
+        log.Printf("Error building preview: %v", err)
+    }
+
+    res, err := json.Marshal(struct {
+        *db.File
+        ThumbnailURLs map[string]string `json:"thumbnailUrls,omitempty"`
+        Preview       *filePreview      `json:"preview,omitempty"`
+    }{file, thumbnailURLs, preview})
     if err != nil {
         log.Printf("Error marshalling response: %v", err)
         return utils.ResponseError(err)
@@ -54,4 +91,33 @@ func PreviewFile(ctx context.Context, request events.APIGatewayProxyRequest) (ev
         },
         Body: string(res),
     }, nil
-}
\ No newline at end of file
+}
+
+// presignThumbnails returns download URLs for a file's thumbnails, by size
+func presignThumbnails(ctx context.Context, thumbnails []db.Thumbnail) (map[string]string, error) {
+    if len(thumbnails) == 0 {
+        return nil, nil
+    }
+
+    cfg, err := config.LoadDefaultConfig(ctx)
+    if err != nil {
+        return nil, fmt.Errorf("unable to load SDK config, %v", err)
+    }
+
+    presignClient := s3.NewPresignClient(s3.NewFromConfig(cfg))
+
+    urls := make(map[string]string, len(thumbnails))
+    for _, thumbnail := range thumbnails {
+        presignedUrl, err := presignClient.PresignGetObject(ctx, &s3.GetObjectInput{
+            Bucket: aws.String("chaosfiles-filestorage"),
+            Key:    aws.String(thumbnail.Key),
+        }, s3.WithPresignExpires(time.Minute*15))
+        if err != nil {
+            return nil, err
+        }
+
+        urls[thumbnail.Size] = presignedUrl.URL
+    }
+
+    return urls, nil
+}
@@ -0,0 +1,380 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/johnnynu/agreatchaos/api/internal/db"
+)
+
+const (
+	previewText = "text"
+	previewCSV  = "csv"
+	previewTSV  = "tsv"
+	previewZip  = "zip"
+	previewTar  = "tar"
+	previewTgz  = "tar.gz"
+
+	// previewReadLimit is the ranged read text and table previews are built from
+	previewReadLimit = 64 * 1024
+	previewLines     = 50
+	previewRows      = 20
+	previewEntries   = 500
+	// archiveReadBudget caps what an archive listing may fetch of the object
+	archiveReadBudget = 16 * 1024 * 1024
+
+	// previewSequencerMetadata ties a cached preview to the upload it was built from
+	previewSequencerMetadata = "upload-sequencer"
+)
+
+// filePreview is a type-specific preview of a file's content
+type filePreview struct {
+	Kind      string         `json:"kind"`
+	Encoding  string         `json:"encoding,omitempty"`
+	Lines     []string       `json:"lines,omitempty"`
+	Header    []string       `json:"header,omitempty"`
+	Rows      [][]string     `json:"rows,omitempty"`
+	Entries   []archiveEntry `json:"entries,omitempty"`
+	Truncated bool           `json:"truncated"`
+}
+
+type archiveEntry struct {
+	Name           string `json:"name"`
+	Size           int64  `json:"size"`
+	CompressedSize int64  `json:"compressedSize,omitempty"`
+	Dir            bool   `json:"dir,omitempty"`
+	ModTime        string `json:"modTime,omitempty"`
+}
+
+var textExtensions = map[string]bool{
+	".txt": true, ".md": true, ".log": true, ".json": true, ".xml": true, ".yaml": true,
+	".yml": true, ".toml": true, ".ini": true, ".cfg": true, ".conf": true, ".html": true,
+	".css": true, ".js": true, ".ts": true, ".tsx": true, ".jsx": true, ".go": true,
+	".py": true, ".rb": true, ".rs": true, ".java": true, ".kt": true, ".c": true,
+	".h": true, ".cpp": true, ".hpp": true, ".cs": true, ".php": true, ".sh": true,
+	".sql": true, ".swift": true,
+}
+
+// previewKind picks the preview for a file from its name and declared type, or
+// returns an empty kind for files that have none
+func previewKind(file *db.File) string {
+	name := strings.ToLower(file.FileName)
+	fileType := strings.ToLower(file.FileType)
+
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return previewTgz
+	case strings.HasSuffix(name, ".tar"), fileType == "application/x-tar":
+		return previewTar
+	case strings.HasSuffix(name, ".zip"), fileType == "application/zip":
+		return previewZip
+	case strings.HasSuffix(name, ".csv"), fileType == "text/csv":
+		return previewCSV
+	case strings.HasSuffix(name, ".tsv"), fileType == "text/tab-separated-values":
+		return previewTSV
+	case textExtensions[path.Ext(name)], strings.HasPrefix(fileType, "text/"), fileType == "application/json":
+		return previewText
+	}
+
+	return ""
+}
+
+// getFilePreview returns the preview of a downloadable file, from the derived
+// object cache when it was already built for the current upload
+func getFilePreview(ctx context.Context, s3Client *s3.Client, bucket string, file *db.File) (*filePreview, error) {
+	kind := previewKind(file)
+	if kind == "" || !downloadable(file) || file.FileSize == 0 {
+		return nil, nil
+	}
+
+	key := file.ObjectKey()
+	cacheKey := derivedKey(key, "preview.json")
+
+	cached, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(cacheKey),
+	})
+	var noSuchKey *types.NoSuchKey
+	if err != nil && !errors.As(err, &noSuchKey) {
+		return nil, fmt.Errorf("error reading cached preview: %v", err)
+	}
+	if err == nil {
+		defer cached.Body.Close()
+		if cached.Metadata[previewSequencerMetadata] == file.UploadSequencer {
+			var preview filePreview
+			err = json.NewDecoder(cached.Body).Decode(&preview)
+			if err == nil {
+				return &preview, nil
+			}
+			log.Printf("Ignoring invalid cached preview %s: %v", cacheKey, err)
+		}
+	}
+
+	preview, err := buildPreview(ctx, s3Client, bucket, key, file.FileSize, kind)
+	if err != nil || preview == nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(preview)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(cacheKey),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+		Metadata:    map[string]string{previewSequencerMetadata: file.UploadSequencer},
+	})
+	if err != nil {
+		log.Printf("Error caching preview %s: %v", cacheKey, err)
+	}
+
+	return preview, nil
+}
+
+func buildPreview(ctx context.Context, s3Client *s3.Client, bucket, key string, size int64, kind string) (*filePreview, error) {
+	switch kind {
+	case previewZip:
+		return previewZipArchive(newObjectReader(ctx, s3Client, bucket, key, size, 256*1024, archiveReadBudget), size)
+	case previewTar:
+		return previewTarArchive(newObjectReader(ctx, s3Client, bucket, key, size, 16*1024, archiveReadBudget), size, false)
+	case previewTgz:
+		return previewTarArchive(newObjectReader(ctx, s3Client, bucket, key, size, 256*1024, archiveReadBudget), size, true)
+	}
+
+	limit := min(size, previewReadLimit)
+	data := make([]byte, limit)
+	_, err := newObjectReader(ctx, s3Client, bucket, key, size, limit, limit).ReadAt(data, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	text, encoding, ok := decodeText(data, limit < size)
+	if !ok {
+		return nil, nil
+	}
+	truncated := limit < size
+
+	if kind == previewText {
+		return previewTextLines(text, encoding, truncated), nil
+	}
+
+	return previewTable(text, encoding, kind, truncated), nil
+}
+
+// decodeText detects the encoding of the start of a file and decodes it. It
+// reports false for content that looks binary.
+func decodeText(data []byte, partial bool) (string, string, bool) {
+	switch {
+	case bytes.HasPrefix(data, []byte("\xef\xbb\xbf")):
+		data = data[3:]
+	case bytes.HasPrefix(data, []byte("\xff\xfe")), bytes.HasPrefix(data, []byte("\xfe\xff")):
+		bigEndian := data[0] == 0xfe
+		data = data[2:]
+		units := make([]uint16, len(data)/2)
+		for i := range units {
+			if bigEndian {
+				units[i] = uint16(data[2*i])<<8 | uint16(data[2*i+1])
+			} else {
+				units[i] = uint16(data[2*i+1])<<8 | uint16(data[2*i])
+			}
+		}
+		if bigEndian {
+			return string(utf16.Decode(units)), "utf-16be", true
+		}
+		return string(utf16.Decode(units)), "utf-16le", true
+	}
+
+	if bytes.IndexByte(data, 0) >= 0 {
+		return "", "", false
+	}
+
+	// a ranged read can end in the middle of a character
+	if partial {
+		for i := 0; i < utf8.UTFMax && len(data) > 0; i++ {
+			r, size := utf8.DecodeLastRune(data)
+			if r != utf8.RuneError || size != 1 {
+				break
+			}
+			data = data[:len(data)-1]
+		}
+	}
+
+	if utf8.Valid(data) {
+		return string(data), "utf-8", true
+	}
+
+	// every byte is a valid latin-1 character
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+
+	return string(runes), "iso-8859-1", true
+}
+
+func previewTextLines(text, encoding string, truncated bool) *filePreview {
+	lines := strings.SplitAfter(text, "\n")
+	// the last line of a partial read may be cut short
+	if truncated && len(lines) > 1 {
+		lines = lines[:len(lines)-1]
+	}
+
+	preview := &filePreview{Kind: previewText, Encoding: encoding, Truncated: truncated}
+	for _, line := range lines {
+		if len(preview.Lines) == previewLines {
+			preview.Truncated = true
+			break
+		}
+		if line == "" {
+			continue
+		}
+		preview.Lines = append(preview.Lines, strings.TrimRight(line, "\r\n"))
+	}
+
+	return preview
+}
+
+func previewTable(text, encoding, kind string, truncated bool) *filePreview {
+	// the last record of a partial read may be cut short
+	if truncated {
+		if i := strings.LastIndexByte(text, '\n'); i >= 0 {
+			text = text[:i+1]
+		}
+	}
+
+	r := csv.NewReader(strings.NewReader(text))
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	if kind == previewTSV {
+		r.Comma = '\t'
+	}
+
+	preview := &filePreview{Kind: kind, Encoding: encoding, Rows: [][]string{}, Truncated: truncated}
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// a malformed table still gets the rows read so far
+			preview.Truncated = true
+			break
+		}
+
+		if preview.Header == nil {
+			preview.Header = record
+			continue
+		}
+		if len(preview.Rows) == previewRows {
+			preview.Truncated = true
+			break
+		}
+		preview.Rows = append(preview.Rows, record)
+	}
+
+	return preview
+}
+
+// previewZipArchive lists a zip archive from its central directory, which is
+// read from the end of the object
+func previewZipArchive(r *objectReader, size int64) (*filePreview, error) {
+	archive, err := zip.NewReader(r, size)
+	if errors.Is(err, errReadBudget) {
+		return &filePreview{Kind: previewZip, Entries: []archiveEntry{}, Truncated: true}, nil
+	}
+	if err != nil {
+		log.Printf("Not previewing %s, invalid zip: %v", r.key, err)
+		return nil, nil
+	}
+
+	preview := &filePreview{Kind: previewZip, Entries: []archiveEntry{}}
+	for _, f := range archive.File {
+		if len(preview.Entries) == previewEntries {
+			preview.Truncated = true
+			break
+		}
+
+		preview.Entries = append(preview.Entries, archiveEntry{
+			Name:           f.Name,
+			Size:           int64(f.UncompressedSize64),
+			CompressedSize: int64(f.CompressedSize64),
+			Dir:            f.FileInfo().IsDir(),
+			ModTime:        f.Modified.UTC().Format(time.RFC3339),
+		})
+	}
+
+	return preview, nil
+}
+
+// previewTarArchive lists a tar archive by walking its headers. Plain tar
+// archives are seekable, so the entry contents are skipped without being read;
+// compressed ones are read up to the budget.
+func previewTarArchive(r *objectReader, size int64, compressed bool) (*filePreview, error) {
+	kind := previewTar
+	var src io.Reader = io.NewSectionReader(r, 0, size)
+	if compressed {
+		kind = previewTgz
+		gz, err := gzip.NewReader(src)
+		if err != nil {
+			log.Printf("Not previewing %s, invalid gzip: %v", r.key, err)
+			return nil, nil
+		}
+		defer gz.Close()
+		src = gz
+	}
+
+	preview := &filePreview{Kind: kind, Entries: []archiveEntry{}}
+	tr := tar.NewReader(src)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, errReadBudget) {
+			preview.Truncated = true
+			break
+		}
+		if err != nil {
+			if len(preview.Entries) == 0 {
+				log.Printf("Not previewing %s, invalid tar: %v", r.key, err)
+				return nil, nil
+			}
+			preview.Truncated = true
+			break
+		}
+
+		if len(preview.Entries) == previewEntries {
+			preview.Truncated = true
+			break
+		}
+
+		preview.Entries = append(preview.Entries, archiveEntry{
+			Name:    header.Name,
+			Size:    header.Size,
+			Dir:     header.Typeflag == tar.TypeDir,
+			ModTime: header.ModTime.UTC().Format(time.RFC3339),
+		})
+	}
+
+	return preview, nil
+}
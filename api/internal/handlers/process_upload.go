@@ -2,37 +2,327 @@ package handlers
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"net/url"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/google/uuid"
 	"github.com/johnnynu/agreatchaos/api/internal/db"
 )
 
+// sizeMismatchDelete is the SIZE_MISMATCH_ACTION that deletes objects whose
+// size differs from the declared FileSize, instead of only flagging the file
+const sizeMismatchDelete = "delete"
+
+// quarantinePrefix holds objects that showed up without any file metadata
+const quarantinePrefix = "quarantine/"
+
+// internalPrefixes are keys written by the backend itself, which are never uploads
+var internalPrefixes = []string{quarantinePrefix, derivedPrefix, tmpPrefix}
+
+// ProcessUpload records uploaded objects on their files. Each record is handled
+// on its own: a record that fails is sent to the dead letter table so that the
+// rest of the batch still goes through, and replays are safe because events
+// older than the one already recorded are skipped.
 func ProcessUpload(ctx context.Context, s3Event events.S3Event) error {
+    cfg, err := config.LoadDefaultConfig(ctx)
+    if err != nil {
+        log.Printf("Error loading SDK config: %v", err)
+        return err
+    }
+
+    s3Client := s3.NewFromConfig(cfg)
+
     for _, record := range s3Event.Records {
-        key := record.S3.Object.Key // fileID
-        size := record.S3.Object.Size
+        err := processUploadRecord(ctx, s3Client, record)
+        if err == nil {
+            continue
+        }
+
+        log.Printf("Error processing upload for %s: %v", record.S3.Object.Key, err)
 
-        // Fetch file metadata
-        file, err := db.GetFile(ctx, key)
+        // only fail the invocation if the record would otherwise be lost
+        err = deadLetterUpload(ctx, record, err)
         if err != nil {
-            log.Printf("Error fetching file metadata: %v", err)
+            log.Printf("Error writing dead letter: %v", err)
             return err
         }
+    }
 
-        // Update file metadata
+    return nil
+}
+
+func processUploadRecord(ctx context.Context, s3Client *s3.Client, record events.S3EventRecord) error {
+    if !strings.HasPrefix(record.EventName, "ObjectCreated:") {
+        log.Printf("Ignoring %s event", record.EventName)
+        return nil
+    }
+
+    // keys in S3 notifications are URL encoded, with spaces as '+'
+    key, err := url.QueryUnescape(record.S3.Object.Key)
+    if err != nil {
+        return fmt.Errorf("invalid object key %q: %v", record.S3.Object.Key, err)
+    }
+
+    for _, prefix := range internalPrefixes {
+        if strings.HasPrefix(key, prefix) {
+            log.Printf("Ignoring internal object: %s", key)
+            return nil
+        }
+    }
+
+    bucket := record.S3.Bucket.Name
+    size := record.S3.Object.Size
+
+    // Read back the checksum S3 verified on upload, if the client sent one
+    head, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+        Bucket:       aws.String(bucket),
+        Key:          aws.String(key),
+        ChecksumMode: types.ChecksumModeEnabled,
+    })
+    var notFound *types.NotFound
+    if errors.As(err, &notFound) {
+        log.Printf("Object %s no longer exists, skipping", key)
+        return nil
+    }
+    if err != nil {
+        return fmt.Errorf("error fetching object attributes: %v", err)
+    }
+
+    // Deduplicated content is shared by every file pointing at the blob
+    fileID := key
+    if blobID, ok := strings.CutPrefix(key, db.BlobKey("")); ok {
+        blob, err := db.GetBlob(ctx, blobID)
+        if err != nil {
+            return fmt.Errorf("error fetching blob metadata: %v", err)
+        }
+
+        // a blob that isn't the size it was acquired with never becomes
+        // available, so no other file is short-circuited onto it
+        if blob != nil && blob.Size != size {
+            log.Printf("Blob %s was acquired for %d bytes but %d were uploaded", blobID, blob.Size, size)
+        } else {
+            // files reusing the blob are checked against its type without reading it
+            detectedType, err := detectObjectType(ctx, s3Client, bucket, key, size)
+            if err != nil {
+                return err
+            }
+
+            err = db.MarkBlobAvailable(ctx, blobID, size, detectedType)
+            if err != nil {
+                return fmt.Errorf("error updating blob metadata: %v", err)
+            }
+
+            log.Printf("Successfully processed upload for blob: %s", blobID)
+        }
+
+        fileID = head.Metadata[blobFileIDMetadata]
+        if fileID == "" {
+            return nil
+        }
+    }
+
+    // Fetch file metadata
+    file, err := db.GetFile(ctx, fileID)
+    if err != nil {
+        return fmt.Errorf("error fetching file metadata: %v", err)
+    }
+
+    if file == nil {
+        if fileID != key {
+            // the file was deleted while its blob was uploading
+            log.Printf("File %s waiting on %s no longer exists", fileID, key)
+            return nil
+        }
+
+        log.Printf("No file metadata for %s, quarantining orphaned object", key)
+        return quarantineObject(ctx, s3Client, bucket, key)
+    }
+
+    sequencer := normalizeSequencer(record.S3.Object.Sequencer)
+    if file.UploadSequencer >= sequencer {
+        log.Printf("Skipping stale event %s for file %s", record.S3.Object.Sequencer, fileID)
+        return nil
+    }
+
+    // Update file metadata
+	file.UpdatedAt = time.Now().Format(time.RFC3339)
+    file.Status = db.FileStatusUploaded
+    file.UploadSequencer = sequencer
+    if head.ChecksumSHA256 != nil {
+        file.ChecksumSHA256 = *head.ChecksumSHA256
+    }
+
+    // Presigned PUTs don't bind Content-Length, so the object may not be what was declared
+    if size != file.FileSize {
+        log.Printf("File %s declared %d bytes but %d were uploaded", fileID, file.FileSize, size)
+        file.StatusReason = fmt.Sprintf("declared size %d does not match uploaded size %d", file.FileSize, size)
         file.FileSize = size
-		file.UpdatedAt = time.Now().Format(time.RFC3339)
+        file.Status = db.FileStatusFlagged
+
+        // blob objects are shared with other files, only the file is flagged
+        if os.Getenv("SIZE_MISMATCH_ACTION") == sizeMismatchDelete && file.BlobID == "" {
+            err = deleteFileFromS3(ctx, key)
+            if err != nil {
+                return fmt.Errorf("error deleting mismatched upload: %v", err)
+            }
+            file.Status = db.FileStatusFailed
+        }
+    }
 
-        err = db.UpdateFile(ctx, *file)
+    // The declared type is served on download, so it has to match the content
+    if file.Status == db.FileStatusUploaded {
+        err = checkContentType(ctx, s3Client, bucket, key, file)
         if err != nil {
-            log.Printf("Error updating file metadata: %v", err)
             return err
         }
+    }
+
+    // Nothing can download the file before it is recorded, so scan it first.
+    // Flagged files are served too, only failed ones have no content to scan.
+    if file.Status != db.FileStatusFailed && uploadScanner != nil {
+        err = scanObject(ctx, s3Client, uploadScanner, bucket, key, file)
+        if err != nil {
+            return err
+        }
+    }
 
-        log.Printf("Successfully processed upload for file: %s", key)
+    applied, err := db.RecordUpload(ctx, *file)
+    if err != nil {
+        return fmt.Errorf("error updating file metadata: %v", err)
+    }
+
+    if !applied {
+        log.Printf("Skipping stale event %s for file %s", record.S3.Object.Sequencer, fileID)
+        return nil
+    }
+
+    log.Printf("Successfully processed upload for file: %s", fileID)
+
+    // thumbnails are a convenience, an image that can't get them is still uploaded
+    if file.Status == db.FileStatusUploaded {
+        err = generateThumbnails(ctx, s3Client, bucket, key, file)
+        if err != nil {
+            log.Printf("Error generating thumbnails for file %s: %v", fileID, err)
+        }
+    }
+
+    return nil
+}
+
+// checkContentType sniffs the type of an uploaded object and applies the
+// CONTENT_TYPE_POLICY when it doesn't match the declared type
+func checkContentType(ctx context.Context, s3Client *s3.Client, bucket, key string, file *db.File) error {
+    if file.FileSize == 0 {
+        return nil
+    }
+
+    detected, err := detectObjectType(ctx, s3Client, bucket, key, file.FileSize)
+    if err != nil {
+        return err
+    }
+
+    // blob objects are shared with other files, only the file is failed
+    if applyContentTypePolicy(file, detected) && file.BlobID == "" {
+        err = deleteFileFromS3(ctx, key)
+        if err != nil {
+            return fmt.Errorf("error deleting mismatched upload: %v", err)
+        }
     }
 
     return nil
-}
\ No newline at end of file
+}
+
+// detectObjectType sniffs the type of an object from its first bytes. Empty
+// objects have no type.
+func detectObjectType(ctx context.Context, s3Client *s3.Client, bucket, key string, size int64) (string, error) {
+    if size == 0 {
+        return "", nil
+    }
+
+    obj, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+        Bucket: aws.String(bucket),
+        Key:    aws.String(key),
+        Range:  aws.String(fmt.Sprintf("bytes=0-%d", sniffLength-1)),
+    })
+    if err != nil {
+        return "", fmt.Errorf("error reading object to detect its type: %v", err)
+    }
+    defer obj.Body.Close()
+
+    head, err := io.ReadAll(io.LimitReader(obj.Body, sniffLength))
+    if err != nil {
+        return "", fmt.Errorf("error reading object to detect its type: %v", err)
+    }
+
+    return sniffContentType(head), nil
+}
+
+// normalizeSequencer left pads an S3 event sequencer so that sequencers for the
+// same key compare correctly as strings
+func normalizeSequencer(sequencer string) string {
+    const width = 32
+    if len(sequencer) >= width {
+        return sequencer
+    }
+
+    return strings.Repeat("0", width-len(sequencer)) + sequencer
+}
+
+// quarantineObject moves an object out of the way so it can be inspected later
+func quarantineObject(ctx context.Context, s3Client *s3.Client, bucket, key string) error {
+    _, err := s3Client.CopyObject(ctx, &s3.CopyObjectInput{
+        Bucket:     aws.String(bucket),
+        Key:        aws.String(quarantinePrefix + key),
+        CopySource: aws.String(copySource(bucket, key)),
+    })
+    if err != nil {
+        return fmt.Errorf("unable to quarantine %s, %v", key, err)
+    }
+
+    _, err = s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+        Bucket: aws.String(bucket),
+        Key:    aws.String(key),
+    })
+    if err != nil {
+        return fmt.Errorf("unable to delete quarantined %s, %v", key, err)
+    }
+
+    return nil
+}
+
+// copySource builds the URL encoded bucket/key CopySource S3 expects
+func copySource(bucket, key string) string {
+    segments := strings.Split(key, "/")
+    for i, segment := range segments {
+        segments[i] = url.PathEscape(segment)
+    }
+
+    return bucket + "/" + strings.Join(segments, "/")
+}
+
+func deadLetterUpload(ctx context.Context, record events.S3EventRecord, cause error) error {
+    payload, err := json.Marshal(record)
+    if err != nil {
+        return fmt.Errorf("failed to marshal S3 record: %v", err)
+    }
+
+    return db.CreateDeadLetter(ctx, db.DeadLetter{
+        DeadLetterID: uuid.New().String(),
+        Source:       "process_upload",
+        Payload:      string(payload),
+        Error:        cause.Error(),
+        CreatedAt:    time.Now().Format(time.RFC3339),
+    })
+}
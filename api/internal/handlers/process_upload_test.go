@@ -0,0 +1,29 @@
+package handlers
+
+import "testing"
+
+func TestNormalizeSequencer(t *testing.T) {
+	tests := []struct {
+		name           string
+		earlier, later string
+	}{
+		{name: "same length", earlier: "0055AED6DCD90281E5", later: "0055AED6DCD90281E6"},
+		// S3 sequencers grow in length, a plain string comparison puts "F" after "10"
+		{name: "longer later", earlier: "F", later: "10"},
+		{name: "carried into a new digit", earlier: "9FFFFFFFFFFFFFFF", later: "0100000000000000000"},
+		{name: "first event", earlier: "", later: "1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			earlier, later := normalizeSequencer(tt.earlier), normalizeSequencer(tt.later)
+			if earlier >= later {
+				t.Errorf("normalizeSequencer(%q) = %q, not before normalizeSequencer(%q) = %q", tt.earlier, earlier, tt.later, later)
+			}
+		})
+	}
+
+	if got := normalizeSequencer("0055AED6DCD90281E5"); normalizeSequencer(got) != got {
+		t.Errorf("normalizeSequencer(%q) changed an already normalized sequencer", got)
+	}
+}
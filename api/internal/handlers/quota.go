@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/johnnynu/agreatchaos/api/internal/db"
+)
+
+// errQuotaExceeded is returned when a write would take a user over their quota
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+// quotaRemaining returns how many more bytes a user may store. limited is false
+// for users without a quota. Usage is summed from the user's files rather than
+// read from StorageUsed, which is only as fresh as its last recompute.
+func quotaRemaining(ctx context.Context, userID string) (remaining int64, limited bool, err error) {
+	user, err := db.GetUser(ctx, userID)
+	if err != nil {
+		return 0, false, err
+	}
+	if user == nil {
+		return 0, false, fmt.Errorf("user %s not found", userID)
+	}
+	if user.StorageQuota == 0 {
+		return 0, false, nil
+	}
+
+	files, err := db.ListUserFiles(ctx, userID)
+	if err != nil {
+		return 0, false, err
+	}
+
+	// pending files count too, their uploads are already under way
+	var used int64
+	for _, file := range files {
+		used += file.FileSize
+	}
+
+	return max(user.StorageQuota-used, 0), true, nil
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+var errBlockedAddress = errors.New("address is not publicly routable")
+
+// sharedAddressSpace is the carrier-grade NAT range, which net.IP doesn't
+// count as private
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// allowedAddress decides which addresses requests to user supplied URLs, like
+// imports and webhooks, may connect to. Tests replace it to reach local servers.
+var allowedAddress = publicIP
+
+// publicIP reports whether ip is a publicly routable unicast address
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() ||
+		sharedAddressSpace.Contains(ip) || ip.Equal(net.IPv4bcast))
+}
+
+// checkHost rejects URL hosts given as IP addresses that aren't allowed. Names
+// are checked when they are dialed.
+func checkHost(host string) error {
+	if ip := net.ParseIP(host); ip != nil && !allowedAddress(ip) {
+		return errBlockedAddress
+	}
+
+	return nil
+}
+
+// safeTransport dials only addresses allowedAddress accepts. The check runs on
+// the address being dialed, so it also covers redirects and names that resolve
+// differently over time.
+func safeTransport(headerTimeout time.Duration) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !allowedAddress(ip) {
+				return fmt.Errorf("%s: %w", host, errBlockedAddress)
+			}
+			return nil
+		},
+	}
+
+	return &http.Transport{
+		// a proxy would do the dialing, and the address check with it
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: headerTimeout,
+	}
+}
@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/johnnynu/agreatchaos/api/internal/db"
+	"github.com/johnnynu/agreatchaos/api/internal/scan"
+	"github.com/johnnynu/agreatchaos/api/pkg/utils"
+)
+
+const (
+	// SCAN_ERROR_POLICY values, deciding what happens to files whose scan fails
+	scanErrorQuarantine = "quarantine" // hold the file until a rescan succeeds, the default
+	scanErrorAllow      = "allow"      // keep the file's status with an error scan status, it isn't served until a rescan succeeds
+)
+
+// uploadScanner scans uploads before they are recorded, nil when SCANNER isn't set
+var uploadScanner = scan.FromEnv()
+
+// scanObject scans the object at key and records the result on file, see
+// recordScanResult
+func scanObject(ctx context.Context, s3Client *s3.Client, scanner scan.Scanner, bucket, key string, file *db.File) error {
+	obj, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("error reading object to scan: %v", err)
+	}
+	defer obj.Body.Close()
+
+	result, err := scanner.Scan(ctx, obj.Body)
+	if err != nil {
+		log.Printf("Error scanning %s: %v", key, err)
+	}
+	recordScanResult(file, result, err)
+
+	// deduplicated files reuse the blob's scan instead of uploading it again
+	if file.BlobID != "" && file.ScanStatus != db.ScanError {
+		err = db.SetBlobScan(ctx, file.BlobID, file.ScanStatus, file.ScanSignature)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recordScanResult sets the scan fields and status of a file. Infected files
+// are quarantined, and a clean scan releases a quarantined file. A scan that
+// failed quarantines the file too, unless SCAN_ERROR_POLICY allows it, with an
+// error scan status admins can find and rescan.
+func recordScanResult(file *db.File, result scan.Result, scanErr error) {
+	file.ScannedAt = time.Now().UTC().Format(time.RFC3339)
+	file.ScanEngine = result.Engine
+	file.ScanSignature = result.Signature
+
+	switch {
+	case scanErr != nil:
+		file.ScanStatus = db.ScanError
+		if os.Getenv("SCAN_ERROR_POLICY") != scanErrorAllow {
+			file.Status = db.FileStatusQuarantined
+			file.StatusReason = "malware scan failed"
+		}
+	case result.Infected:
+		log.Printf("File %s is infected with %s", file.FileID, result.Signature)
+		file.ScanStatus = db.ScanInfected
+		file.Status = db.FileStatusQuarantined
+		file.StatusReason = "malware detected: " + result.Signature
+	default:
+		file.ScanStatus = db.ScanClean
+		if file.Status == db.FileStatusQuarantined {
+			file.Status = db.FileStatusUploaded
+			file.StatusReason = ""
+		}
+	}
+}
+
+// RescanFile scans a file again and updates its quarantine status, along with
+// that of the files sharing its blob. Only admins may call it.
+func RescanFile(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if !isAdmin(request) {
+		return events.APIGatewayProxyResponse{StatusCode: 403, Body: "admin access required"}, nil
+	}
+
+	if uploadScanner == nil {
+		return utils.ResponseError(errors.New("malware scanning is not configured"))
+	}
+
+	fileID := request.PathParameters["fileId"]
+	if fileID == "" {
+		return utils.ResponseError(errors.New("fileID is required"))
+	}
+
+	file, err := db.GetFile(ctx, fileID)
+	if err != nil {
+		return utils.ResponseError(err)
+	}
+	if file == nil {
+		return utils.ResponseError(utils.ErrNotFound)
+	}
+
+	if file.Status == db.FileStatusPending || file.Status == db.FileStatusFailed {
+		return events.APIGatewayProxyResponse{StatusCode: 400, Body: fmt.Sprintf("file is %s", file.Status)}, nil
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return utils.ResponseError(err)
+	}
+
+	err = scanObject(ctx, s3.NewFromConfig(cfg), uploadScanner, "chaosfiles-filestorage", file.ObjectKey(), file)
+	if err != nil {
+		log.Printf("Error rescanning file %s: %v", fileID, err)
+		return utils.ResponseError(err)
+	}
+
+	file.UpdatedAt = time.Now().Format(time.RFC3339)
+	err = db.RecordScan(ctx, *file)
+	if err != nil {
+		log.Printf("Error recording scan: %v", err)
+		return utils.ResponseError(err)
+	}
+
+	if file.BlobID != "" && file.ScanStatus != db.ScanError {
+		err = recordBlobFilesScan(ctx, *file)
+		if err != nil {
+			log.Printf("Error recording scan of blob %s: %v", file.BlobID, err)
+			return utils.ResponseError(err)
+		}
+	}
+
+	return utils.ResponseOK(map[string]string{
+		"fileId":        file.FileID,
+		"status":        file.Status,
+		"scanStatus":    file.ScanStatus,
+		"scanSignature": file.ScanSignature,
+		"scanEngine":    file.ScanEngine,
+		"scannedAt":     file.ScannedAt,
+	})
+}
+
+// recordBlobFilesScan applies the scan of a deduplicated file to every other
+// file sharing its blob, since they all serve the same content
+func recordBlobFilesScan(ctx context.Context, scanned db.File) error {
+	files, err := db.ListBlobFiles(ctx, scanned.UserID, scanned.BlobID)
+	if err != nil {
+		return err
+	}
+
+	result := scan.Result{
+		Infected:  scanned.ScanStatus == db.ScanInfected,
+		Signature: scanned.ScanSignature,
+		Engine:    scanned.ScanEngine,
+	}
+
+	for _, file := range files {
+		if file.FileID == scanned.FileID || file.Status == db.FileStatusPending || file.Status == db.FileStatusFailed {
+			continue
+		}
+
+		recordScanResult(&file, result, nil)
+		file.UpdatedAt = scanned.UpdatedAt
+		err = db.RecordScan(ctx, file)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isAdmin reports whether the caller is in the Cognito group named by
+// ADMIN_GROUP, "admins" by default
+func isAdmin(request events.APIGatewayProxyRequest) bool {
+	group := os.Getenv("ADMIN_GROUP")
+	if group == "" {
+		group = "admins"
+	}
+
+	jwt, ok := request.RequestContext.Authorizer["jwt"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	claims, ok := jwt["claims"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+
+	// HTTP API authorizers pass the groups as a string like "[admins editors]"
+	var groups []string
+	switch v := claims["cognito:groups"].(type) {
+	case string:
+		groups = strings.Fields(strings.Trim(v, "[]"))
+	case []interface{}:
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+	}
+
+	for _, g := range groups {
+		if strings.Trim(g, `",`) == group {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/johnnynu/agreatchaos/api/internal/db"
+	"github.com/johnnynu/agreatchaos/api/internal/scan"
+)
+
+// eicar is the standard antivirus test string, which scan.Fake detects
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// failingScanner stands in for a scanner that can't be reached
+type failingScanner struct{}
+
+func (failingScanner) Scan(ctx context.Context, r io.Reader) (scan.Result, error) {
+	return scan.Result{}, errors.New("connection refused")
+}
+
+func TestRecordScanResult(t *testing.T) {
+	tests := []struct {
+		name          string
+		scanner       scan.Scanner
+		content       string
+		policy        string
+		status        string
+		wantStatus    string
+		wantScan      string
+		wantSignature string
+	}{
+		{
+			name:       "clean upload",
+			scanner:    scan.Fake{},
+			content:    "hello",
+			status:     db.FileStatusUploaded,
+			wantStatus: db.FileStatusUploaded,
+			wantScan:   db.ScanClean,
+		},
+		{
+			name:          "infected upload is quarantined",
+			scanner:       scan.Fake{},
+			content:       "prefix " + eicar,
+			status:        db.FileStatusUploaded,
+			wantStatus:    db.FileStatusQuarantined,
+			wantScan:      db.ScanInfected,
+			wantSignature: "Eicar-Test-Signature",
+		},
+		{
+			name:       "clean rescan releases a quarantined file",
+			scanner:    scan.Fake{},
+			content:    "hello",
+			status:     db.FileStatusQuarantined,
+			wantStatus: db.FileStatusUploaded,
+			wantScan:   db.ScanClean,
+		},
+		{
+			name:       "clean scan keeps a flagged file flagged",
+			scanner:    scan.Fake{},
+			content:    "hello",
+			status:     db.FileStatusFlagged,
+			wantStatus: db.FileStatusFlagged,
+			wantScan:   db.ScanClean,
+		},
+		{
+			name:       "failed scan quarantines by default",
+			scanner:    failingScanner{},
+			status:     db.FileStatusUploaded,
+			wantStatus: db.FileStatusQuarantined,
+			wantScan:   db.ScanError,
+		},
+		{
+			name:       "failed scan is allowed by policy",
+			scanner:    failingScanner{},
+			policy:     scanErrorAllow,
+			status:     db.FileStatusUploaded,
+			wantStatus: db.FileStatusUploaded,
+			wantScan:   db.ScanError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SCAN_ERROR_POLICY", tt.policy)
+
+			file := db.File{FileID: "f1", Status: tt.status}
+			result, err := tt.scanner.Scan(context.Background(), strings.NewReader(tt.content))
+			recordScanResult(&file, result, err)
+
+			if file.Status != tt.wantStatus || file.ScanStatus != tt.wantScan || file.ScanSignature != tt.wantSignature {
+				t.Errorf("got status %q, scan %q, signature %q, want %q, %q, %q",
+					file.Status, file.ScanStatus, file.ScanSignature, tt.wantStatus, tt.wantScan, tt.wantSignature)
+			}
+			if file.ScannedAt == "" {
+				t.Error("ScannedAt not set")
+			}
+			if file.Status == db.FileStatusQuarantined && file.StatusReason == "" {
+				t.Error("quarantined without a reason")
+			}
+		})
+	}
+}
+
+func TestDownloadable(t *testing.T) {
+	tests := []struct {
+		name    string
+		scanner scan.Scanner
+		file    db.File
+		want    bool
+	}{
+		{name: "uploaded without a scanner", file: db.File{Status: db.FileStatusUploaded}, want: true},
+		{name: "legacy file without a scanner", file: db.File{}, want: true},
+		{name: "quarantined", file: db.File{Status: db.FileStatusQuarantined}},
+		{name: "pending", file: db.File{Status: db.FileStatusPending}},
+		{name: "clean", scanner: scan.Fake{}, file: db.File{Status: db.FileStatusUploaded, ScanStatus: db.ScanClean}, want: true},
+		{name: "flagged and clean", scanner: scan.Fake{}, file: db.File{Status: db.FileStatusFlagged, ScanStatus: db.ScanClean}, want: true},
+		{name: "flagged and never scanned", scanner: scan.Fake{}, file: db.File{Status: db.FileStatusFlagged}},
+		{name: "legacy file never scanned", scanner: scan.Fake{}, file: db.File{}},
+		{name: "scan failed", scanner: scan.Fake{}, file: db.File{Status: db.FileStatusUploaded, ScanStatus: db.ScanError}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := uploadScanner
+			uploadScanner = tt.scanner
+			t.Cleanup(func() { uploadScanner = saved })
+
+			if got := downloadable(&tt.file); got != tt.want {
+				t.Errorf("downloadable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -84,6 +84,11 @@ func SigninUser(ctx context.Context, request events.APIGatewayProxyRequest) (eve
 		log.Println("Existing user signed in")
 	}
 
+	err = recordAudit(ctx, request, db.AuditSignin, uid, nil)
+	if err != nil {
+		log.Printf("Error recording audit entry: %v", err)
+	}
+
 	res := struct {
 		Message   string `json:"message"`
 		IsNewUser bool   `json:"isNewUser"`
@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/johnnynu/agreatchaos/api/internal/db"
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+)
+
+// derivedPrefix holds objects generated from uploads, such as thumbnails
+const derivedPrefix = "derived/"
+
+const (
+	// maxThumbnailSourceSize and maxThumbnailPixels bound the memory used to
+	// decode an image, images above either limit get no thumbnails
+	maxThumbnailSourceSize = 50 * 1024 * 1024
+	maxThumbnailPixels     = 50 * 1000 * 1000
+	thumbnailQuality       = 80
+)
+
+// thumbnailSizes are the longest edges of the generated thumbnails, by name
+var thumbnailSizes = []struct {
+	name string
+	edge int
+}{
+	{"small", 128},
+	{"medium", 512},
+	{"large", 1024},
+}
+
+// thumbnailFormats are the image formats thumbnails are generated for
+var thumbnailFormats = map[string]func(io.Reader) (image.Image, error){
+	"jpeg": jpeg.Decode,
+	"png":  png.Decode,
+	"gif":  gif.Decode,
+	"webp": webp.Decode,
+}
+
+var thumbnailConfigs = map[string]func(io.Reader) (image.Config, error){
+	"jpeg": jpeg.DecodeConfig,
+	"png":  png.DecodeConfig,
+	"gif":  gif.DecodeConfig,
+	"webp": webp.DecodeConfig,
+}
+
+// derivedKey returns the key of an object derived from the object at key
+func derivedKey(key, name string) string {
+	return derivedPrefix + key + "/" + name
+}
+
+// generateThumbnails writes the thumbnails of an uploaded image and records
+// them on its file, and on its blob for the files that reuse it later. Objects
+// that aren't supported images are left alone.
+func generateThumbnails(ctx context.Context, s3Client *s3.Client, bucket, key string, file *db.File) error {
+	if file.FileSize > maxThumbnailSourceSize {
+		return nil
+	}
+
+	obj, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("error reading image: %v", err)
+	}
+	defer obj.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(obj.Body, maxThumbnailSourceSize+1))
+	if err != nil {
+		return fmt.Errorf("error reading image: %v", err)
+	}
+	if len(data) > maxThumbnailSourceSize {
+		return nil
+	}
+
+	// detect the format from the content, the declared type can't be trusted
+	format := imageFormat(data)
+	if format == "" {
+		return nil
+	}
+
+	cfg, err := thumbnailConfigs[format](bytes.NewReader(data))
+	if err != nil {
+		log.Printf("Not generating thumbnails for %s, invalid %s: %v", file.FileID, format, err)
+		return nil
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxThumbnailPixels {
+		log.Printf("Not generating thumbnails for %s, %dx%d pixels", file.FileID, cfg.Width, cfg.Height)
+		return nil
+	}
+
+	img, err := thumbnailFormats[format](bytes.NewReader(data))
+	if err != nil {
+		log.Printf("Not generating thumbnails for %s, invalid %s: %v", file.FileID, format, err)
+		return nil
+	}
+
+	var thumbnails []db.Thumbnail
+	longest := max(cfg.Width, cfg.Height)
+	for i, size := range thumbnailSizes {
+		// never scale up, but images smaller than every size still get one thumbnail
+		if size.edge > longest && i > 0 {
+			break
+		}
+
+		thumb := scaleImage(img, size.edge)
+
+		var buf bytes.Buffer
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: thumbnailQuality})
+		if err != nil {
+			return fmt.Errorf("error encoding thumbnail: %v", err)
+		}
+
+		thumbKey := derivedKey(key, "thumb_"+size.name+".jpg")
+		_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(bucket),
+			Key:         aws.String(thumbKey),
+			Body:        bytes.NewReader(buf.Bytes()),
+			ContentType: aws.String("image/jpeg"),
+		})
+		if err != nil {
+			return fmt.Errorf("error storing thumbnail: %v", err)
+		}
+
+		bounds := thumb.Bounds()
+		thumbnails = append(thumbnails, db.Thumbnail{
+			Size:   size.name,
+			Key:    thumbKey,
+			Width:  bounds.Dx(),
+			Height: bounds.Dy(),
+		})
+	}
+
+	if file.BlobID != "" {
+		err = db.SetBlobThumbnails(ctx, file.BlobID, thumbnails)
+		if err != nil {
+			return err
+		}
+	}
+
+	return db.SetFileThumbnails(ctx, file.FileID, thumbnails)
+}
+
+// imageFormat returns the thumbnail format of an image from its magic bytes
+func imageFormat(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("\xff\xd8\xff")):
+		return "jpeg"
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return "png"
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return "gif"
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return "webp"
+	}
+
+	return ""
+}
+
+// scaleImage scales img so that its longest edge is at most edge pixels,
+// flattening transparency onto white since thumbnails are JPEGs
+func scaleImage(img image.Image, edge int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > edge || height > edge {
+		if width >= height {
+			width, height = edge, max(1, height*edge/width)
+		} else {
+			width, height = max(1, width*edge/height), edge
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Over, nil)
+
+	return dst
+}
+
+// deleteDerivedObjects removes every object derived from the object at key
+func deleteDerivedObjects(ctx context.Context, s3Client *s3.Client, bucket, key string) error {
+	paginator := s3.NewListObjectsV2Paginator(s3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(derivedKey(key, "")),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("error listing derived objects: %v", err)
+		}
+
+		for _, obj := range page.Contents {
+			if !strings.HasPrefix(aws.ToString(obj.Key), derivedPrefix) {
+				continue
+			}
+
+			_, err = s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    obj.Key,
+			})
+			if err != nil {
+				return fmt.Errorf("error deleting derived object %s: %v", aws.ToString(obj.Key), err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/johnnynu/agreatchaos/api/internal/db"
+	"github.com/johnnynu/agreatchaos/api/internal/domain"
+)
+
+const (
+	webhookTimeout         = 10 * time.Second
+	webhookMaxAttempts     = 8
+	webhookDisableAfter    = 20 // consecutive failed attempts across deliveries
+	webhookBaseDelay       = 30 * time.Second
+	webhookMaxDelay        = 6 * time.Hour
+	webhookDeliveryBatch   = 100
+	webhookSignatureHeader = "X-ChaosFiles-Signature"
+	webhookTimestampHeader = "X-ChaosFiles-Timestamp"
+	// webhookClaimLease is how long a sender holds a delivery for one attempt
+	// before the scheduled retries may take it over
+	webhookClaimLease = 2 * webhookTimeout
+)
+
+var webhookClient = &http.Client{
+	Transport: safeTransport(webhookTimeout),
+	Timeout:   webhookTimeout,
+	// a redirect could point the signed payload anywhere
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func init() {
+	StreamDispatcher.Subscribe(deliverWebhooks)
+}
+
+// deliverWebhooks creates a delivery of a file event for every matching
+// webhook and makes the first attempts, all at once so the stream isn't held up
+// for longer than one webhookTimeout. Failed attempts are retried by
+// ProcessWebhookDeliveries.
+func deliverWebhooks(ctx context.Context, event domain.Event) error {
+	msg, ok := fileNotification(event)
+	if !ok {
+		return nil
+	}
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook payload: %v", err)
+	}
+
+	var attempts []db.Webhook
+	var deliveries []db.WebhookDelivery
+	for _, userID := range notificationRecipients(msg.File) {
+		webhooks, err := db.ListUserWebhooks(ctx, userID)
+		if err != nil {
+			return err
+		}
+
+		for _, webhook := range webhooks {
+			if webhook.Disabled || !webhook.Subscribed(msg.Type) {
+				continue
+			}
+
+			// created already claimed by this sender, the scheduled retries only
+			// pick it up if the first attempt never gets recorded
+			now := time.Now()
+			delivery := db.WebhookDelivery{
+				DeliveryID:    msg.EventID + "/" + webhook.WebhookID,
+				WebhookID:     webhook.WebhookID,
+				EventType:     msg.Type,
+				Payload:       string(payload),
+				Status:        db.DeliveryPending,
+				NextAttemptAt: now.Add(webhookClaimLease).UTC().Format(time.RFC3339),
+				CreatedAt:     now.UTC().Format(time.RFC3339),
+				UpdatedAt:     now.UTC().Format(time.RFC3339),
+			}
+
+			created, err := db.CreateWebhookDelivery(ctx, delivery)
+			if err != nil {
+				return err
+			}
+			if !created {
+				// the record was redelivered, the first delivery carries on from here
+				continue
+			}
+
+			attempts = append(attempts, webhook)
+			deliveries = append(deliveries, delivery)
+		}
+	}
+
+	forEachBounded(len(deliveries), maxWebhooksPerUser, func(i int) {
+		err := attemptWebhookDelivery(ctx, &attempts[i], deliveries[i])
+		if err != nil {
+			log.Printf("Error recording webhook delivery %s: %v", deliveries[i].DeliveryID, err)
+		}
+	})
+
+	return nil
+}
+
+// ProcessWebhookDeliveries retries the pending deliveries that are due. It runs on a schedule.
+func ProcessWebhookDeliveries(ctx context.Context, event events.CloudWatchEvent) error {
+	deliveries, err := db.ListDueWebhookDeliveries(ctx, time.Now(), webhookDeliveryBatch)
+	if err != nil {
+		log.Printf("Error listing webhook deliveries: %v", err)
+		return err
+	}
+
+	log.Printf("Retrying %d webhook deliveries", len(deliveries))
+
+	for _, delivery := range deliveries {
+		claimed, err := db.ClaimWebhookDelivery(ctx, delivery, time.Now().Add(webhookClaimLease))
+		if err != nil {
+			log.Printf("Error claiming webhook delivery %s: %v", delivery.DeliveryID, err)
+			continue
+		}
+		if !claimed {
+			// another run or the stream got to it first
+			continue
+		}
+
+		// read the webhook for every attempt, an earlier one may have disabled it
+		webhook, err := db.GetWebhook(ctx, delivery.WebhookID)
+		if err != nil {
+			log.Printf("Error getting webhook %s: %v", delivery.WebhookID, err)
+			continue
+		}
+
+		err = attemptWebhookDelivery(ctx, webhook, delivery)
+		if err != nil {
+			log.Printf("Error recording webhook delivery %s: %v", delivery.DeliveryID, err)
+		}
+	}
+
+	return nil
+}
+
+// attemptWebhookDelivery sends a claimed delivery once and records the
+// outcome. The returned error is about recording it, failed sends are scheduled
+// for retry.
+func attemptWebhookDelivery(ctx context.Context, webhook *db.Webhook, delivery db.WebhookDelivery) error {
+	now := time.Now()
+
+	if webhook == nil || webhook.Disabled {
+		recordDeliveryAttempt(&delivery, now, delivery.LastStatusCode, errors.New("webhook deleted or disabled"), true)
+		return db.UpdateWebhookDelivery(ctx, delivery)
+	}
+
+	delivery.Attempts++
+	statusCode, sendErr := sendWebhook(ctx, *webhook, delivery, now)
+
+	disabled := false
+	if sendErr == nil {
+		err := db.RecordWebhookSuccess(ctx, webhook.WebhookID)
+		if err != nil {
+			log.Printf("Error resetting webhook %s failures: %v", webhook.WebhookID, err)
+		}
+	} else {
+		log.Printf("Webhook delivery %s failed on attempt %d: %v", delivery.DeliveryID, delivery.Attempts, sendErr)
+
+		var err error
+		disabled, err = db.RecordWebhookFailure(ctx, webhook.WebhookID, webhookDisableAfter)
+		if err != nil {
+			log.Printf("Error counting webhook %s failure: %v", webhook.WebhookID, err)
+		}
+		if disabled {
+			log.Printf("Webhook %s is disabled", webhook.WebhookID)
+		}
+	}
+
+	recordDeliveryAttempt(&delivery, now, statusCode, sendErr, disabled)
+	return db.UpdateWebhookDelivery(ctx, delivery)
+}
+
+// recordDeliveryAttempt sets a delivery's status after an attempt made at now:
+// delivered, retried after a backoff, or failed for good once the webhook is
+// disabled or the attempts run out
+func recordDeliveryAttempt(delivery *db.WebhookDelivery, now time.Time, statusCode int, sendErr error, disabled bool) {
+	delivery.UpdatedAt = now.UTC().Format(time.RFC3339)
+	delivery.LastStatusCode = statusCode
+
+	switch {
+	case sendErr == nil:
+		delivery.Status = db.DeliveryDelivered
+		delivery.NextAttemptAt = ""
+		delivery.LastError = ""
+	case disabled || delivery.Attempts >= webhookMaxAttempts:
+		delivery.Status = db.DeliveryFailed
+		delivery.NextAttemptAt = ""
+		delivery.LastError = sendErr.Error()
+	default:
+		delivery.NextAttemptAt = now.Add(webhookBackoff(delivery.Attempts - 1)).UTC().Format(time.RFC3339)
+		delivery.LastError = sendErr.Error()
+	}
+}
+
+// sendWebhook posts a delivery's payload. The signature is the hex HMAC-SHA256
+// of "<timestamp>.<body>" keyed with the webhook secret, so receivers can reject
+// replayed deliveries by their timestamp.
+func sendWebhook(ctx context.Context, webhook db.Webhook, delivery db.WebhookDelivery, now time.Time) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader([]byte(delivery.Payload)))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	signature := hmacSHA256([]byte(webhook.Secret), timestamp+"."+delivery.Payload)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ChaosFiles-Webhooks/1.0")
+	req.Header.Set("X-ChaosFiles-Event", delivery.EventType)
+	req.Header.Set("X-ChaosFiles-Delivery", delivery.DeliveryID)
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(signature))
+
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return res.StatusCode, fmt.Errorf("endpoint responded with %s: %s", res.Status, body)
+	}
+
+	return res.StatusCode, nil
+}
+
+// webhookBackoff doubles the delay with every failed attempt
+func webhookBackoff(attempts int) time.Duration {
+	delay := float64(webhookBaseDelay) * math.Pow(2, float64(attempts))
+	if delay > float64(webhookMaxDelay) {
+		return webhookMaxDelay
+	}
+
+	return time.Duration(delay)
+}
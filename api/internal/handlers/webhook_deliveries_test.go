@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/johnnynu/agreatchaos/api/internal/db"
+)
+
+// allowLocalAddresses lets the safe transports reach httptest servers for the
+// duration of a test
+func allowLocalAddresses(t *testing.T) {
+	allowedAddress = func(net.IP) bool { return true }
+	t.Cleanup(func() { allowedAddress = publicIP })
+}
+
+func TestSendWebhookSignature(t *testing.T) {
+	allowLocalAddresses(t)
+
+	webhook := db.Webhook{WebhookID: "wh-1", Secret: "whsec_test"}
+	delivery := db.WebhookDelivery{DeliveryID: "evt-1/wh-1", EventType: "file.created", Payload: `{"type":"file.created"}`}
+	now := time.Unix(1700000000, 0)
+
+	var got *http.Request
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+	webhook.URL = server.URL
+
+	statusCode, err := sendWebhook(context.Background(), webhook, delivery, now)
+	if err != nil || statusCode != http.StatusOK {
+		t.Fatalf("sendWebhook() = %d, %v", statusCode, err)
+	}
+
+	if string(body) != delivery.Payload {
+		t.Errorf("body = %s, want %s", body, delivery.Payload)
+	}
+
+	timestamp := got.Header.Get(webhookTimestampHeader)
+	if timestamp != strconv.FormatInt(now.Unix(), 10) {
+		t.Errorf("timestamp = %q, want %d", timestamp, now.Unix())
+	}
+
+	// verify the signature the way a receiver would
+	mac := hmac.New(sha256.New, []byte(webhook.Secret))
+	mac.Write([]byte(timestamp + "." + string(body)))
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if signature := got.Header.Get(webhookSignatureHeader); !hmac.Equal([]byte(signature), []byte(want)) {
+		t.Errorf("signature = %q, want %q", signature, want)
+	}
+
+	if event := got.Header.Get("X-ChaosFiles-Event"); event != delivery.EventType {
+		t.Errorf("event header = %q, want %q", event, delivery.EventType)
+	}
+	if id := got.Header.Get("X-ChaosFiles-Delivery"); id != delivery.DeliveryID {
+		t.Errorf("delivery header = %q, want %q", id, delivery.DeliveryID)
+	}
+}
+
+func TestSendWebhookFailures(t *testing.T) {
+	allowLocalAddresses(t)
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		want    int
+	}{
+		{
+			name:    "server error",
+			handler: func(w http.ResponseWriter, r *http.Request) { http.Error(w, "boom", http.StatusInternalServerError) },
+			want:    http.StatusInternalServerError,
+		},
+		{
+			name:    "redirects aren't followed",
+			handler: func(w http.ResponseWriter, r *http.Request) { http.Redirect(w, r, "/elsewhere", http.StatusFound) },
+			want:    http.StatusFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(tt.handler)
+			defer server.Close()
+
+			statusCode, err := sendWebhook(context.Background(), db.Webhook{URL: server.URL}, db.WebhookDelivery{Payload: "{}"}, time.Now())
+			if err == nil || statusCode != tt.want {
+				t.Errorf("sendWebhook() = %d, %v, want %d and an error", statusCode, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendWebhookBlocksPrivateAddresses(t *testing.T) {
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer server.Close()
+
+	_, err := sendWebhook(context.Background(), db.Webhook{URL: server.URL}, db.WebhookDelivery{Payload: "{}"}, time.Now())
+	if !errors.Is(err, errBlockedAddress) {
+		t.Errorf("sendWebhook() error = %v, want errBlockedAddress", err)
+	}
+	if called {
+		t.Error("the loopback server was reached")
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, 30 * time.Second},
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{5, 16 * time.Minute},
+		{9, 256 * time.Minute},
+		{10, webhookMaxDelay},
+		{40, webhookMaxDelay},
+	}
+
+	for _, tt := range tests {
+		if got := webhookBackoff(tt.attempts); got != tt.want {
+			t.Errorf("webhookBackoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestRecordDeliveryAttempt(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	failed := errors.New("endpoint responded with 500")
+
+	tests := []struct {
+		name          string
+		attempts      int
+		sendErr       error
+		disabled      bool
+		wantStatus    string
+		wantNext      string
+		wantLastError string
+	}{
+		{
+			name:       "delivered",
+			attempts:   3,
+			wantStatus: db.DeliveryDelivered,
+		},
+		{
+			name:          "first failure is retried after the base delay",
+			attempts:      1,
+			sendErr:       failed,
+			wantStatus:    db.DeliveryPending,
+			wantNext:      "2024-01-01T12:00:30Z",
+			wantLastError: failed.Error(),
+		},
+		{
+			name:          "later failures back off",
+			attempts:      4,
+			sendErr:       failed,
+			wantStatus:    db.DeliveryPending,
+			wantNext:      "2024-01-01T12:04:00Z",
+			wantLastError: failed.Error(),
+		},
+		{
+			name:          "last attempt fails the delivery",
+			attempts:      webhookMaxAttempts,
+			sendErr:       failed,
+			wantStatus:    db.DeliveryFailed,
+			wantLastError: failed.Error(),
+		},
+		{
+			name:          "disabled webhook fails the delivery",
+			attempts:      1,
+			sendErr:       failed,
+			disabled:      true,
+			wantStatus:    db.DeliveryFailed,
+			wantLastError: failed.Error(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delivery := db.WebhookDelivery{
+				Status:        db.DeliveryPending,
+				Attempts:      tt.attempts,
+				NextAttemptAt: "2024-01-01T12:00:20Z",
+				LastError:     "earlier failure",
+			}
+
+			recordDeliveryAttempt(&delivery, now, 500, tt.sendErr, tt.disabled)
+
+			if delivery.Status != tt.wantStatus || delivery.NextAttemptAt != tt.wantNext || delivery.LastError != tt.wantLastError {
+				t.Errorf("got status %q, next attempt %q, error %q, want %q, %q, %q",
+					delivery.Status, delivery.NextAttemptAt, delivery.LastError, tt.wantStatus, tt.wantNext, tt.wantLastError)
+			}
+		})
+	}
+}
+
+func TestValidateWebhook(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     CreateWebhookRequest
+		wantErr bool
+	}{
+		{name: "https", req: CreateWebhookRequest{URL: "https://hooks.example.com/chaos", Events: []string{"file.created"}}},
+		{name: "plain http", req: CreateWebhookRequest{URL: "http://hooks.example.com/chaos"}, wantErr: true},
+		{name: "relative", req: CreateWebhookRequest{URL: "/chaos"}, wantErr: true},
+		{name: "loopback", req: CreateWebhookRequest{URL: "https://127.0.0.1/chaos"}, wantErr: true},
+		{name: "instance metadata", req: CreateWebhookRequest{URL: "https://169.254.169.254/latest"}, wantErr: true},
+		{name: "private", req: CreateWebhookRequest{URL: "https://10.0.0.8/chaos"}, wantErr: true},
+		{name: "unknown event", req: CreateWebhookRequest{URL: "https://hooks.example.com/chaos", Events: []string{"file.exploded"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateWebhook(tt.req); (err != nil) != tt.wantErr {
+				t.Errorf("validateWebhook() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/uuid"
+	"github.com/johnnynu/agreatchaos/api/internal/db"
+	"github.com/johnnynu/agreatchaos/api/pkg/utils"
+)
+
+const maxWebhooksPerUser = 10
+
+type CreateWebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+// CreateWebhook registers a webhook for the caller. The signing secret is only
+// returned here.
+func CreateWebhook(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := jwtSubject(request)
+	if userID == "" {
+		log.Println("Unable to extract user ID from JWT claims")
+		return utils.ResponseError(fmt.Errorf("unable to extract user ID from JWT claims"))
+	}
+
+	var req CreateWebhookRequest
+	err := json.Unmarshal([]byte(request.Body), &req)
+	if err != nil {
+		return events.APIGatewayProxyResponse{StatusCode: 400, Body: "invalid request body"}, nil
+	}
+
+	err = validateWebhook(req)
+	if err != nil {
+		return events.APIGatewayProxyResponse{StatusCode: 400, Body: err.Error()}, nil
+	}
+
+	existing, err := db.ListUserWebhooks(ctx, userID)
+	if err != nil {
+		return utils.ResponseError(err)
+	}
+	if len(existing) >= maxWebhooksPerUser {
+		return events.APIGatewayProxyResponse{StatusCode: 400, Body: fmt.Sprintf("at most %d webhooks can be registered", maxWebhooksPerUser)}, nil
+	}
+
+	secret := make([]byte, 32)
+	_, err = rand.Read(secret)
+	if err != nil {
+		return utils.ResponseError(err)
+	}
+
+	webhook := db.Webhook{
+		WebhookID: uuid.New().String(),
+		UserID:    userID,
+		URL:       req.URL,
+		Secret:    "whsec_" + hex.EncodeToString(secret),
+		Events:    req.Events,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+
+	err = db.CreateWebhook(ctx, webhook)
+	if err != nil {
+		log.Printf("Error creating webhook: %v", err)
+		return utils.ResponseError(err)
+	}
+
+	return utils.ResponseOK(struct {
+		db.Webhook
+		Secret string `json:"secret"`
+	}{webhook, webhook.Secret})
+}
+
+func ListWebhooks(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := jwtSubject(request)
+	if userID == "" {
+		log.Println("Unable to extract user ID from JWT claims")
+		return utils.ResponseError(fmt.Errorf("unable to extract user ID from JWT claims"))
+	}
+
+	webhooks, err := db.ListUserWebhooks(ctx, userID)
+	if err != nil {
+		log.Printf("Error listing webhooks: %v", err)
+		return utils.ResponseError(err)
+	}
+
+	return utils.ResponseOK(webhooks)
+}
+
+func DeleteWebhook(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := jwtSubject(request)
+	if userID == "" {
+		log.Println("Unable to extract user ID from JWT claims")
+		return utils.ResponseError(fmt.Errorf("unable to extract user ID from JWT claims"))
+	}
+
+	err := db.DeleteWebhook(ctx, request.PathParameters["webhookId"], userID)
+	return webhookResult(err)
+}
+
+// EnableWebhook re-enables a webhook that was disabled after repeated failures
+func EnableWebhook(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := jwtSubject(request)
+	if userID == "" {
+		log.Println("Unable to extract user ID from JWT claims")
+		return utils.ResponseError(fmt.Errorf("unable to extract user ID from JWT claims"))
+	}
+
+	err := db.EnableWebhook(ctx, request.PathParameters["webhookId"], userID)
+	return webhookResult(err)
+}
+
+// ListWebhookDeliveries returns a page of a webhook's delivery log to its owner
+func ListWebhookDeliveries(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := jwtSubject(request)
+	if userID == "" {
+		log.Println("Unable to extract user ID from JWT claims")
+		return utils.ResponseError(fmt.Errorf("unable to extract user ID from JWT claims"))
+	}
+
+	webhook, err := db.GetWebhook(ctx, request.PathParameters["webhookId"])
+	if err != nil {
+		return utils.ResponseError(err)
+	}
+	if webhook == nil || webhook.UserID != userID {
+		return utils.ResponseError(utils.ErrNotFound)
+	}
+
+	limit, err := pageSize(request)
+	if err != nil {
+		return events.APIGatewayProxyResponse{StatusCode: 400, Body: err.Error()}, nil
+	}
+
+	deliveries, cursor, err := db.ListWebhookDeliveries(ctx, webhook.WebhookID, request.QueryStringParameters["cursor"], limit)
+	if errors.Is(err, db.ErrInvalidCursor) {
+		return events.APIGatewayProxyResponse{StatusCode: 400, Body: err.Error()}, nil
+	}
+	if err != nil {
+		log.Printf("Error listing webhook deliveries: %v", err)
+		return utils.ResponseError(err)
+	}
+
+	return utils.ResponseOK(struct {
+		Deliveries []db.WebhookDelivery `json:"deliveries"`
+		NextCursor string               `json:"nextCursor,omitempty"`
+	}{deliveries, cursor})
+}
+
+func webhookResult(err error) (events.APIGatewayProxyResponse, error) {
+	if errors.Is(err, db.ErrWebhookNotFound) {
+		return utils.ResponseError(utils.ErrNotFound)
+	}
+	if err != nil {
+		log.Printf("Error updating webhook: %v", err)
+		return utils.ResponseError(err)
+	}
+
+	return events.APIGatewayProxyResponse{StatusCode: 204}, nil
+}
+
+func validateWebhook(req CreateWebhookRequest) error {
+	u, err := url.Parse(req.URL)
+	if err != nil || u.Host == "" {
+		return errors.New("url must be an absolute URL")
+	}
+	if u.Scheme != "https" {
+		return errors.New("url must use https")
+	}
+	if err := checkHost(u.Hostname()); err != nil {
+		return err
+	}
+
+	for _, eventType := range req.Events {
+		if !notificationTypes[eventType] {
+			return fmt.Errorf("unknown event type %q", eventType)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/johnnynu/agreatchaos/api/internal/db"
+	"github.com/johnnynu/agreatchaos/api/pkg/utils"
+)
+
+// connectionTTL matches the longest a WebSocket API keeps a connection open,
+// the TTL removes the rows whose disconnect never arrived
+const connectionTTL = 2 * time.Hour
+
+// subscribeMessage is sent by clients on the subscribe route to choose the
+// event types they receive, e.g. {"action":"subscribe","events":["file.deleted"]}
+type subscribeMessage struct {
+	Action string   `json:"action"`
+	Events []string `json:"events"`
+}
+
+func WebSocketConnect(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := websocketUserID(request)
+	if userID == "" {
+		log.Println("Unable to extract user ID from the authorizer context")
+		return events.APIGatewayProxyResponse{StatusCode: 401}, nil
+	}
+
+	now := time.Now()
+	err := db.CreateConnection(ctx, db.Connection{
+		ConnectionID: request.RequestContext.ConnectionID,
+		UserID:       userID,
+		Endpoint:     websocketEndpoint(request),
+		ConnectedAt:  now.UTC().Format(time.RFC3339),
+		ExpiresAt:    now.Add(connectionTTL).Unix(),
+	})
+	if err != nil {
+		log.Printf("Error storing connection: %v", err)
+		return utils.ResponseError(err)
+	}
+
+	return events.APIGatewayProxyResponse{StatusCode: 200}, nil
+}
+
+func WebSocketDisconnect(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+	err := db.DeleteConnection(ctx, request.RequestContext.ConnectionID)
+	if err != nil {
+		log.Printf("Error deleting connection: %v", err)
+		return utils.ResponseError(err)
+	}
+
+	return events.APIGatewayProxyResponse{StatusCode: 200}, nil
+}
+
+func WebSocketSubscribe(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := websocketUserID(request)
+	if userID == "" {
+		log.Println("Unable to extract user ID from the authorizer context")
+		return events.APIGatewayProxyResponse{StatusCode: 401}, nil
+	}
+
+	var msg subscribeMessage
+	err := json.Unmarshal([]byte(request.Body), &msg)
+	if err != nil {
+		return events.APIGatewayProxyResponse{StatusCode: 400, Body: "invalid subscribe message"}, nil
+	}
+
+	for _, eventType := range msg.Events {
+		if !notificationTypes[eventType] {
+			return events.APIGatewayProxyResponse{StatusCode: 400, Body: fmt.Sprintf("unknown event type %q", eventType)}, nil
+		}
+	}
+
+	err = db.SetConnectionEvents(ctx, request.RequestContext.ConnectionID, userID, msg.Events)
+	if err != nil {
+		log.Printf("Error updating connection: %v", err)
+		return utils.ResponseError(err)
+	}
+
+	return events.APIGatewayProxyResponse{StatusCode: 200}, nil
+}
+
+// websocketUserID returns the user the Lambda authorizer of the $connect route
+// resolved the token to. The authorizer context is passed on to every route.
+func websocketUserID(request events.APIGatewayWebsocketProxyRequest) string {
+	authorizer, ok := request.RequestContext.Authorizer.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+
+	if sub, ok := authorizer["sub"].(string); ok {
+		return sub
+	}
+	if principalID, ok := authorizer["principalId"].(string); ok {
+		return principalID
+	}
+
+	return ""
+}
+
+// websocketEndpoint returns the connection management endpoint for a
+// connection. WEBSOCKET_ENDPOINT overrides it when the API sits behind a
+// custom domain.
+func websocketEndpoint(request events.APIGatewayWebsocketProxyRequest) string {
+	if endpoint := os.Getenv("WEBSOCKET_ENDPOINT"); endpoint != "" {
+		return endpoint
+	}
+
+	return fmt.Sprintf("https://%s/%s", request.RequestContext.DomainName, request.RequestContext.Stage)
+}
@@ -0,0 +1,115 @@
+package scan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// clamdChunkSize is the size of the chunks content is streamed to clamd in
+const clamdChunkSize = 64 * 1024
+
+// Clamd scans content with a clamd daemon, using its INSTREAM command
+type Clamd struct {
+	Network string
+	Address string
+	// Timeout bounds a whole scan, including streaming the content
+	Timeout time.Duration
+}
+
+func (c *Clamd) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	version, err := c.Version(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+
+	reply, err := c.command(ctx, "INSTREAM", r)
+	if err != nil {
+		return Result{}, err
+	}
+
+	// replies look like "stream: OK" or "stream: Eicar-Signature FOUND"
+	status := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case status == "OK":
+		return Result{Engine: version}, nil
+	case strings.HasSuffix(status, " FOUND"):
+		return Result{Infected: true, Signature: strings.TrimSuffix(status, " FOUND"), Engine: version}, nil
+	}
+
+	return Result{}, fmt.Errorf("clamd: %s", reply)
+}
+
+// Version returns the engine and signature database version of the daemon
+func (c *Clamd) Version(ctx context.Context) (string, error) {
+	return c.command(ctx, "VERSION", nil)
+}
+
+// command sends a null-terminated command, streams content after it if given,
+// and returns the reply
+func (c *Clamd) command(ctx context.Context, name string, content io.Reader) (string, error) {
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+	conn, err := dialer.DialContext(ctx, c.Network, c.Address)
+	if err != nil {
+		return "", fmt.Errorf("clamd: %v", err)
+	}
+	defer conn.Close()
+
+	if c.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.Timeout))
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	_, err = conn.Write([]byte("z" + name + "\x00"))
+	if err != nil {
+		return "", fmt.Errorf("clamd: %v", err)
+	}
+
+	if content != nil {
+		err = streamChunks(conn, content)
+		if err != nil {
+			return "", fmt.Errorf("clamd: %v", err)
+		}
+	}
+
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil && len(reply) == 0 {
+		return "", fmt.Errorf("clamd: reading reply: %v", err)
+	}
+
+	return string(bytes.TrimRight(reply, "\x00\n")), nil
+}
+
+// streamChunks writes content as length-prefixed chunks followed by an empty
+// chunk. clamd stops reading once a stream exceeds its StreamMaxLength, so its
+// reply is what tells whether the stream was accepted.
+func streamChunks(w io.Writer, content io.Reader) error {
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := io.ReadFull(content, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			_, werr := w.Write(buf[:4+n])
+			if werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := w.Write([]byte{0, 0, 0, 0})
+	return err
+}
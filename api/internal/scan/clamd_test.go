@@ -0,0 +1,186 @@
+package scan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClamd speaks enough of the clamd protocol for Clamd: null-terminated
+// VERSION and INSTREAM commands, with the stream sent as length-prefixed chunks
+type fakeClamd struct {
+	listener net.Listener
+	// reply overrides the INSTREAM reply when set
+	reply string
+	mu    sync.Mutex
+	// received is the content of the last stream, chunks the size of each chunk
+	received []byte
+	chunks   []int
+}
+
+func newFakeClamd(t *testing.T) *fakeClamd {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	clamd := &fakeClamd{listener: listener}
+	go clamd.serve()
+
+	return clamd
+}
+
+func (f *fakeClamd) client() *Clamd {
+	return &Clamd{Network: "tcp", Address: f.listener.Addr().String(), Timeout: 5 * time.Second}
+}
+
+func (f *fakeClamd) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		f.handle(conn)
+	}
+}
+
+func (f *fakeClamd) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	command, err := r.ReadString(0)
+	if err != nil {
+		return
+	}
+
+	switch command {
+	case "zVERSION\x00":
+		conn.Write([]byte("ClamAV 1.0.0/27000/Mon Jan  1 00:00:00 2024\x00"))
+	case "zINSTREAM\x00":
+		var content []byte
+		var chunks []int
+		for {
+			var size uint32
+			if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+				return
+			}
+			if size == 0 {
+				break
+			}
+
+			chunk := make([]byte, size)
+			if _, err := io.ReadFull(r, chunk); err != nil {
+				return
+			}
+			content = append(content, chunk...)
+			chunks = append(chunks, int(size))
+		}
+		f.mu.Lock()
+		f.received, f.chunks = content, chunks
+		f.mu.Unlock()
+
+		reply := "stream: OK"
+		switch {
+		case f.reply != "":
+			reply = f.reply
+		case bytes.Contains(content, []byte(eicar)):
+			reply = "stream: Eicar-Signature FOUND"
+		}
+		conn.Write([]byte(reply + "\x00"))
+	default:
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+	}
+}
+
+func TestClamdScan(t *testing.T) {
+	tests := []struct {
+		name          string
+		content       string
+		reply         string
+		wantInfected  bool
+		wantSignature string
+		wantErr       bool
+	}{
+		{name: "clean", content: "hello world"},
+		{name: "empty", content: ""},
+		{name: "infected", content: "some bytes " + eicar, wantInfected: true, wantSignature: "Eicar-Signature"},
+		{name: "size limit", content: "hello", reply: "INSTREAM size limit exceeded. ERROR", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clamd := newFakeClamd(t)
+			clamd.reply = tt.reply
+
+			result, err := clamd.client().Scan(context.Background(), strings.NewReader(tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Scan() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if result.Infected != tt.wantInfected || result.Signature != tt.wantSignature {
+				t.Errorf("Scan() = %+v, want infected %v with %q", result, tt.wantInfected, tt.wantSignature)
+			}
+			if !strings.HasPrefix(result.Engine, "ClamAV 1.0.0") {
+				t.Errorf("Engine = %q", result.Engine)
+			}
+			clamd.mu.Lock()
+			defer clamd.mu.Unlock()
+			if string(clamd.received) != tt.content {
+				t.Errorf("clamd received %d bytes, want %d", len(clamd.received), len(tt.content))
+			}
+		})
+	}
+}
+
+func TestClamdStreamsChunks(t *testing.T) {
+	clamd := newFakeClamd(t)
+	content := bytes.Repeat([]byte("x"), 2*clamdChunkSize+10)
+
+	_, err := clamd.client().Scan(context.Background(), bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clamd.mu.Lock()
+	defer clamd.mu.Unlock()
+
+	want := []int{clamdChunkSize, clamdChunkSize, 10}
+	if len(clamd.chunks) != len(want) || clamd.chunks[0] != want[0] || clamd.chunks[1] != want[1] || clamd.chunks[2] != want[2] {
+		t.Errorf("chunks = %v, want %v", clamd.chunks, want)
+	}
+	if !bytes.Equal(clamd.received, content) {
+		t.Error("clamd received different content")
+	}
+}
+
+func TestClamdUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	_, err = (&Clamd{Network: "tcp", Address: address}).Scan(context.Background(), strings.NewReader("hello"))
+	if err == nil {
+		t.Error("Scan() succeeded without a daemon")
+	}
+}
+
+func TestFakeDetectsEicar(t *testing.T) {
+	result, err := Fake{}.Scan(context.Background(), strings.NewReader(eicar))
+	if err != nil || !result.Infected {
+		t.Errorf("Scan() = %+v, %v, want infected", result, err)
+	}
+}
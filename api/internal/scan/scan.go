@@ -0,0 +1,63 @@
+// Package scan checks uploaded content for malware.
+package scan
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"time"
+)
+
+// Result is the outcome of scanning some content
+type Result struct {
+	Infected bool
+	// Signature names the malware found in infected content
+	Signature string
+	// Engine identifies the scanner and its signature database version
+	Engine string
+}
+
+// Scanner scans content read from r
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (Result, error)
+}
+
+// FromEnv returns the scanner selected by SCANNER: "clamd", which connects to
+// CLAMD_ADDRESS, or "fake". It returns nil when scanning is disabled.
+func FromEnv() Scanner {
+	switch os.Getenv("SCANNER") {
+	case "clamd":
+		address := os.Getenv("CLAMD_ADDRESS")
+		if address == "" {
+			address = "localhost:3310"
+		}
+		return &Clamd{Network: "tcp", Address: address, Timeout: 5 * time.Minute}
+	case "fake":
+		return Fake{}
+	}
+
+	return nil
+}
+
+// eicar is the standard antivirus test string
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// Fake is a scanner that only detects the EICAR test string, for tests and
+// local development
+type Fake struct{}
+
+func (Fake) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return Result{}, err
+	}
+
+	result := Result{Engine: "fake"}
+	if bytes.Contains(data, []byte(eicar)) {
+		result.Infected = true
+		result.Signature = "Eicar-Test-Signature"
+	}
+
+	return result, nil
+}
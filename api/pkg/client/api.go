@@ -0,0 +1,163 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+// File is the metadata of a stored file
+type File struct {
+	FileID         string `json:"FileID"`
+	UserID         string `json:"UserID"`
+	FileName       string `json:"FileName"`
+	FileSize       int64  `json:"FileSize"`
+	FileType       string `json:"FileType"`
+	CreatedAt      string `json:"CreatedAt"`
+	UpdatedAt      string `json:"UpdatedAt"`
+	ChecksumSHA256 string `json:"ChecksumSHA256,omitempty"`
+	BlobID         string `json:"BlobID,omitempty"`
+	Status         string `json:"Status,omitempty"`
+	StatusReason   string `json:"StatusReason,omitempty"`
+}
+
+type SigninResponse struct {
+	Message   string `json:"message"`
+	IsNewUser bool   `json:"isNewUser"`
+}
+
+type CreateFileRequest struct {
+	FileName string `json:"file_name"`
+	FileSize int64  `json:"file_size"`
+	FileType string `json:"file_type"`
+}
+
+type UploadURLRequest struct {
+	FileName       string   `json:"fileName"`
+	FileType       string   `json:"fileType"`
+	FileSize       int64    `json:"fileSize"`
+	ChunkSize      int64    `json:"chunkSize,omitempty"`
+	ChecksumSHA256 string   `json:"checksumSHA256,omitempty"`
+	PartChecksums  []string `json:"partChecksums,omitempty"`
+	Dedup          bool     `json:"dedup,omitempty"`
+	UploadMethod   string   `json:"uploadMethod,omitempty"`
+}
+
+// UploadURLResponse holds the fields of whichever upload flow the API chose:
+// UploadURL for a single part PUT (or POST, with Fields), UploadID and PartURLs
+// for a multipart upload, or only FileID when Deduplicated.
+type UploadURLResponse struct {
+	FileID       string              `json:"fileID"`
+	UploadURL    string              `json:"uploadUrl,omitempty"`
+	Headers      map[string]string   `json:"headers,omitempty"`
+	Fields       map[string]string   `json:"fields,omitempty"`
+	UploadID     string              `json:"uploadId,omitempty"`
+	PartURLs     []string            `json:"partUrls,omitempty"`
+	PartHeaders  []map[string]string `json:"partHeaders,omitempty"`
+	Deduplicated bool                `json:"deduplicated,omitempty"`
+}
+
+type CompletedPart struct {
+	ETag           string `json:"ETag"`
+	PartNumber     int32  `json:"PartNumber"`
+	ChecksumSHA256 string `json:"ChecksumSHA256,omitempty"`
+}
+
+type CompleteUploadRequest struct {
+	FileID   string          `json:"fileID"`
+	UploadID string          `json:"uploadId"`
+	Parts    []CompletedPart `json:"parts"`
+}
+
+type CompleteUploadResponse struct {
+	Message        string `json:"message"`
+	FileID         string `json:"fileID"`
+	ChecksumSHA256 string `json:"checksumSHA256"`
+}
+
+type DownloadURL struct {
+	DownloadURL    string `json:"downloadUrl"`
+	FileName       string `json:"fileName"`
+	ContentType    string `json:"contentType"`
+	ChecksumSHA256 string `json:"checksumSHA256"`
+}
+
+// Signin registers the token's user on first sign in
+func (c *Client) Signin(ctx context.Context) (*SigninResponse, error) {
+	var res SigninResponse
+	err := c.do(ctx, http.MethodPost, c.routes.Signin, nil, nil, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+// CreateFile creates file metadata without uploading any content
+func (c *Client) CreateFile(ctx context.Context, req CreateFileRequest) (*File, error) {
+	var file File
+	err := c.do(ctx, http.MethodPost, c.routes.CreateFile, nil, req, &file)
+	if err != nil {
+		return nil, err
+	}
+
+	return &file, nil
+}
+
+// GenerateUploadURL creates a pending file and returns where to upload its content.
+// Most callers want Upload instead.
+func (c *Client) GenerateUploadURL(ctx context.Context, req UploadURLRequest) (*UploadURLResponse, error) {
+	var res UploadURLResponse
+	err := c.do(ctx, http.MethodPost, c.routes.UploadURL, nil, req, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+// CompleteUpload assembles the parts of a multipart upload
+func (c *Client) CompleteUpload(ctx context.Context, req CompleteUploadRequest) (*CompleteUploadResponse, error) {
+	var res CompleteUploadResponse
+	err := c.do(ctx, http.MethodPost, c.routes.CompleteUpload, nil, req, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+func (c *Client) ListFiles(ctx context.Context) ([]File, error) {
+	var files []File
+	err := c.do(ctx, http.MethodGet, c.routes.ListFiles, nil, nil, &files)
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+func (c *Client) PreviewFile(ctx context.Context, fileID string) (*File, error) {
+	var file File
+	err := c.do(ctx, http.MethodGet, route(c.routes.PreviewFile, fileID), nil, nil, &file)
+	if err != nil {
+		return nil, err
+	}
+
+	return &file, nil
+}
+
+// GenerateDownloadURL returns a short lived presigned URL for a file's content
+func (c *Client) GenerateDownloadURL(ctx context.Context, fileID string) (*DownloadURL, error) {
+	var res DownloadURL
+	err := c.do(ctx, http.MethodGet, c.routes.DownloadURL, url.Values{"fileID": {fileID}}, nil, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+func (c *Client) DeleteFile(ctx context.Context, fileID string) error {
+	return c.do(ctx, http.MethodDelete, route(c.routes.DeleteFile, fileID), nil, nil, nil)
+}
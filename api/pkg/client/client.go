@@ -0,0 +1,179 @@
+// Package client is a Go SDK for the ChaosFiles API.
+//
+// A Client wraps every endpoint with typed methods, and Upload and Download
+// take care of the presigned URL flows: Upload picks a single part or a
+// concurrent multipart upload based on the size, verifies content with SHA-256
+// checksums and finishes with CompleteUpload.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TokenSource supplies the bearer token sent with every API request
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// StaticToken is a TokenSource that always returns the same token
+type StaticToken string
+
+func (t StaticToken) Token(ctx context.Context) (string, error) {
+	return string(t), nil
+}
+
+// TokenFunc adapts a function, for example one refreshing Cognito tokens, to a TokenSource
+type TokenFunc func(ctx context.Context) (string, error)
+
+func (f TokenFunc) Token(ctx context.Context) (string, error) {
+	return f(ctx)
+}
+
+// Routes maps endpoints to their paths under the API base URL. Path parameters
+// are written as {fileId}.
+type Routes struct {
+	Signin         string
+	CreateFile     string
+	UploadURL      string
+	CompleteUpload string
+	ListFiles      string
+	PreviewFile    string
+	DownloadURL    string
+	DeleteFile     string
+}
+
+// DefaultRoutes are the paths of the ChaosFiles API Gateway deployment
+var DefaultRoutes = Routes{
+	Signin:         "/signin",
+	CreateFile:     "/create-file",
+	UploadURL:      "/upload-url",
+	CompleteUpload: "/complete-upload",
+	ListFiles:      "/chaosfiles-list-files",
+	PreviewFile:    "/preview-file/{fileId}",
+	DownloadURL:    "/download-url",
+	DeleteFile:     "/chaosfiles-delete-file/{fileId}",
+}
+
+// Client calls the ChaosFiles API. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	tokens     TokenSource
+	routes     Routes
+	httpClient *http.Client
+}
+
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client used for API calls and presigned transfers
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithRoutes overrides the endpoint paths, for deployments that don't use DefaultRoutes
+func WithRoutes(routes Routes) Option {
+	return func(c *Client) {
+		c.routes = routes
+	}
+}
+
+// New creates a client for the API at baseURL, for example
+// https://4j1h7lzpf5.execute-api.us-east-2.amazonaws.com/dev
+func New(baseURL string, tokens TokenSource, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		tokens:     tokens,
+		routes:     DefaultRoutes,
+		httpClient: &http.Client{Timeout: 5 * time.Minute},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// APIError is returned when the API answers with a non 2xx status
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("chaosfiles: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// route fills the {fileId} parameter of a path
+func route(path, fileID string) string {
+	return strings.ReplaceAll(path, "{fileId}", url.PathEscape(fileID))
+}
+
+// do sends an authenticated API request with an optional JSON body and decodes
+// the JSON response into out, if out is not nil
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		payload, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("chaosfiles: failed to marshal request: %v", err)
+		}
+		body = bytes.NewReader(payload)
+	}
+
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	if c.tokens != nil {
+		token, err := c.tokens.Token(ctx)
+		if err != nil {
+			return fmt.Errorf("chaosfiles: failed to get token: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return &APIError{StatusCode: res.StatusCode, Message: strings.TrimSpace(string(resBody))}
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	err = json.Unmarshal(resBody, out)
+	if err != nil {
+		return fmt.Errorf("chaosfiles: failed to decode response: %v", err)
+	}
+
+	return nil
+}
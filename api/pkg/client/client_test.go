@@ -0,0 +1,342 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeAPI serves the upload and download endpoints of the API along with the
+// presigned storage URLs they hand out
+type fakeAPI struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	// failures makes the next PUTs to a storage path fail with the given statuses
+	failures map[string][]int
+	puts     map[string]int
+	// uploadRequests and completed record what the client asked the API for
+	uploadRequests []UploadURLRequest
+	completed      []CompleteUploadRequest
+	// corrupt makes downloads serve different content than their checksum claims
+	corrupt bool
+}
+
+func newFakeAPI(t *testing.T) (*fakeAPI, *Client) {
+	api := &fakeAPI{
+		t:        t,
+		objects:  make(map[string][]byte),
+		failures: make(map[string][]int),
+		puts:     make(map[string]int),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/upload-url", api.uploadURL)
+	mux.HandleFunc("/complete-upload", api.completeUpload)
+	mux.HandleFunc("/download-url", api.downloadURL)
+	mux.HandleFunc("/storage/", api.storage)
+	api.server = httptest.NewServer(mux)
+	t.Cleanup(api.server.Close)
+
+	return api, New(api.server.URL, StaticToken("token"))
+}
+
+func (a *fakeAPI) uploadURL(w http.ResponseWriter, r *http.Request) {
+	var req UploadURLRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	a.mu.Lock()
+	a.uploadRequests = append(a.uploadRequests, req)
+	a.mu.Unlock()
+
+	res := UploadURLResponse{FileID: "file-1"}
+	if req.ChunkSize == 0 {
+		res.UploadURL = a.server.URL + "/storage/file-1"
+		res.Headers = map[string]string{"x-amz-checksum-sha256": req.ChecksumSHA256}
+	} else {
+		res.UploadID = "upload-1"
+		for i, checksum := range req.PartChecksums {
+			res.PartURLs = append(res.PartURLs, fmt.Sprintf("%s/storage/file-1.part%d", a.server.URL, i+1))
+			res.PartHeaders = append(res.PartHeaders, map[string]string{"x-amz-checksum-sha256": checksum})
+		}
+	}
+
+	json.NewEncoder(w).Encode(res)
+}
+
+func (a *fakeAPI) completeUpload(w http.ResponseWriter, r *http.Request) {
+	var req CompleteUploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.completed = append(a.completed, req)
+
+	var content []byte
+	for _, part := range req.Parts {
+		content = append(content, a.objects[fmt.Sprintf("/storage/file-1.part%d", part.PartNumber)]...)
+	}
+	a.objects["/storage/file-1"] = content
+
+	json.NewEncoder(w).Encode(CompleteUploadResponse{FileID: req.FileID})
+}
+
+func (a *fakeAPI) downloadURL(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	content := a.objects["/storage/"+r.URL.Query().Get("fileID")]
+	a.mu.Unlock()
+
+	json.NewEncoder(w).Encode(DownloadURL{
+		DownloadURL:    a.server.URL + "/storage/" + r.URL.Query().Get("fileID"),
+		ChecksumSHA256: sha256Base64(content),
+	})
+}
+
+// storage stands in for S3, rejecting content that doesn't match its checksum header
+func (a *fakeAPI) storage(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		a.puts[r.URL.Path]++
+		if failures := a.failures[r.URL.Path]; len(failures) > 0 {
+			a.failures[r.URL.Path] = failures[1:]
+			http.Error(w, "injected failure", failures[0])
+			return
+		}
+
+		if checksum := r.Header.Get("x-amz-checksum-sha256"); checksum != sha256Base64(body) {
+			http.Error(w, "checksum mismatch", http.StatusBadRequest)
+			return
+		}
+
+		a.objects[r.URL.Path] = body
+		w.Header().Set("ETag", fmt.Sprintf("%q", r.URL.Path))
+	case http.MethodGet:
+		content, ok := a.objects[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if a.corrupt {
+			content = bytes.ToUpper(content)
+		}
+		w.Write(content)
+	}
+}
+
+func sha256Base64(b []byte) string {
+	sum := sha256.Sum256(b)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestUploadPicksSingleOrMultipart(t *testing.T) {
+	content := []byte("the quick brown fox jumps over the lazy dog")
+
+	tests := []struct {
+		name      string
+		threshold int64
+		dedup     bool
+		wantParts int
+	}{
+		{name: "below threshold", threshold: 100},
+		{name: "above threshold", threshold: 10, wantParts: 3},
+		{name: "dedup is always single part", threshold: 10, dedup: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api, c := newFakeAPI(t)
+
+			fileID, err := c.Upload(context.Background(), "fox.txt", bytes.NewReader(content), int64(len(content)), &UploadOptions{
+				MultipartThreshold: tt.threshold,
+				PartSize:           16,
+				Dedup:              tt.dedup,
+			})
+			if err != nil {
+				t.Fatalf("Upload() error = %v", err)
+			}
+			if fileID != "file-1" {
+				t.Errorf("Upload() = %q, want file-1", fileID)
+			}
+
+			if len(api.uploadRequests) != 1 {
+				t.Fatalf("got %d upload URL requests, want 1", len(api.uploadRequests))
+			}
+			req := api.uploadRequests[0]
+			if len(req.PartChecksums) != tt.wantParts {
+				t.Errorf("requested %d parts, want %d", len(req.PartChecksums), tt.wantParts)
+			}
+
+			if tt.wantParts == 0 {
+				if req.ChecksumSHA256 != sha256Base64(content) {
+					t.Errorf("checksum = %q, want %q", req.ChecksumSHA256, sha256Base64(content))
+				}
+				if req.Dedup != tt.dedup {
+					t.Errorf("dedup = %v, want %v", req.Dedup, tt.dedup)
+				}
+				if len(api.completed) != 0 {
+					t.Errorf("single part upload was completed %d times", len(api.completed))
+				}
+			} else if len(api.completed) != 1 || len(api.completed[0].Parts) != tt.wantParts {
+				t.Errorf("completed %+v, want one completion of %d parts", api.completed, tt.wantParts)
+			}
+
+			if got := api.objects["/storage/file-1"]; !bytes.Equal(got, content) {
+				t.Errorf("stored %q, want %q", got, content)
+			}
+		})
+	}
+}
+
+func TestUploadRetriesParts(t *testing.T) {
+	content := []byte("the quick brown fox jumps over the lazy dog")
+
+	t.Run("retryable failures", func(t *testing.T) {
+		api, c := newFakeAPI(t)
+		api.failures["/storage/file-1.part2"] = []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}
+
+		var progress []int64
+		var mu sync.Mutex
+		_, err := c.Upload(context.Background(), "fox.txt", bytes.NewReader(content), int64(len(content)), &UploadOptions{
+			MultipartThreshold: 10,
+			PartSize:           16,
+			Concurrency:        1,
+			Progress: func(uploaded, total int64) {
+				mu.Lock()
+				progress = append(progress, uploaded)
+				mu.Unlock()
+			},
+		})
+		if err != nil {
+			t.Fatalf("Upload() error = %v", err)
+		}
+
+		if puts := api.puts["/storage/file-1.part2"]; puts != 3 {
+			t.Errorf("part 2 was sent %d times, want 3", puts)
+		}
+		if got := api.objects["/storage/file-1"]; !bytes.Equal(got, content) {
+			t.Errorf("stored %q, want %q", got, content)
+		}
+		if last := progress[len(progress)-1]; last != int64(len(content)) {
+			t.Errorf("final progress = %d, want %d", last, len(content))
+		}
+	})
+
+	t.Run("client errors aren't retried", func(t *testing.T) {
+		api, c := newFakeAPI(t)
+		api.failures["/storage/file-1.part2"] = []int{http.StatusForbidden}
+
+		_, err := c.Upload(context.Background(), "fox.txt", bytes.NewReader(content), int64(len(content)), &UploadOptions{
+			MultipartThreshold: 10,
+			PartSize:           16,
+			Concurrency:        1,
+		})
+		var transferErr *transferError
+		if !errors.As(err, &transferErr) || transferErr.StatusCode != http.StatusForbidden {
+			t.Fatalf("Upload() error = %v, want a 403 transfer error", err)
+		}
+
+		if puts := api.puts["/storage/file-1.part2"]; puts != 1 {
+			t.Errorf("part 2 was sent %d times, want 1", puts)
+		}
+		if len(api.completed) != 0 {
+			t.Errorf("failed upload was completed")
+		}
+	})
+
+	t.Run("retries run out", func(t *testing.T) {
+		api, c := newFakeAPI(t)
+		api.failures["/storage/file-1"] = []int{http.StatusInternalServerError, http.StatusInternalServerError}
+
+		_, err := c.Upload(context.Background(), "fox.txt", bytes.NewReader(content), int64(len(content)), &UploadOptions{
+			Retries: 1,
+		})
+		if err == nil {
+			t.Fatal("Upload() succeeded, want an error")
+		}
+		if puts := api.puts["/storage/file-1"]; puts != 2 {
+			t.Errorf("object was sent %d times, want 2", puts)
+		}
+	})
+}
+
+func TestDownloadVerifiesChecksum(t *testing.T) {
+	content := []byte("the quick brown fox jumps over the lazy dog")
+
+	t.Run("matching content", func(t *testing.T) {
+		api, c := newFakeAPI(t)
+		api.objects["/storage/file-1"] = content
+
+		var buf bytes.Buffer
+		_, err := c.Download(context.Background(), "file-1", &buf)
+		if err != nil {
+			t.Fatalf("Download() error = %v", err)
+		}
+		if !bytes.Equal(buf.Bytes(), content) {
+			t.Errorf("downloaded %q, want %q", buf.Bytes(), content)
+		}
+	})
+
+	t.Run("corrupted content", func(t *testing.T) {
+		api, c := newFakeAPI(t)
+		api.objects["/storage/file-1"] = content
+		api.corrupt = true
+
+		_, err := c.Download(context.Background(), "file-1", io.Discard)
+		if !errors.Is(err, ErrChecksumMismatch) {
+			t.Fatalf("Download() error = %v, want ErrChecksumMismatch", err)
+		}
+	})
+
+	t.Run("storage error", func(t *testing.T) {
+		_, c := newFakeAPI(t)
+
+		_, err := c.Download(context.Background(), "missing", io.Discard)
+		var transferErr *transferError
+		if !errors.As(err, &transferErr) || transferErr.StatusCode != http.StatusNotFound {
+			t.Fatalf("Download() error = %v, want a 404 transfer error", err)
+		}
+	})
+}
+
+func TestAPIErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("Authorization = %q", r.Header.Get("Authorization"))
+		}
+		http.Error(w, "file not found", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	_, err := New(server.URL, StaticToken("token")).GenerateDownloadURL(context.Background(), "file-1")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound || !strings.Contains(apiErr.Message, "file not found") {
+		t.Fatalf("GenerateDownloadURL() error = %v, want a 404 APIError", err)
+	}
+}
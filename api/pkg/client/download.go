@@ -0,0 +1,61 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ErrChecksumMismatch is returned by Download when the content doesn't match
+// the checksum recorded for the file
+var ErrChecksumMismatch = errors.New("chaosfiles: downloaded content does not match its checksum")
+
+// Download writes a file's content to w, following its presigned download URL.
+// Content with a whole-object checksum is verified, in which case w may have
+// received the corrupted bytes by the time ErrChecksumMismatch is returned.
+func (c *Client) Download(ctx context.Context, fileID string, w io.Writer) (*DownloadURL, error) {
+	dl, err := c.GenerateDownloadURL(ctx, fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, dl.DownloadURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		return nil, &transferError{StatusCode: res.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+
+	expected := res.Header.Get("x-amz-checksum-sha256")
+	if expected == "" {
+		expected = dl.ChecksumSHA256
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(w, h), res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// composite multipart checksums ("<digest>-<parts>") can't be checked against the whole body
+	if expected != "" && !strings.Contains(expected, "-") {
+		if base64.StdEncoding.EncodeToString(h.Sum(nil)) != expected {
+			return nil, ErrChecksumMismatch
+		}
+	}
+
+	return dl, nil
+}
@@ -0,0 +1,477 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultMultipartThreshold matches the size above which the API expects multipart uploads
+	DefaultMultipartThreshold = 100 * 1024 * 1024
+	minPartSize               = 8 * 1024 * 1024
+	maxParts                  = 10000
+)
+
+// UploadOptions tune Upload. The zero value is usable.
+type UploadOptions struct {
+	// ContentType defaults to application/octet-stream
+	ContentType string
+	// MultipartThreshold is the size from which a multipart upload is used,
+	// DefaultMultipartThreshold if zero
+	MultipartThreshold int64
+	// PartSize is the multipart chunk size, DefaultPartSize if zero
+	PartSize int64
+	// Concurrency is the number of parts uploaded at once, 4 if zero
+	Concurrency int
+	// Retries is the number of times a failed part is retried, 3 if zero
+	Retries int
+	// Dedup asks the API to store the content in a shared blob, which skips
+	// the upload entirely when the same content is already stored
+	Dedup bool
+	// Progress, if set, is called with the number of bytes uploaded so far.
+	// It may be called from several goroutines at once.
+	Progress func(uploaded, total int64)
+	// OnPartDone, if set, is called after each multipart part is uploaded, for
+	// example to persist a MultipartUpload so it can be resumed
+	OnPartDone func(upload *MultipartUpload)
+}
+
+func (o *UploadOptions) withDefaults(size int64) UploadOptions {
+	opts := *o
+	if opts.ContentType == "" {
+		opts.ContentType = "application/octet-stream"
+	}
+	if opts.MultipartThreshold == 0 {
+		opts.MultipartThreshold = DefaultMultipartThreshold
+	}
+	if opts.PartSize == 0 {
+		opts.PartSize = DefaultPartSize(size)
+	}
+	if opts.Concurrency == 0 {
+		opts.Concurrency = 4
+	}
+	if opts.Retries == 0 {
+		opts.Retries = 3
+	}
+
+	return opts
+}
+
+// DefaultPartSize is the part size Upload uses for a multipart upload of size
+// bytes: the smallest size above 8MB that keeps the upload within 10000 parts
+func DefaultPartSize(size int64) int64 {
+	partSize := int64(minPartSize)
+	if perPart := (size + maxParts - 1) / maxParts; perPart > partSize {
+		partSize = perPart
+	}
+
+	return partSize
+}
+
+// Upload stores size bytes read from r as a new file and returns its ID.
+// Content is hashed up front so that S3 rejects anything corrupted in transit.
+func (c *Client) Upload(ctx context.Context, name string, r io.ReaderAt, size int64, opts *UploadOptions) (string, error) {
+	if opts == nil {
+		opts = &UploadOptions{}
+	}
+	o := opts.withDefaults(size)
+
+	if size < o.MultipartThreshold || o.Dedup {
+		return c.uploadSinglePart(ctx, name, r, size, o)
+	}
+
+	upload, err := c.StartMultipartUpload(ctx, name, r, size, &o)
+	if err != nil {
+		return "", err
+	}
+
+	err = c.UploadParts(ctx, upload, r, &o)
+	if err != nil {
+		return "", err
+	}
+
+	err = c.FinishMultipartUpload(ctx, upload)
+	if err != nil {
+		return "", err
+	}
+
+	return upload.FileID, nil
+}
+
+func (c *Client) uploadSinglePart(ctx context.Context, name string, r io.ReaderAt, size int64, o UploadOptions) (string, error) {
+	checksum, err := checksumSHA256(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return "", err
+	}
+
+	res, err := c.GenerateUploadURL(ctx, UploadURLRequest{
+		FileName:       name,
+		FileType:       o.ContentType,
+		FileSize:       size,
+		ChecksumSHA256: checksum,
+		Dedup:          o.Dedup,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if res.Deduplicated {
+		if o.Progress != nil {
+			o.Progress(size, size)
+		}
+		return res.FileID, nil
+	}
+
+	var uploaded atomic.Int64
+	headers := map[string]string{"Content-Type": o.ContentType}
+	for name, value := range res.Headers {
+		headers[name] = value
+	}
+
+	_, err = c.putWithRetries(ctx, res.UploadURL, headers, r, 0, size, o, size, &uploaded)
+	if err != nil {
+		return "", err
+	}
+
+	return res.FileID, nil
+}
+
+// MultipartUpload is the state of a multipart upload. It can be saved, for
+// example as JSON, and handed back to UploadParts to resume the upload.
+type MultipartUpload struct {
+	FileID      string              `json:"fileID"`
+	UploadID    string              `json:"uploadId"`
+	Size        int64               `json:"size"`
+	PartSize    int64               `json:"partSize"`
+	PartURLs    []string            `json:"partUrls"`
+	PartHeaders []map[string]string `json:"partHeaders,omitempty"`
+	// Parts has an entry per part, with an empty ETag until the part is uploaded
+	Parts []CompletedPart `json:"parts"`
+	// ExpiresAt is when the presigned part URLs stop working
+	ExpiresAt time.Time `json:"expiresAt"`
+
+	mu sync.Mutex
+}
+
+// partURLLifetime is how long the API's presigned part URLs are valid
+const partURLLifetime = 24 * time.Hour
+
+// StartMultipartUpload hashes each part of r and creates the multipart upload
+func (c *Client) StartMultipartUpload(ctx context.Context, name string, r io.ReaderAt, size int64, opts *UploadOptions) (*MultipartUpload, error) {
+	if opts == nil {
+		opts = &UploadOptions{}
+	}
+	o := opts.withDefaults(size)
+
+	numParts := int((size + o.PartSize - 1) / o.PartSize)
+	if numParts > maxParts {
+		return nil, fmt.Errorf("chaosfiles: %d parts of %d bytes exceed the %d part limit", numParts, o.PartSize, maxParts)
+	}
+
+	parts := make([]CompletedPart, numParts)
+	checksums := make([]string, numParts)
+	for i := range parts {
+		offset, length := partRange(i, o.PartSize, size)
+		checksum, err := checksumSHA256(io.NewSectionReader(r, offset, length))
+		if err != nil {
+			return nil, err
+		}
+
+		checksums[i] = checksum
+		parts[i] = CompletedPart{PartNumber: int32(i + 1), ChecksumSHA256: checksum}
+	}
+
+	startedAt := time.Now()
+	res, err := c.GenerateUploadURL(ctx, UploadURLRequest{
+		FileName:      name,
+		FileType:      o.ContentType,
+		FileSize:      size,
+		ChunkSize:     o.PartSize,
+		PartChecksums: checksums,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res.PartURLs) != numParts {
+		return nil, fmt.Errorf("chaosfiles: expected %d part URLs, got %d", numParts, len(res.PartURLs))
+	}
+
+	return &MultipartUpload{
+		FileID:      res.FileID,
+		UploadID:    res.UploadID,
+		Size:        size,
+		PartSize:    o.PartSize,
+		PartURLs:    res.PartURLs,
+		PartHeaders: res.PartHeaders,
+		Parts:       parts,
+		ExpiresAt:   startedAt.Add(partURLLifetime),
+	}, nil
+}
+
+// UploadParts uploads every part of upload that isn't done yet, o.Concurrency at
+// a time, retrying failed parts with exponential backoff
+func (c *Client) UploadParts(ctx context.Context, upload *MultipartUpload, r io.ReaderAt, opts *UploadOptions) error {
+	if opts == nil {
+		opts = &UploadOptions{}
+	}
+	o := opts.withDefaults(upload.Size)
+
+	if time.Now().After(upload.ExpiresAt) {
+		return errors.New("chaosfiles: the part URLs of this upload have expired")
+	}
+
+	var uploaded atomic.Int64
+	var pending []int
+	for i, part := range upload.Parts {
+		if part.ETag != "" {
+			_, length := partRange(i, upload.PartSize, upload.Size)
+			uploaded.Add(length)
+			continue
+		}
+		pending = append(pending, i)
+	}
+
+	if o.Progress != nil {
+		o.Progress(uploaded.Load(), upload.Size)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var firstErr error
+	var errOnce sync.Once
+	sem := make(chan struct{}, o.Concurrency)
+
+	for _, i := range pending {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			headers := map[string]string{}
+			if i < len(upload.PartHeaders) {
+				for name, value := range upload.PartHeaders[i] {
+					headers[name] = value
+				}
+			}
+
+			offset, length := partRange(i, upload.PartSize, upload.Size)
+			etag, err := c.putWithRetries(ctx, upload.PartURLs[i], headers, r, offset, length, o, upload.Size, &uploaded)
+			if err != nil {
+				errOnce.Do(func() {
+					firstErr = fmt.Errorf("chaosfiles: part %d: %w", i+1, err)
+					cancel()
+				})
+				return
+			}
+
+			upload.mu.Lock()
+			upload.Parts[i].ETag = etag
+			upload.mu.Unlock()
+
+			if o.OnPartDone != nil {
+				o.OnPartDone(upload)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+
+	return ctx.Err()
+}
+
+// FinishMultipartUpload completes an upload whose parts are all uploaded
+func (c *Client) FinishMultipartUpload(ctx context.Context, upload *MultipartUpload) error {
+	for _, part := range upload.Parts {
+		if part.ETag == "" {
+			return fmt.Errorf("chaosfiles: part %d has not been uploaded", part.PartNumber)
+		}
+	}
+
+	_, err := c.CompleteUpload(ctx, CompleteUploadRequest{
+		FileID:   upload.FileID,
+		UploadID: upload.UploadID,
+		Parts:    upload.Parts,
+	})
+
+	return err
+}
+
+// Lock and Unlock guard Parts while parts are being uploaded, for callers
+// persisting the upload from OnPartDone
+func (u *MultipartUpload) Lock() {
+	u.mu.Lock()
+}
+
+func (u *MultipartUpload) Unlock() {
+	u.mu.Unlock()
+}
+
+// putWithRetries PUTs a section of r to a presigned URL and returns the ETag S3 answered with
+func (c *Client) putWithRetries(ctx context.Context, url string, headers map[string]string, r io.ReaderAt, offset, length int64, o UploadOptions, total int64, uploaded *atomic.Int64) (string, error) {
+	var lastErr error
+	for attempt := 0; attempt <= o.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff(attempt)):
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+		}
+
+		var sent int64
+		body := &progressReader{
+			r: io.NewSectionReader(r, offset, length),
+			onRead: func(n int) {
+				sent += int64(n)
+				if o.Progress != nil {
+					o.Progress(uploaded.Add(int64(n)), total)
+				} else {
+					uploaded.Add(int64(n))
+				}
+			},
+		}
+
+		etag, err := c.put(ctx, url, headers, body, length)
+		if err == nil {
+			return etag, nil
+		}
+
+		// take back the progress of the failed attempt
+		uploaded.Add(-sent)
+		lastErr = err
+
+		var transferErr *transferError
+		if errors.As(err, &transferErr) && !transferErr.retryable() {
+			return "", err
+		}
+	}
+
+	return "", lastErr
+}
+
+func (c *Client) put(ctx context.Context, url string, headers map[string]string, body io.Reader, length int64) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, body)
+	if err != nil {
+		return "", err
+	}
+
+	req.ContentLength = length
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		return "", &transferError{StatusCode: res.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+
+	return res.Header.Get("ETag"), nil
+}
+
+// transferError is a failed request against a presigned S3 URL
+type transferError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *transferError) Error() string {
+	return fmt.Sprintf("storage returned %d: %s", e.StatusCode, e.Message)
+}
+
+func (e *transferError) retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+func backoff(attempt int) time.Duration {
+	return time.Duration(1<<uint(attempt-1)) * 500 * time.Millisecond
+}
+
+// partRange returns the offset and length of the i-th part
+func partRange(i int, partSize, size int64) (int64, int64) {
+	offset := int64(i) * partSize
+	length := partSize
+	if offset+length > size {
+		length = size - offset
+	}
+
+	return offset, length
+}
+
+// ContentChecksum computes the checksum S3 records for content uploaded by
+// Upload: the SHA-256 of the whole content for a single part upload, or for a
+// multipart upload the SHA-256 of the concatenated part digests followed by
+// "-<parts>". It lets callers compare local content with File.ChecksumSHA256.
+func ContentChecksum(r io.ReaderAt, size, partSize int64, multipart bool) (string, error) {
+	if !multipart {
+		return checksumSHA256(io.NewSectionReader(r, 0, size))
+	}
+
+	numParts := int((size + partSize - 1) / partSize)
+	composite := sha256.New()
+	for i := 0; i < numParts; i++ {
+		offset, length := partRange(i, partSize, size)
+
+		h := sha256.New()
+		_, err := io.Copy(h, io.NewSectionReader(r, offset, length))
+		if err != nil {
+			return "", fmt.Errorf("chaosfiles: failed to hash content: %v", err)
+		}
+		composite.Write(h.Sum(nil))
+	}
+
+	return fmt.Sprintf("%s-%d", base64.StdEncoding.EncodeToString(composite.Sum(nil)), numParts), nil
+}
+
+func checksumSHA256(r io.Reader) (string, error) {
+	h := sha256.New()
+	_, err := io.Copy(h, r)
+	if err != nil {
+		return "", fmt.Errorf("chaosfiles: failed to hash content: %v", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+type progressReader struct {
+	r      io.Reader
+	onRead func(n int)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.onRead(n)
+	}
+
+	return n, err
+}